@@ -37,7 +37,7 @@ type Process struct {
 // New returns an instantiated daemon. binName is the expected
 // /proc/<pid>/cmdline value used for exit detection; pass cmd for plain
 // invocations, or the post-exec binary name for exec wrappers (e.g.
-// "dockerd" when cmd is "unshare ... -- sh -c 'exec dockerd ...'").
+// "dockerd" when cmd is "unshare ... envbox delegate-cgroups -- dockerd ...").
 func New(ctx context.Context, log slog.Logger, binName, cmd string, args ...string) *Process {
 	ctx, cancel := context.WithCancel(ctx)
 	return &Process{
@@ -0,0 +1,74 @@
+package cli
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+
+	"github.com/spf13/cobra"
+	"golang.org/x/xerrors"
+
+	"cdr.dev/slog/v3"
+	"cdr.dev/slog/v3/sloggers/slogjson"
+	"github.com/coder/envbox/xunix"
+	"github.com/coder/envbox/xunix/cgroup"
+)
+
+// delegateCGroupsCmdName is the name of the subcommand dockerd is wrapped
+// with.
+const delegateCGroupsCmdName = "delegate-cgroups"
+
+type delegateCGroupsFlags struct {
+	controllers []string
+	maxAttempts int
+}
+
+// delegateCGroupsCmd delegates the cgroupv2 hierarchy of the cgroup namespace
+// it is run in and then execs into its arguments. It is run by envbox via
+// `unshare --cgroup` to start dockerd (see wrapDockerdCmd) and isn't meant to
+// be run directly.
+func delegateCGroupsCmd() *cobra.Command {
+	var flags delegateCGroupsFlags
+
+	cmd := &cobra.Command{
+		Use:    delegateCGroupsCmdName + " -- <command> [args...]",
+		Short:  "Delegate cgroups to a nested container runtime and exec it",
+		Hidden: true,
+		Args:   cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			var (
+				ctx = cmd.Context()
+				log = slog.Make(slogjson.Sink(cmd.ErrOrStderr())).Leveled(slog.LevelDebug)
+			)
+
+			controllers, err := cgroup.Delegate(ctx, cgroup.DelegateOptions{
+				FS:          xunix.GetFS(ctx),
+				Mounter:     xunix.Mounter(ctx),
+				Controllers: flags.controllers,
+				MaxAttempts: flags.maxAttempts,
+			})
+			if err != nil {
+				return xerrors.Errorf("delegate cgroups: %w", err)
+			}
+			log.Debug(ctx, "delegated cgroups", slog.F("controllers", controllers))
+
+			bin, err := exec.LookPath(args[0])
+			if err != nil {
+				return xerrors.Errorf("look up %q: %w", args[0], err)
+			}
+
+			//nolint:gosec // Executing the arguments is the purpose of the command.
+			err = syscall.Exec(bin, args, os.Environ())
+			if err != nil {
+				return xerrors.Errorf("exec %q: %w", bin, err)
+			}
+			return nil
+		},
+	}
+
+	cmd.Flags().SetInterspersed(false)
+	cmd.Flags().StringSliceVar(&flags.controllers, "controllers", nil, "The cgroupv2 controllers to enable for nested cgroups. All available controllers are enabled if empty.")
+	cmd.Flags().IntVar(&flags.maxAttempts, "max-attempts", dockerdSubtreeControlMaxAttempts, "The maximum number of attempts to enable the controllers. Attempts back off from 10ms to 100ms so the default of 100 gives up after about 10s.")
+
+	return cmd
+}
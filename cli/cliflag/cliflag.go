@@ -85,6 +85,23 @@ func StringArrayVarP(flagset *pflag.FlagSet, ptr *[]string, name string, shortha
 	flagset.StringArrayVarP(ptr, name, shorthand, def, fmtUsage(usage, env))
 }
 
+// StringLinesVarP sets a string array flag on the given flag set. Unlike
+// StringArrayVarP the environment variable holds one value per line so that
+// values may contain commas. Blank lines are ignored.
+func StringLinesVarP(flagset *pflag.FlagSet, ptr *[]string, name string, shorthand string, env string, def []string, usage string) {
+	val, ok := os.LookupEnv(env)
+	if ok {
+		def = []string{}
+		for _, line := range strings.Split(val, "\n") {
+			line = strings.TrimSpace(line)
+			if line != "" {
+				def = append(def, line)
+			}
+		}
+	}
+	flagset.StringArrayVarP(ptr, name, shorthand, def, fmtUsage(usage, env))
+}
+
 // Uint8VarP sets a uint8 flag on the given flag set.
 func Uint8VarP(flagset *pflag.FlagSet, ptr *uint8, name string, shorthand string, env string, def uint8, usage string) {
 	val, ok := os.LookupEnv(env)
@@ -108,6 +108,16 @@ func TestCliflag(t *testing.T) {
 		require.Equal(t, []string{}, got)
 	})
 
+	t.Run("StringLinesEnvVar", func(t *testing.T) {
+		var ptr []string
+		flagset, name, shorthand, env, usage := randomFlag()
+		t.Setenv(env, "type=tmpfs,target=/tmp\n\n  type=bind,source=/a,target=/b  \n")
+		cliflag.StringLinesVarP(flagset, &ptr, name, shorthand, env, nil, usage)
+		got, err := flagset.GetStringArray(name)
+		require.NoError(t, err)
+		require.Equal(t, []string{"type=tmpfs,target=/tmp", "type=bind,source=/a,target=/b"}, got)
+	})
+
 	t.Run("UInt8Default", func(t *testing.T) {
 		var ptr uint8
 		flagset, name, shorthand, env, usage := randomFlag()
@@ -0,0 +1,155 @@
+package cliflag
+
+import (
+	"math/big"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/pflag"
+	"golang.org/x/xerrors"
+)
+
+// quantitySuffixes are the suffixes of Kubernetes resource quantities and
+// their multipliers.
+// See: https://kubernetes.io/docs/reference/kubernetes-api/common-definitions/quantity/
+var quantitySuffixes = map[string]*big.Rat{
+	"n":  big.NewRat(1, 1e9),
+	"u":  big.NewRat(1, 1e6),
+	"m":  big.NewRat(1, 1e3),
+	"":   big.NewRat(1, 1),
+	"k":  big.NewRat(1e3, 1),
+	"M":  big.NewRat(1e6, 1),
+	"G":  big.NewRat(1e9, 1),
+	"T":  big.NewRat(1e12, 1),
+	"P":  big.NewRat(1e15, 1),
+	"E":  big.NewRat(1e18, 1),
+	"Ki": big.NewRat(1<<10, 1),
+	"Mi": big.NewRat(1<<20, 1),
+	"Gi": big.NewRat(1<<30, 1),
+	"Ti": big.NewRat(1<<40, 1),
+	"Pi": big.NewRat(1<<50, 1),
+	"Ei": big.NewRat(1<<60, 1),
+}
+
+// parseQuantity parses a Kubernetes resource quantity (e.g. 1500m, 2.5,
+// 4Gi or 512M).
+func parseQuantity(s string) (*big.Rat, error) {
+	s = strings.TrimSpace(s)
+	i := strings.LastIndexFunc(s, func(r rune) bool {
+		return (r < 'a' || r > 'z') && (r < 'A' || r > 'Z')
+	})
+	num, suffix := s[:i+1], s[i+1:]
+
+	mult, ok := quantitySuffixes[suffix]
+	if !ok {
+		return nil, xerrors.Errorf("unknown suffix %q", suffix)
+	}
+
+	// Rat.SetString accepts fractions which are not valid quantities.
+	if num == "" || strings.Contains(num, "/") {
+		return nil, xerrors.Errorf("invalid quantity %q", s)
+	}
+	v, ok := new(big.Rat).SetString(num)
+	if !ok {
+		return nil, xerrors.Errorf("invalid quantity %q", s)
+	}
+
+	return v.Mul(v, mult), nil
+}
+
+// MilliCPUs is a number of CPUs in thousandths of a CPU. It is set from a
+// Kubernetes resource quantity where '1' is a whole CPU and '1500m' is one
+// and a half.
+type MilliCPUs int64
+
+func (c *MilliCPUs) Set(s string) error {
+	v, err := parseQuantity(s)
+	if err != nil {
+		return err
+	}
+
+	v.Mul(v, big.NewRat(1000, 1))
+	if !v.IsInt() {
+		return xerrors.Errorf("%q is more precise than 1m", s)
+	}
+	if !v.Num().IsInt64() {
+		return xerrors.Errorf("%q is out of range", s)
+	}
+
+	*c = MilliCPUs(v.Num().Int64())
+	return nil
+}
+
+func (c MilliCPUs) String() string {
+	if c%1000 == 0 {
+		return strconv.FormatInt(int64(c)/1000, 10)
+	}
+	return strconv.FormatInt(int64(c), 10) + "m"
+}
+
+func (MilliCPUs) Type() string {
+	return "cpus"
+}
+
+// Bytes is a number of bytes. It is set from a Kubernetes resource quantity
+// (e.g. 4Gi or 512M). Fractional bytes are rounded up.
+type Bytes int64
+
+func (b *Bytes) Set(s string) error {
+	v, err := parseQuantity(s)
+	if err != nil {
+		return err
+	}
+
+	n := new(big.Int).Quo(v.Num(), v.Denom())
+	if !v.IsInt() && v.Sign() > 0 {
+		n.Add(n, big.NewInt(1))
+	}
+	if !n.IsInt64() {
+		return xerrors.Errorf("%q is out of range", s)
+	}
+
+	*b = Bytes(n.Int64())
+	return nil
+}
+
+func (b Bytes) String() string {
+	for _, suffix := range []string{"Ei", "Pi", "Ti", "Gi", "Mi", "Ki"} {
+		mult := quantitySuffixes[suffix].Num().Int64()
+		if b != 0 && int64(b)%mult == 0 {
+			return strconv.FormatInt(int64(b)/mult, 10) + suffix
+		}
+	}
+	return strconv.FormatInt(int64(b), 10)
+}
+
+func (Bytes) Type() string {
+	return "quantity"
+}
+
+// MilliCPUsVarP sets a MilliCPUs flag on the given flag set.
+func MilliCPUsVarP(flagset *pflag.FlagSet, ptr *MilliCPUs, name string, shorthand string, env string, def MilliCPUs, usage string) {
+	*ptr = def
+	if val, ok := os.LookupEnv(env); ok && val != "" {
+		var v MilliCPUs
+		if err := v.Set(val); err == nil {
+			*ptr = v
+		}
+	}
+
+	flagset.VarP(ptr, name, shorthand, fmtUsage(usage, env))
+}
+
+// BytesVarP sets a Bytes flag on the given flag set.
+func BytesVarP(flagset *pflag.FlagSet, ptr *Bytes, name string, shorthand string, env string, def Bytes, usage string) {
+	*ptr = def
+	if val, ok := os.LookupEnv(env); ok && val != "" {
+		var v Bytes
+		if err := v.Set(val); err == nil {
+			*ptr = v
+		}
+	}
+
+	flagset.VarP(ptr, name, shorthand, fmtUsage(usage, env))
+}
@@ -0,0 +1,131 @@
+package cliflag_test
+
+import (
+	"testing"
+
+	"github.com/spf13/pflag"
+	"github.com/stretchr/testify/require"
+
+	"github.com/coder/envbox/cli/cliflag"
+)
+
+func TestMilliCPUs(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		in       string
+		expected cliflag.MilliCPUs
+		str      string
+		err      string
+	}{
+		{in: "2", expected: 2000, str: "2"},
+		{in: "1500m", expected: 1500, str: "1500m"},
+		{in: "2.5", expected: 2500, str: "2500m"},
+		{in: "0.1", expected: 100, str: "100m"},
+		{in: "1e3m", expected: 1000, str: "1"},
+		{in: "0.0005", err: "more precise than 1m"},
+		{in: "1.5x", err: "unknown suffix"},
+		{in: "m", err: "invalid quantity"},
+		{in: "1/2", err: "invalid quantity"},
+	} {
+		tc := tc
+		t.Run(tc.in, func(t *testing.T) {
+			t.Parallel()
+
+			var c cliflag.MilliCPUs
+			err := c.Set(tc.in)
+			if tc.err != "" {
+				require.ErrorContains(t, err, tc.err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.expected, c)
+			require.Equal(t, tc.str, c.String())
+		})
+	}
+}
+
+func TestBytes(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		in       string
+		expected cliflag.Bytes
+		str      string
+		err      string
+	}{
+		{in: "4294967296", expected: 4 << 30, str: "4Gi"},
+		{in: "4Gi", expected: 4 << 30, str: "4Gi"},
+		{in: "512M", expected: 512e6, str: "500000Ki"},
+		{in: "1.5Gi", expected: 3 << 29, str: "1536Mi"},
+		{in: "1k", expected: 1000, str: "1000"},
+		{in: "-1", expected: -1, str: "-1"},
+		{in: "0", expected: 0, str: "0"},
+		// Fractional bytes are rounded up.
+		{in: "1500m", expected: 2, str: "2"},
+		{in: "10Zi", err: "unknown suffix"},
+		{in: "100E", err: "out of range"},
+	} {
+		tc := tc
+		t.Run(tc.in, func(t *testing.T) {
+			t.Parallel()
+
+			var b cliflag.Bytes
+			err := b.Set(tc.in)
+			if tc.err != "" {
+				require.ErrorContains(t, err, tc.err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.expected, b)
+			require.Equal(t, tc.str, b.String())
+		})
+	}
+}
+
+// TestQuantityVarP cannot run in parallel because it uses t.Setenv.
+//
+//nolint:paralleltest
+func TestQuantityVarP(t *testing.T) {
+	t.Run("Default", func(t *testing.T) {
+		var (
+			cpus    cliflag.MilliCPUs
+			memory  cliflag.Bytes
+			flagset = pflag.NewFlagSet("test", pflag.PanicOnError)
+		)
+		cliflag.MilliCPUsVarP(flagset, &cpus, "cpus", "", "TEST_QUANTITY_CPUS", 1500, "cpus")
+		cliflag.BytesVarP(flagset, &memory, "memory", "", "TEST_QUANTITY_MEMORY", 1<<30, "memory")
+		require.Equal(t, cliflag.MilliCPUs(1500), cpus)
+		require.Equal(t, cliflag.Bytes(1<<30), memory)
+		require.Contains(t, flagset.FlagUsages(), "Consumes $TEST_QUANTITY_CPUS")
+	})
+
+	t.Run("EnvVar", func(t *testing.T) {
+		t.Setenv("TEST_QUANTITY_CPUS", "250m")
+		t.Setenv("TEST_QUANTITY_MEMORY", "2Gi")
+		var (
+			cpus    cliflag.MilliCPUs
+			memory  cliflag.Bytes
+			flagset = pflag.NewFlagSet("test", pflag.PanicOnError)
+		)
+		cliflag.MilliCPUsVarP(flagset, &cpus, "cpus", "", "TEST_QUANTITY_CPUS", 0, "cpus")
+		cliflag.BytesVarP(flagset, &memory, "memory", "", "TEST_QUANTITY_MEMORY", 0, "memory")
+		require.Equal(t, cliflag.MilliCPUs(250), cpus)
+		require.Equal(t, cliflag.Bytes(2<<30), memory)
+	})
+
+	t.Run("Flag", func(t *testing.T) {
+		var (
+			cpus    cliflag.MilliCPUs
+			memory  cliflag.Bytes
+			flagset = pflag.NewFlagSet("test", pflag.ContinueOnError)
+		)
+		cliflag.MilliCPUsVarP(flagset, &cpus, "cpus", "", "", 0, "cpus")
+		cliflag.BytesVarP(flagset, &memory, "memory", "", "", 0, "memory")
+		require.NoError(t, flagset.Parse([]string{"--cpus=1.25", "--memory=512Mi"}))
+		require.Equal(t, cliflag.MilliCPUs(1250), cpus)
+		require.Equal(t, cliflag.Bytes(512<<20), memory)
+
+		require.Error(t, flagset.Parse([]string{"--cpus=bogus"}))
+	})
+}
@@ -3,6 +3,7 @@ package clitest
 import (
 	"bufio"
 	"context"
+	"io"
 	"net"
 	"os"
 	"strings"
@@ -45,11 +46,22 @@ func NewFakeDockerClient() dockerutil.Client {
 	}
 
 	client.ContainerExecAttachFn = func(_ context.Context, _ string, _ containertypes.ExecAttachOptions) (dockertypes.HijackedResponse, error) {
-		return dockertypes.HijackedResponse{
-			Reader: bufio.NewReader(strings.NewReader("root:x:0:0:root:/root:/bin/bash")),
-			Conn:   &net.IPConn{},
-		}, nil
+		return ExecResponse("root:x:0:0:root:/root:/bin/bash"), nil
 	}
 
 	return client
 }
+
+// ExecResponse returns an attached exec that outputs out. Anything written
+// to its stdin, e.g. a secret, is discarded.
+func ExecResponse(out string) dockertypes.HijackedResponse {
+	conn, peer := net.Pipe()
+	go func() {
+		_, _ = io.Copy(io.Discard, peer)
+		_ = peer.Close()
+	}()
+	return dockertypes.HijackedResponse{
+		Reader: bufio.NewReader(strings.NewReader(out)),
+		Conn:   conn,
+	}
+}
@@ -0,0 +1,125 @@
+package cli
+
+import (
+	"context"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+
+	"golang.org/x/xerrors"
+
+	"cdr.dev/slog/v3"
+	"github.com/coder/envbox/dockerutil"
+	"github.com/coder/envbox/xunix"
+)
+
+// innerDaemonConfig returns the settings for the inner Docker daemon. Like
+// the outer daemon it uses the MTU of the outer container's link and its
+// default address pools exclude the outer bridge network and the networks
+// of the outer container, unless pools are given explicitly.
+func innerDaemonConfig(ctx context.Context, log slog.Logger, flags flags) (dockerutil.DaemonConfig, error) {
+	var conf dockerutil.DaemonConfig
+
+	mtu, err := xunix.NetlinkMTU(flags.ethlink)
+	if err != nil {
+		return dockerutil.DaemonConfig{}, xerrors.Errorf("custom mtu: %w", err)
+	}
+	conf.MTU = mtu
+
+	for _, p := range strings.Split(strings.Join(flags.innerAddressPools, ","), ",") {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+		pool, err := dockerutil.ParseAddressPool(p)
+		if err != nil {
+			return dockerutil.DaemonConfig{}, xerrors.Errorf("parse %q: %w", EnvInnerAddressPools, err)
+		}
+		conf.AddressPools = append(conf.AddressPools, pool)
+	}
+	conf.OverrideAddressPools = len(conf.AddressPools) > 0
+
+	if !conf.OverrideAddressPools {
+		cidr := dockerutil.DefaultBridgeCIDR
+		if flags.dockerdBridgeCIDR != "" {
+			cidr = flags.dockerdBridgeCIDR
+		}
+		_, bridge, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return dockerutil.DaemonConfig{}, xerrors.Errorf("parse bridge cidr: %w", err)
+		}
+		exclude := []*net.IPNet{bridge}
+
+		nets, err := xunix.NetlinkIPv4Nets(flags.ethlink)
+		if err != nil {
+			log.Info(ctx, "unable to read outer networks", slog.Error(err))
+		}
+		exclude = append(exclude, nets...)
+		conf.AddressPools = dockerutil.AddressPoolsExcluding(exclude)
+	}
+
+	for _, m := range strings.Split(strings.Join(flags.registryMirrors, ","), ",") {
+		m = strings.TrimSpace(m)
+		if m == "" {
+			continue
+		}
+		// An invalid mirror prevents the inner daemon from starting.
+		u, err := url.Parse(m)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return dockerutil.DaemonConfig{}, xerrors.Errorf("invalid registry mirror %q: must be an http or https URL", m)
+		}
+		conf.RegistryMirrors = append(conf.RegistryMirrors, m)
+	}
+
+	for _, r := range strings.Split(strings.Join(flags.insecureRegistries, ","), ",") {
+		r = strings.TrimSpace(r)
+		if r == "" {
+			continue
+		}
+		if strings.Contains(r, "://") {
+			return dockerutil.DaemonConfig{}, xerrors.Errorf("invalid insecure registry %q: must not contain a scheme", r)
+		}
+		conf.InsecureRegistries = append(conf.InsecureRegistries, r)
+	}
+
+	return conf, nil
+}
+
+// writeInnerDaemonConfig merges conf into the inner Docker daemon's
+// configuration file. It must be written before the inner container starts
+// since the daemon only reads it on startup.
+func writeInnerDaemonConfig(ctx context.Context, client dockerutil.Client, containerID string, conf dockerutil.DaemonConfig) error {
+	existing, err := dockerutil.ReadContainerFile(ctx, client, containerID, dockerutil.DaemonConfigPath)
+	if err != nil && !xerrors.Is(err, os.ErrNotExist) {
+		return xerrors.Errorf("read existing config: %w", err)
+	}
+
+	content, err := dockerutil.MergeDaemonConfig(existing, conf)
+	if err != nil {
+		return err
+	}
+
+	var (
+		files []dockerutil.ContainerFile
+		dir   = path.Dir(dockerutil.DaemonConfigPath)
+	)
+	exists, err := dockerutil.PathExists(ctx, client, containerID, dir)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		files = append(files, dockerutil.ContainerFile{
+			Path: dir,
+			Mode: 0o755,
+			Dir:  true,
+		})
+	}
+	files = append(files, dockerutil.ContainerFile{
+		Path:    dockerutil.DaemonConfigPath,
+		Content: content,
+		Mode:    0o644,
+	})
+	return dockerutil.CopyFilesToContainer(ctx, client, containerID, files)
+}
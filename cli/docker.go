@@ -1,8 +1,8 @@
 package cli
 
 import (
+	"bytes"
 	"context"
-	_ "embed"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -20,6 +20,7 @@ import (
 
 	"github.com/docker/docker/api/types/container"
 	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/spf13/afero"
 	"github.com/spf13/cobra"
 	"golang.org/x/exp/slices"
 	"golang.org/x/xerrors"
@@ -73,16 +74,25 @@ const (
 	InnerContainerName = "workspace_cvm"
 
 	// Required for userns mapping.
-	// This is the ID of the user we apply in `envbox/Dockerfile`.
+	// This is the default start of the subordinate IDs we apply in
+	// `envbox/Dockerfile`. It can be changed with CODER_USERNS_OFFSET.
 	//
 	// There should be caution changing this value.
 	// Source directory permissions on the host are offset by this
 	// value. For example, folder `/home/coder` inside the container
 	// with UID/GID 1000 will be mapped to `UserNamespaceOffset` + 1000
 	// on the host. Changing this value will result in improper mappings
-	// on existing containers.
+	// on existing containers unless their volumes are migrated with
+	// `envbox shift-ownership`.
 	UserNamespaceOffset = 100000
-	devDir              = "/dev"
+	// userNamespaceSize is the number of IDs mapped into the inner
+	// container's user namespace (see the subuids in the Dockerfile).
+	userNamespaceSize = 65536
+	// userNamespaceUser is the user whose subordinate IDs dockerd maps the
+	// inner container's user namespace to.
+	userNamespaceUser = "coder"
+
+	devDir = "/dev"
 )
 
 var (
@@ -108,6 +118,40 @@ var (
 	EnvDebug                = "CODER_DEBUG"
 	EnvDisableIDMappedMount = "CODER_DISABLE_IDMAPPED_MOUNT"
 	EnvExtraCertsPath       = "CODER_EXTRA_CERTS_PATH"
+	EnvImageCacheDir        = "CODER_IMAGE_CACHE_DIR"
+	EnvInnerEntrypoint      = "CODER_INNER_ENTRYPOINT"
+	EnvInnerEntrypointCmd   = "CODER_INNER_ENTRYPOINT_CMD"
+	EnvInnerInit            = "CODER_INNER_INIT"
+	EnvBootstrapMode        = "CODER_BOOTSTRAP_MODE"
+	EnvPidsLimit            = "CODER_PIDS_LIMIT"
+	EnvMemorySwap           = "CODER_MEMORY_SWAP"
+	EnvMemoryReservation    = "CODER_MEMORY_RESERVATION"
+	EnvCPUSetCPUs           = "CODER_CPUSET_CPUS"
+	EnvBlkioWeight          = "CODER_BLKIO_WEIGHT"
+	EnvShmSize              = "CODER_SHM_SIZE"
+	EnvUlimits              = "CODER_ULIMITS"
+	EnvResizeInterval       = "CODER_RESIZE_INTERVAL"
+	EnvCGroupControllers    = "CODER_CGROUP_CONTROLLERS"
+	EnvMountSpecs           = "CODER_MOUNT"
+	EnvOwnerRepairTimeout   = "CODER_OWNER_REPAIR_TIMEOUT"
+	EnvUserNamespaceOffset  = "CODER_USERNS_OFFSET"
+	EnvCreateUser           = "CODER_CREATE_USER"
+	EnvCreateUserUID        = "CODER_CREATE_USER_UID"
+	EnvCreateUserGID        = "CODER_CREATE_USER_GID"
+	EnvCreateUserHome       = "CODER_CREATE_USER_HOME"
+	EnvCreateUserShell      = "CODER_CREATE_USER_SHELL"
+	EnvCreateUserSudo       = "CODER_CREATE_USER_SUDO"
+	EnvInnerGroups          = "CODER_INNER_GROUPS"
+	EnvInitHome             = "CODER_INIT_HOME"
+	EnvSecrets              = "CODER_SECRETS"
+	EnvAgentTokenFile       = "CODER_AGENT_TOKEN_AS_FILE"
+	EnvCopyFiles            = "CODER_COPY_FILES"
+	EnvInnerRegistryAuth    = "CODER_INNER_REGISTRY_AUTH"
+	EnvInnerRegistries      = "CODER_INNER_REGISTRIES"
+	EnvInnerDaemonConfig    = "CODER_INNER_DAEMON_CONFIG"
+	EnvInnerAddressPools    = "CODER_INNER_ADDRESS_POOLS"
+	EnvRegistryMirrors      = "CODER_INNER_REGISTRY_MIRRORS"
+	EnvInsecureRegistries   = "CODER_INNER_INSECURE_REGISTRIES"
 )
 
 var envboxPrivateMounts = map[string]struct{}{
@@ -140,13 +184,51 @@ type flags struct {
 	dockerdBridgeCIDR    string
 	boostrapScript       string
 	containerMounts      string
+	mountSpecs           []string
 	hostUsrLibDir        string
 	innerUsrLibDir       string
 	dockerConfig         string
-	cpus                 int
-	memory               int
+	cpus                 cliflag.MilliCPUs
+	memory               cliflag.Bytes
+	memorySwap           cliflag.Bytes
+	memoryReservation    cliflag.Bytes
+	pidsLimit            int
+	cpusetCPUs           string
+	blkioWeight          int
+	shmSize              cliflag.Bytes
+	ulimits              []string
+	resizeInterval       time.Duration
+	cgroupControllers    []string
+	ownerRepairTimeout   time.Duration
+	usernsOffset         int
+	createUser           bool
+	createUserUID        int
+	createUserGID        int
+	createUserHome       string
+	createUserShell      string
+	createUserSudo       bool
+	innerGroups          []string
+	initHome             bool
+	secrets              []string
+	agentTokenFile       bool
+	copyFiles            []string
+	innerRegistryAuth    bool
+	innerRegistries      []string
+	innerDaemonConfig    bool
+	innerAddressPools    []string
+	registryMirrors      []string
+	insecureRegistries   []string
 	disableIDMappedMount bool
 	extraCertsPath       string
+	imageCacheDir        string
+	entrypoint           string
+	entrypointCmd        string
+	innerInit            string
+	bootstrapMode        string
+
+	// explicit records which flags that may be defaulted from image labels
+	// were explicitly provided.
+	explicit map[string]bool
 
 	// Test flags.
 	noStartupLogs bool
@@ -217,6 +299,12 @@ func dockerCmd() *cobra.Command {
 				}
 			}(&err)
 
+			// dockerd only reads the subordinate IDs when it starts.
+			err = setUserNamespaceOffset(ctx, log, flags.usernsOffset)
+			if err != nil {
+				return xerrors.Errorf("set %q: %w", EnvUserNamespaceOffset, err)
+			}
+
 			sysboxArgs := []string{}
 			if flags.disableIDMappedMount {
 				sysboxArgs = append(sysboxArgs, "--disable-idmapped-mount")
@@ -257,7 +345,7 @@ func dockerCmd() *cobra.Command {
 			log.Debug(ctx, "starting dockerd", slog.F("args", args))
 
 			blog.Info("Waiting for sysbox processes to startup...")
-			wrapCmd, wrapArgs := wrapDockerdCmd(dargs)
+			wrapCmd, wrapArgs := wrapDockerdCmd(flags.cgroupControllers, dargs)
 			dockerd := background.New(ctx, log, dockerdBinName, wrapCmd, wrapArgs...)
 			err = dockerd.Start()
 			if err != nil {
@@ -291,7 +379,7 @@ func dockerCmd() *cobra.Command {
 						log.Fatal(ctx, "dockerd exited, failed getting args for restart", slog.Error(err))
 					}
 
-					wrapCmd, wrapArgs := wrapDockerdCmd(args)
+					wrapCmd, wrapArgs := wrapDockerdCmd(flags.cgroupControllers, args)
 					err = dockerd.Restart(ctx, dockerdBinName, wrapCmd, wrapArgs...)
 					if err != nil {
 						blog.Info("Failed to create Container-based Virtual Machine: " + err.Error())
@@ -343,6 +431,8 @@ func dockerCmd() *cobra.Command {
 				)
 			}
 
+			flags.explicit = explicitImageLabelFlags(cmd)
+
 			bootstrapExecID, err := runDockerCVM(ctx, log, client, blog, flags)
 			if err != nil {
 				// It's possible we failed because we ran out of disk while
@@ -360,7 +450,7 @@ func dockerCmd() *cobra.Command {
 
 					log.Debug(ctx, "restarting dockerd", slog.F("args", args))
 
-					wrapCmd, wrapArgs := wrapDockerdCmd(args)
+					wrapCmd, wrapArgs := wrapDockerdCmd(flags.cgroupControllers, args)
 					err = dockerd.Restart(ctx, dockerdBinName, wrapCmd, wrapArgs...)
 					if err != nil {
 						return xerrors.Errorf("restart dockerd: %w", err)
@@ -430,23 +520,57 @@ func dockerCmd() *cobra.Command {
 	cliflag.StringVarP(cmd.Flags(), &flags.coderURL, "coder-url", "", EnvAgentURL, "", "The URL of the Coder deployement.")
 
 	// Optional flags.
-	cliflag.StringVarP(cmd.Flags(), &flags.innerEnvs, "envs", "", EnvInnerEnvs, "", "Comma separated list of envs to add to the inner container.")
+	cliflag.StringVarP(cmd.Flags(), &flags.innerEnvs, "envs", "", EnvInnerEnvs, "", "Comma or newline separated list of envs to pass to the inner container. Entries may be a name, a wildcard pattern (KUBERNETES_*), an exclusion (!SECRET_*), a rename (OUTER=INNER), a literal (NAME:=value) or an env file (@/path/to/file). Later entries override earlier ones.")
 	cliflag.StringVarP(cmd.Flags(), &flags.innerWorkDir, "work-dir", "", EnvInnerWorkDir, "", "The working directory of the inner container.")
 	cliflag.StringVarP(cmd.Flags(), &flags.innerHostname, "hostname", "", EnvInnerHostname, "", "The hostname to use for the inner container.")
 	cliflag.StringVarP(cmd.Flags(), &flags.imagePullSecret, "image-secret", "", EnvBoxPullImageSecretEnvVar, "", fmt.Sprintf("The secret to use to pull the image. It is highly encouraged to provide this via the %s environment variable.", EnvBoxPullImageSecretEnvVar))
 	cliflag.StringVarP(cmd.Flags(), &flags.dockerdBridgeCIDR, "bridge-cidr", "", EnvBridgeCIDR, "", "The CIDR to use for the docker bridge.")
 	cliflag.StringVarP(cmd.Flags(), &flags.boostrapScript, "boostrap-script", "", EnvBootstrap, "", "The script to use to bootstrap the container. This should typically install and start the agent.")
 	cliflag.StringVarP(cmd.Flags(), &flags.containerMounts, "mounts", "", EnvMounts, "", "Comma separated list of mounts in the form of '<source>:<target>[:options]' (e.g. /var/lib/docker:/var/lib/docker:ro,/usr/src:/usr/src).")
+	cliflag.StringLinesVarP(cmd.Flags(), &flags.mountSpecs, "mount", "", EnvMountSpecs, nil, "A mount for the inner container in the form of 'docker run --mount' (e.g. type=tmpfs,target=/tmp,tmpfs-size=1g or type=bind,source=/mnt/fuse,target=/mnt/fuse,bind-propagation=rshared). May be repeated, the environment variable takes one mount per line.")
 	cliflag.StringVarP(cmd.Flags(), &flags.hostUsrLibDir, "usr-lib-dir", "", EnvUsrLibDir, "", "The host /usr/lib mountpoint. Used to detect GPU drivers to mount into inner container.")
 	cliflag.StringVarP(cmd.Flags(), &flags.innerUsrLibDir, "inner-usr-lib-dir", "", EnvInnerUsrLibDir, "", "The inner /usr/lib mountpoint. This is automatically detected based on /etc/os-release in the inner image, but may optionally be overridden.")
 	cliflag.StringVarP(cmd.Flags(), &flags.dockerConfig, "docker-config", "", EnvDockerConfig, "/root/.docker/config.json", "The path to the docker config to consult when pulling an image.")
 	cliflag.BoolVarP(cmd.Flags(), &flags.addTUN, "add-tun", "", EnvAddTun, false, "Add a TUN device to the inner container.")
 	cliflag.BoolVarP(cmd.Flags(), &flags.addFUSE, "add-fuse", "", EnvAddFuse, false, "Add a FUSE device to the inner container.")
 	cliflag.BoolVarP(cmd.Flags(), &flags.addGPU, "add-gpu", "", EnvAddGPU, false, "Add detected GPUs to the inner container.")
-	cliflag.IntVarP(cmd.Flags(), &flags.cpus, "cpus", "", EnvCPUs, 0, "Number of CPUs to allocate inner container. e.g. 2")
-	cliflag.IntVarP(cmd.Flags(), &flags.memory, "memory", "", EnvMemory, 0, "Max memory to allocate to the inner container in bytes.")
+	cliflag.MilliCPUsVarP(cmd.Flags(), &flags.cpus, "cpus", "", EnvCPUs, 0, "Number of CPUs to allocate inner container as a Kubernetes quantity. e.g. 2, 1.5 or 1500m")
+	cliflag.BytesVarP(cmd.Flags(), &flags.memory, "memory", "", EnvMemory, 0, "Max memory to allocate to the inner container as a Kubernetes quantity or in bytes. e.g. 4Gi")
+	cliflag.BytesVarP(cmd.Flags(), &flags.memorySwap, "memory-swap", "", EnvMemorySwap, 0, "The combined memory and swap limit of the inner container, -1 for unlimited swap. Requires --memory.")
+	cliflag.BytesVarP(cmd.Flags(), &flags.memoryReservation, "memory-reservation", "", EnvMemoryReservation, 0, "The soft memory limit of the inner container.")
+	cliflag.IntVarP(cmd.Flags(), &flags.pidsLimit, "pids-limit", "", EnvPidsLimit, 0, "The maximum number of processes in the inner container.")
+	cliflag.StringVarP(cmd.Flags(), &flags.cpusetCPUs, "cpuset-cpus", "", EnvCPUSetCPUs, "", "The CPUs the inner container may run on (e.g. 0-3,6).")
+	cliflag.IntVarP(cmd.Flags(), &flags.blkioWeight, "blkio-weight", "", EnvBlkioWeight, 0, "The relative block IO weight of the inner container, between 10 and 1000.")
+	cliflag.BytesVarP(cmd.Flags(), &flags.shmSize, "shm-size", "", EnvShmSize, 0, "The size of /dev/shm in the inner container. e.g. 1Gi")
+	cliflag.BoolVarP(cmd.Flags(), &flags.createUser, "create-user", "", EnvCreateUser, false, "Create the user given by --username in the inner container if it doesn't exist in the image.")
+	cliflag.IntVarP(cmd.Flags(), &flags.createUserUID, "create-user-uid", "", EnvCreateUserUID, 1000, "The UID of a user created with --create-user.")
+	cliflag.IntVarP(cmd.Flags(), &flags.createUserGID, "create-user-gid", "", EnvCreateUserGID, 1000, "The GID of the primary group of a user created with --create-user. An existing group with the GID is reused.")
+	cliflag.StringVarP(cmd.Flags(), &flags.createUserHome, "create-user-home", "", EnvCreateUserHome, "", "The home directory of a user created with --create-user. Defaults to /home/<username>.")
+	cliflag.StringVarP(cmd.Flags(), &flags.createUserShell, "create-user-shell", "", EnvCreateUserShell, "", "The shell of a user created with --create-user. Defaults to /bin/bash if it exists and /bin/sh otherwise.")
+	cliflag.BoolVarP(cmd.Flags(), &flags.createUserSudo, "create-user-sudo", "", EnvCreateUserSudo, false, "Configure passwordless sudo for a user created with --create-user if sudo is installed in the image.")
+	cliflag.StringArrayVarP(cmd.Flags(), &flags.innerGroups, "groups", "", EnvInnerGroups, nil, "Comma separated list of supplementary groups, names or GIDs, to add the user to in addition to its groups in the image. The docker group is added automatically if the image contains dockerd.")
+	cliflag.BoolVarP(cmd.Flags(), &flags.initHome, "init-home", "", EnvInitHome, true, "Copy the image's home directory, or /etc/skel if it has none, into an empty volume mounted over the user's home directory the first time it is mounted.")
+	cliflag.StringLinesVarP(cmd.Flags(), &flags.secrets, "secret", "", EnvSecrets, nil, fmt.Sprintf("A secret written to a file in %s in the inner container instead of being passed as an environment variable, in the form of 'name=<file name>,env=<outer env>' or 'name=<file name>,file=<outer path>' with optional 'owner=user|root|<uid>:<gid>' and 'mode=0400' fields. May be repeated, the environment variable takes one secret per line.", InnerSecretsDir))
+	cliflag.BoolVarP(cmd.Flags(), &flags.agentTokenFile, "agent-token-file", "", EnvAgentTokenFile, true, fmt.Sprintf("Pass the agent token to the inner container as the secret %s/%s, read by the agent via %s, instead of as %s. Disable it for agents that don't support %s.", InnerSecretsDir, agentTokenSecret, envAgentTokenFile, EnvAgentToken, envAgentTokenFile))
+	cliflag.StringLinesVarP(cmd.Flags(), &flags.copyFiles, "copy-file", "", EnvCopyFiles, nil, "A file or directory copied into the inner container once it has started, in the form of 'source=<outer path>,target=<inner path>' with optional 'owner=user|root|<uid>:<gid>', 'mode=0644' and 'overwrite=never|always' fields. A target starting with '~/' is relative to the user's home directory. May be repeated, the environment variable takes one file per line.")
+	cliflag.BoolVarP(cmd.Flags(), &flags.innerRegistryAuth, "inner-registry-auth", "", EnvInnerRegistryAuth, false, "Write the credentials used to pull the image, from --image-secret and --docker-config, into the user's ~/.docker/config.json in the inner container and the extra certificates into its /etc/docker/certs.d.")
+	cliflag.StringArrayVarP(cmd.Flags(), &flags.innerRegistries, "inner-registries", "", EnvInnerRegistries, nil, "Comma separated list of registries, which may contain wildcards (e.g. *.gcr.io), whose credentials are passed with --inner-registry-auth. Defaults to the registry of the image.")
+	cliflag.BoolVarP(cmd.Flags(), &flags.innerDaemonConfig, "inner-daemon-config", "", EnvInnerDaemonConfig, false, "Write the MTU, address pools, registry mirrors and insecure registries of the inner container's Docker daemon into its /etc/docker/daemon.json, merging them with the existing file.")
+	cliflag.StringArrayVarP(cmd.Flags(), &flags.innerAddressPools, "inner-address-pools", "", EnvInnerAddressPools, nil, "Comma separated list of default address pools of the inner Docker daemon in the form of '<base>[:<size>]' (e.g. 10.10.0.0/16:24). Defaults to the Docker defaults that don't overlap the outer container's networks. Requires --inner-daemon-config.")
+	cliflag.StringArrayVarP(cmd.Flags(), &flags.registryMirrors, "inner-registry-mirrors", "", EnvRegistryMirrors, nil, "Comma separated list of registry mirror URLs of the inner Docker daemon. Requires --inner-daemon-config.")
+	cliflag.StringArrayVarP(cmd.Flags(), &flags.insecureRegistries, "inner-insecure-registries", "", EnvInsecureRegistries, nil, "Comma separated list of registries, or CIDRs, the inner Docker daemon may access without TLS. Requires --inner-daemon-config.")
+	cliflag.IntVarP(cmd.Flags(), &flags.usernsOffset, "userns-offset", "", EnvUserNamespaceOffset, UserNamespaceOffset, "The first host ID the inner container's user namespace is mapped to. The coder user's range in /etc/subuid and /etc/subgid is set to the 65536 IDs beginning at it. Changing it requires migrating existing volumes with 'envbox shift-ownership'.")
+	cliflag.DurationVarP(cmd.Flags(), &flags.ownerRepairTimeout, "owner-repair-timeout", "", EnvOwnerRepairTimeout, 10*time.Minute, "How long to spend re-chowning the files of a mount whose owner changed since the last start (e.g. the image user's UID changed) before resuming on the next start. 0 disables.")
+	cliflag.DurationVarP(cmd.Flags(), &flags.resizeInterval, "resize-interval", "", EnvResizeInterval, 10*time.Second, "How often to check the outer container's CPU and memory limits for changes (e.g. an in-place pod resize) and apply them to the inner container. 0 disables.")
+	cliflag.StringArrayVarP(cmd.Flags(), &flags.cgroupControllers, "cgroup-controllers", "", EnvCGroupControllers, nil, "Comma separated list of cgroupv2 controllers to delegate to the inner container's cgroups (e.g. cpu,memory,pids). All available controllers are delegated if empty. Ignored on cgroupv1 hosts.")
+	cliflag.StringArrayVarP(cmd.Flags(), &flags.ulimits, "ulimit", "", EnvUlimits, nil, "Comma separated list of ulimits for the inner container in the form of '<name>=<soft>[:<hard>]' (e.g. nofile=1024:4096,nproc=512).")
 	cliflag.BoolVarP(cmd.Flags(), &flags.disableIDMappedMount, "disable-idmapped-mount", "", EnvDisableIDMappedMount, false, "Disable idmapped mounts in sysbox. Note that you may need an alternative (e.g. shiftfs).")
 	cliflag.StringVarP(cmd.Flags(), &flags.extraCertsPath, "extra-certs-path", "", EnvExtraCertsPath, "", "The path to a directory or file containing extra CA certificates.")
+	cliflag.StringVarP(cmd.Flags(), &flags.entrypoint, "entrypoint", "", EnvInnerEntrypoint, string(dockerutil.EntrypointAuto), "What the inner container runs as PID 1. One of 'auto' (/sbin/init if present, otherwise 'sleep infinity'), 'image' (the image's ENTRYPOINT and CMD), 'init', 'sleep' or 'custom'.")
+	cliflag.StringVarP(cmd.Flags(), &flags.entrypointCmd, "entrypoint-cmd", "", EnvInnerEntrypointCmd, "", "The command to run when --entrypoint=custom. A JSON array is run as-is, anything else is run with '/bin/sh -c'.")
+	cliflag.StringVarP(cmd.Flags(), &flags.innerInit, "init", "", EnvInnerInit, string(dockerutil.InitAuto), "The init system to boot when the entrypoint is 'auto' or 'init'. One of 'auto' (detect from the image), 'systemd', 'openrc', 's6', 'tini', 'busybox' or 'none'.")
+	cliflag.StringVarP(cmd.Flags(), &flags.bootstrapMode, "bootstrap-mode", "", EnvBootstrapMode, bootstrapModeExec, "How the bootstrap script is run. One of 'exec' (a detached exec) or 'systemd' (a systemd unit, falling back to 'exec' if the inner container isn't running systemd).")
+	cliflag.StringVarP(cmd.Flags(), &flags.imageCacheDir, "image-cache-dir", "", EnvImageCacheDir, "", "The path to a shared image cache populated by 'envbox prepull'. The image is loaded from the cache when present instead of being pulled.")
 
 	// Test flags.
 	cliflag.BoolVarP(cmd.Flags(), &flags.noStartupLogs, "no-startup-log", "", "", false, "Do not log startup logs. Useful for testing.")
@@ -467,37 +591,158 @@ func runDockerCVM(ctx context.Context, log slog.Logger, client dockerutil.Client
 		return "", xerrors.Errorf("parse ref: %w", err)
 	}
 
-	var dockerAuth dockerutil.AuthConfig
-	if flags.imagePullSecret != "" {
-		dockerAuth, err = dockerutil.AuthConfigFromString(flags.imagePullSecret, ref.Context().RegistryStr())
-		if err != nil {
-			return "", xerrors.Errorf("parse auth config: %w", err)
-		}
+	entrypoint, err := dockerutil.ParseEntrypointMode(flags.entrypoint)
+	if err != nil {
+		return "", xerrors.Errorf("parse entrypoint: %w", err)
 	}
 
-	log.Info(ctx, "checking for docker config file", slog.F("path", flags.dockerConfig))
-	if _, err := fs.Stat(flags.dockerConfig); err == nil {
-		log.Info(ctx, "detected file", slog.F("image", flags.innerImage))
-		dockerAuth, err = dockerutil.AuthConfigFromPath(flags.dockerConfig, ref.Context().RegistryStr())
-		if err != nil && !xerrors.Is(err, os.ErrNotExist) {
-			return "", xerrors.Errorf("auth config from file: %w", err)
+	var entrypointCmd []string
+	if entrypoint == dockerutil.EntrypointCustom {
+		entrypointCmd, err = dockerutil.ParseEntrypointCommand(flags.entrypointCmd)
+		if err != nil {
+			return "", xerrors.Errorf("parse %q: %w", EnvInnerEntrypointCmd, err)
 		}
 	}
 
-	envs := defaultContainerEnvs(ctx, flags.agentToken)
+	_, err = dockerutil.ParseInitSystem(flags.innerInit)
+	if err != nil {
+		return "", xerrors.Errorf("parse init: %w", err)
+	}
 
-	innerEnvsTokens := strings.Split(flags.innerEnvs, ",")
-	envs = append(envs, filterElements(xunix.Environ(ctx), innerEnvsTokens...)...)
+	if flags.bootstrapMode != bootstrapModeExec && flags.bootstrapMode != bootstrapModeSystemd {
+		return "", xerrors.Errorf("unknown bootstrap mode %q, must be one of %q or %q", flags.bootstrapMode, bootstrapModeExec, bootstrapModeSystemd)
+	}
 
 	mounts := defaultMounts()
 	// Add any user-specified mounts to our mounts list.
-	extraMounts, err := parseMounts(flags.containerMounts)
+	extraMounts, warnings, err := parseMounts(flags.containerMounts)
 	if err != nil {
 		return "", xerrors.Errorf("read mounts: %w", err)
 	}
+	for _, w := range warnings {
+		log.Warn(ctx, "invalid mount accepted for compatibility", slog.F("warning", w))
+		blog.Infof("%s: %s. This will be an error in a future release.", EnvMounts, w)
+	}
 	mounts = append(mounts, extraMounts...)
 
-	log.Debug(ctx, "using mounts", slog.F("mounts", mounts))
+	mountSpecs, err := parseMountSpecs(flags.mountSpecs, mounts)
+	if err != nil {
+		return "", xerrors.Errorf("parse %q: %w", EnvMountSpecs, err)
+	}
+	err = prepareMountSources(ctx, mountSpecs)
+	if err != nil {
+		return "", xerrors.Errorf("prepare mounts: %w", err)
+	}
+
+	secretSpecs, err := parseSecretSpecs(flags.secrets)
+	if err != nil {
+		return "", xerrors.Errorf("parse %q: %w", EnvSecrets, err)
+	}
+	useSecrets := len(secretSpecs) > 0 || flags.agentTokenFile
+	if useSecrets && slices.ContainsFunc(mountSpecs, func(m mountSpec) bool { return path.Clean(m.Target) == InnerSecretsDir }) {
+		return "", xerrors.Errorf("%q is reserved for secrets and can't be mounted", InnerSecretsDir)
+	}
+
+	fileSpecs, err := parseFileSpecs(flags.copyFiles)
+	if err != nil {
+		return "", xerrors.Errorf("parse %q: %w", EnvCopyFiles, err)
+	}
+
+	registryPatterns, err := registryAllowlist(flags.innerRegistries, ref.Context().RegistryStr())
+	if err != nil {
+		return "", xerrors.Errorf("parse %q: %w", EnvInnerRegistries, err)
+	}
+
+	var daemonConf dockerutil.DaemonConfig
+	if flags.innerDaemonConfig {
+		daemonConf, err = innerDaemonConfig(ctx, log, flags)
+		if err != nil {
+			return "", xerrors.Errorf("inner daemon config: %w", err)
+		}
+	}
+
+	// Default the inner container's memory limit to that of the outer
+	// container so that it doesn't depend on CODER_MEMORY being set.
+	var memoryDerived bool
+	outerMemory, outerMemoryErr := xunix.ReadMemoryLimit(ctx, log)
+	if outerMemoryErr != nil {
+		log.Info(ctx, "unable to read outer memory limit", slog.Error(outerMemoryErr))
+	} else if flags.memory == 0 && outerMemory.Limit > 0 {
+		memoryDerived = true
+		flags.memory = cliflag.Bytes(dockerutil.InnerMemoryLimit(outerMemory.Limit))
+		blog.Infof("Limiting workspace memory to %d bytes based on the outer container's limit of %d bytes", flags.memory, outerMemory.Limit)
+	}
+
+	resources, err := parseInnerResources(ctx, log, flags)
+	if err != nil {
+		return "", xerrors.Errorf("resource limits: %w", err)
+	}
+
+	dockerAuth, err := imageAuth(ctx, log, ref, flags.imagePullSecret, flags.dockerConfig)
+	if err != nil {
+		return "", xerrors.Errorf("image auth: %w", err)
+	}
+
+	log.Debug(ctx, "pulling image", slog.F("image", flags.innerImage))
+
+	err = dockerutil.PullImage(ctx, &dockerutil.PullImageConfig{
+		Client:     client,
+		Image:      flags.innerImage,
+		Auth:       dockerAuth,
+		ProgressFn: dockerutil.DefaultLogImagePullFn(blog),
+		CacheDir:   flags.imageCacheDir,
+		Log:        log,
+	})
+	if err != nil {
+		return "", xerrors.Errorf("pull image: %w", err)
+	}
+
+	// Image labels may provide defaults for flags so the image must be
+	// pulled before anything depending on those flags is done.
+	inspect, err := client.ImageInspect(ctx, flags.innerImage)
+	if err != nil {
+		return "", xerrors.Errorf("inspect image: %w", err)
+	}
+
+	if inspect.Config != nil {
+		applied, err := applyImageLabels(&flags, inspect.Config.Labels)
+		if err != nil {
+			return "", xerrors.Errorf("apply image labels: %w", err)
+		}
+		for _, l := range applied {
+			blog.Infof("Using %q from image label %s", l.Value, l.Label)
+			log.Debug(ctx, "using value from image label", slog.F("label", l.Label), slog.F("value", l.Value))
+		}
+	}
+
+	envs := defaultContainerEnvs(ctx, flags.agentToken)
+
+	innerEnvs, err := xunix.ParseEnvSpec(splitEnvSpec(flags.innerEnvs))
+	if err != nil {
+		return "", xerrors.Errorf("parse %s: %w", EnvInnerEnvs, err)
+	}
+	// The variables secrets are read from, including the agent token when
+	// it's passed as a secret, are never passed, not even renamed.
+	hidden := secretEnvNames(secretSpecs)
+	if flags.agentTokenFile {
+		hidden = append(hidden, EnvAgentToken)
+	}
+	passed, err := innerEnvs.Resolve(xunix.WithEnvironFn(ctx, func() []string {
+		return withoutEnvs(xunix.Environ(ctx), hidden)
+	}))
+	if err != nil {
+		return "", xerrors.Errorf("resolve %s: %w", EnvInnerEnvs, err)
+	}
+	for _, e := range passed {
+		// The variables envbox sets can't be overridden.
+		if slices.ContainsFunc(envs, func(s string) bool { return strings.HasPrefix(s, e.Name+"=") }) {
+			log.Debug(ctx, "ignoring inner env set by envbox", slog.F("name", e.Name))
+			continue
+		}
+		envs = append(envs, e.String())
+	}
+
+	log.Debug(ctx, "using mounts", slog.F("mounts", mounts), slog.F("mount_specs", mountSpecs))
 
 	devices := make([]container.DeviceMapping, 0, 2)
 	if flags.addTUN {
@@ -537,27 +782,15 @@ func runDockerCVM(ctx context.Context, log slog.Logger, client dockerutil.Client
 	for _, device := range devices {
 		log.Debug(ctx, "chowning device",
 			slog.F("device", device.PathOnHost),
-			slog.F("uid", UserNamespaceOffset),
-			slog.F("gid", UserNamespaceOffset),
+			slog.F("uid", flags.usernsOffset),
+			slog.F("gid", flags.usernsOffset),
 		)
-		err = fs.Chown(device.PathOnHost, UserNamespaceOffset, UserNamespaceOffset)
+		err = fs.Chown(device.PathOnHost, flags.usernsOffset, flags.usernsOffset)
 		if err != nil {
 			return "", xerrors.Errorf("chown device %q: %w", device.PathOnHost, err)
 		}
 	}
 
-	log.Debug(ctx, "pulling image", slog.F("image", flags.innerImage))
-
-	err = dockerutil.PullImage(ctx, &dockerutil.PullImageConfig{
-		Client:     client,
-		Image:      flags.innerImage,
-		Auth:       dockerAuth,
-		ProgressFn: dockerutil.DefaultLogImagePullFn(blog),
-	})
-	if err != nil {
-		return "", xerrors.Errorf("pull image: %w", err)
-	}
-
 	log.Debug(ctx, "remounting /sys")
 
 	// After image pull we remount /sys so sysbox can have appropriate perms to create a container.
@@ -588,20 +821,58 @@ func runDockerCVM(ctx context.Context, log slog.Logger, client dockerutil.Client
 	// Get metadata about the image. We need to know things like the UID/GID
 	// of the user so that we can chown directories to the namespaced UID inside
 	// the inner container as well as whether we should be starting the container
-	// with /sbin/init or something simple like 'sleep infinity'.
-	imgMeta, err := dockerutil.GetImageMetadata(ctx, log, client, flags.innerImage, flags.innerUsername)
+	// with /sbin/init or something simple like 'sleep infinity'. The result
+	// is persisted so that restarts with an unchanged image skip the probe.
+	imgMeta, err := dockerutil.GetCachedImageMetadata(ctx, log, client, dockerutil.ImageMetadataStateFile, flags.innerImage, flags.innerUsername)
+	var createUser *dockerutil.CreateUserConfig
+	if xerrors.Is(err, dockerutil.ErrUserNotFound) && flags.createUser {
+		createUser, err = newCreateUserConfig(flags)
+		if err != nil {
+			return "", xerrors.Errorf("create user: %w", err)
+		}
+		blog.Infof("User %q does not exist in the image, it will be created with UID %d and GID %d", createUser.Username, createUser.UID, createUser.GID)
+		imgMeta.UID = strconv.Itoa(createUser.UID)
+		imgMeta.GID = strconv.Itoa(createUser.GID)
+		imgMeta.HomeDir = createUser.HomeDir
+	}
 	if err != nil {
+		if xerrors.Is(err, dockerutil.ErrUserNotFound) {
+			return "", xerrors.Errorf("get image metadata: %w (set %s to create the user)", err, EnvCreateUser)
+		}
 		return "", xerrors.Errorf("get image metadata: %w", err)
 	}
 
+	// Image labels have been applied by now so the override may have
+	// changed since we validated it.
+	initOverride, err := dockerutil.ParseInitSystem(flags.innerInit)
+	if err != nil {
+		return "", xerrors.Errorf("parse init: %w", err)
+	}
+
+	if initOverride != dockerutil.InitAuto {
+		blog.Infof("Using init system %q, overriding detected %q", initOverride, imgMeta.Init)
+		if initOverride != imgMeta.Init {
+			imgMeta.InitPath = ""
+		}
+		imgMeta.Init = initOverride
+		imgMeta.HasInit = initOverride.IsServiceManager()
+	} else {
+		blog.Infof("Detected init system %q", imgMeta.Init)
+	}
+
 	blog.Infof("Detected entrypoint user '%s:%s' with home directory %q", imgMeta.UID, imgMeta.UID, imgMeta.HomeDir)
 
 	log.Debug(ctx, "fetched image metadata",
 		slog.F("uid", imgMeta.UID),
 		slog.F("gid", imgMeta.GID),
 		slog.F("has_init", imgMeta.HasInit),
+		slog.F("init", imgMeta.Init),
+		slog.F("init_path", imgMeta.InitPath),
 		slog.F("os_release", imgMeta.OsReleaseID),
 		slog.F("home_dir", imgMeta.HomeDir),
+		slog.F("groups", imgMeta.Groups),
+		slog.F("has_dockerd", imgMeta.HasDockerd),
+		slog.F("docker_gid", imgMeta.DockerGID),
 	)
 
 	uid, err := strconv.ParseInt(imgMeta.UID, 10, 32)
@@ -613,16 +884,49 @@ func runDockerCVM(ctx context.Context, log slog.Logger, client dockerutil.Client
 		return "", xerrors.Errorf("parse image gid: %w", err)
 	}
 
-	for _, m := range mounts {
+	groups, missingGroups, err := supplementaryGroups(imgMeta, flags.innerGroups)
+	if err != nil {
+		return "", xerrors.Errorf("supplementary groups: %w", err)
+	}
+	if len(missingGroups) > 0 {
+		log.Warn(ctx, "skipping groups missing from the image", slog.F("groups", missingGroups))
+		blog.Infof("Skipping groups missing from the image: %s", strings.Join(missingGroups, ","))
+	}
+	if len(groups) > 0 {
+		blog.Infof("Adding user to supplementary groups %s", strings.Join(groups, ","))
+	}
+	// Without a docker group in the image the user is made a member of a
+	// new one once the container runs. root can use the socket regardless.
+	addDockerGroup := imgMeta.HasDockerd && imgMeta.DockerGID == "" && uid != 0
+
+	secrets, err := resolveSecrets(ctx, secretSpecs, int(uid), int(gid))
+	if err != nil {
+		return "", xerrors.Errorf("resolve secrets: %w", err)
+	}
+	if flags.agentTokenFile && flags.agentToken != "" {
+		secrets = append(secrets, dockerutil.Secret{
+			Name:  agentTokenSecret,
+			Value: []byte(flags.agentToken),
+			UID:   int(uid),
+			GID:   int(gid),
+			Mode:  0o400,
+		})
+		// Anything in the container's config can be read with 'docker
+		// inspect' and by every process in the container.
+		envs = slices.DeleteFunc(envs, func(e string) bool { return strings.HasPrefix(e, EnvAgentToken+"=") })
+		envs = append(envs, fmt.Sprintf("%s=%s", envAgentTokenFile, path.Join(InnerSecretsDir, agentTokenSecret)))
+	}
+
+	for _, m := range shiftMounts(mounts, mountSpecs) {
 		// Don't modify anything private to envbox.
-		if isPrivateMount(m) {
+		if isPrivateMount(m.Mount) {
 			continue
 		}
 
-		log.Debug(ctx, "chmod'ing directory",
-			slog.F("path", m.Source),
-			slog.F("mode", "02755"),
-		)
+		innerUID, innerGID, chown := m.ids(m.Source, int(uid), int(gid))
+		if !chown && m.NoChmod {
+			continue
+		}
 
 		// If a mount is read-only we have to remount it rw so that we
 		// can id shift it correctly. We'll still mount it read-only into
@@ -635,37 +939,61 @@ func runDockerCVM(ctx context.Context, log slog.Logger, client dockerutil.Client
 			}
 		}
 
-		err := fs.Chmod(m.Source, 0o2755)
-		if err != nil {
-			return "", xerrors.Errorf("chmod mountpoint %q: %w", m.Source, err)
+		if !m.NoChmod {
+			log.Debug(ctx, "chmod'ing directory",
+				slog.F("path", m.Source),
+				slog.F("mode", "02755"),
+			)
+
+			err := fs.Chmod(m.Source, 0o2755)
+			if err != nil {
+				return "", xerrors.Errorf("chmod mountpoint %q: %w", m.Source, err)
+			}
+		}
+
+		if !chown {
+			continue
 		}
 
 		var (
-			shiftedUID = shiftedID(0)
-			shiftedGID = shiftedID(0)
+			shiftedUID = shiftedID(flags.usernsOffset, innerUID)
+			shiftedGID = shiftedID(flags.usernsOffset, innerGID)
 		)
 
-		if isHomeDir(m.Source) {
-			// We want to ensure that the inner directory is ID shifted to
-			// the namespaced UID of the user in the inner container otherwise
-			// they won't be able to write files.
-			shiftedUID = shiftedID(int(uid))
-			shiftedGID = shiftedID(int(gid))
-		}
-
 		log.Debug(ctx, "chowning mount",
 			slog.F("source", m.Source),
 			slog.F("target", m.Mountpoint),
 			slog.F("uid", shiftedUID),
 			slog.F("gid", shiftedGID),
+			slog.F("recursive", m.Recursive),
 		)
 
-		// Any non-home directory we assume should be owned by id-shifted root
-		// user.
-		err = fs.Chown(m.Source, shiftedUID, shiftedGID)
+		if m.Recursive {
+			blog.Infof("Recursively chowning %q to %d:%d", m.Source, innerUID, innerGID)
+			err = chownTree(fs, m.Source, shiftedUID, shiftedGID)
+		} else {
+			err = fs.Chown(m.Source, shiftedUID, shiftedGID)
+		}
 		if err != nil {
 			return "", xerrors.Errorf("chown mountpoint %q: %w", m.Source, err)
 		}
+
+		if flags.ownerRepairTimeout > 0 {
+			err = repairOwnership(ctx, log, blog, fs, m.Source, shiftedUID, shiftedGID, flags.ownerRepairTimeout)
+			if err != nil {
+				blog.Errorf("Failed to repair ownership of %q: %v", m.Source, err)
+				log.Error(ctx, "repair ownership", slog.F("source", m.Source), slog.Error(err))
+			}
+		}
+
+		// Read-only volumes are left as they are.
+		if flags.initHome && !m.ReadOnly && path.Clean(m.Mountpoint) == path.Clean(imgMeta.HomeDir) {
+			err = initHome(ctx, log, blog, fs, client, flags.innerImage, m.Source, imgMeta.HomeDir, int(uid), int(gid), flags.usernsOffset)
+			if err != nil {
+				blog.Errorf("Failed to initialize home directory %q: %v", imgMeta.HomeDir, err)
+				log.Error(ctx, "init home", slog.F("source", m.Source), slog.Error(err))
+			}
+		}
 	}
 
 	if flags.addGPU {
@@ -705,6 +1033,8 @@ func runDockerCVM(ctx context.Context, log slog.Logger, client dockerutil.Client
 			// for duplicates again here after remapping the path.
 			if slices.ContainsFunc(mounts, func(m xunix.Mount) bool {
 				return m.Mountpoint == mountpoint
+			}) || slices.ContainsFunc(mountSpecs, func(m mountSpec) bool {
+				return m.Target == mountpoint
 			}) {
 				log.Debug(ctx, "skipping duplicate mount", slog.F("path", mountpoint))
 				continue
@@ -718,28 +1048,41 @@ func runDockerCVM(ctx context.Context, log slog.Logger, client dockerutil.Client
 		envs = append(envs, xunix.GPUEnvs(ctx)...)
 	}
 
-	blog.Info("Creating workspace...")
-	// If imgMeta.HasInit is true, we just use flags.boostrapScript as the entrypoint.
-	// But if it's false, we need to run /sbin/init as the entrypoint.
-	// We need to mount or run some exec command that injects a systemd service for starting
-	// the coder agent.
-
-	// We need to check that if PID1 is systemd (or /sbin/init) that systemd propagates SIGTERM
-	// to service units. If it doesn't then this solution doesn't help us.
+	innerMounts := dockerMounts(mountSpecs)
+	if useSecrets {
+		innerMounts = append(innerMounts, secretsMount())
+	}
 
+	blog.Info("Creating workspace...")
 	// Create the inner container.
 	containerID, err := dockerutil.CreateContainer(ctx, client, &dockerutil.ContainerConfig{
-		Log:         log,
-		Mounts:      mounts,
-		Devices:     devices,
-		Envs:        envs,
-		Name:        InnerContainerName,
-		Hostname:    flags.innerHostname,
-		WorkingDir:  flags.innerWorkDir,
-		HasInit:     imgMeta.HasInit,
-		Image:       flags.innerImage,
-		CPUs:        int64(flags.cpus),
-		MemoryLimit: int64(flags.memory),
+		Log:           log,
+		Mounts:        mounts,
+		DockerMounts:  innerMounts,
+		Devices:       devices,
+		Envs:          envs,
+		Name:          InnerContainerName,
+		Hostname:      flags.innerHostname,
+		WorkingDir:    flags.innerWorkDir,
+		Init:          imgMeta.Init,
+		InitPath:      imgMeta.InitPath,
+		Entrypoint:    entrypoint,
+		EntrypointCmd: entrypointCmd,
+		Image:         flags.innerImage,
+		MilliCPUs:     int64(flags.cpus),
+		MemoryLimit:   int64(flags.memory),
+
+		MemorySwap:        resources.memorySwap,
+		MemoryReservation: resources.memoryReservation,
+		PidsLimit:         resources.pidsLimit,
+		CPUSetCPUs:        resources.cpusetCPUs,
+		BlkioWeight:       resources.blkioWeight,
+		ShmSize:           resources.shmSize,
+		Ulimits:           resources.ulimits,
+		Labels: map[string]string{
+			ImageLabelPrefix + "init": string(imgMeta.Init),
+		},
+		GroupAdd: groups,
 	})
 	if err != nil {
 		return "", xerrors.Errorf("create container: %w", err)
@@ -752,6 +1095,22 @@ func runDockerCVM(ctx context.Context, log slog.Logger, client dockerutil.Client
 		return "", xerrors.Errorf("prune images: %w", err)
 	}
 
+	if flags.innerDaemonConfig {
+		blog.Infof("Writing %s with MTU %d...", dockerutil.DaemonConfigPath, daemonConf.MTU)
+		log.Debug(ctx, "writing inner daemon config",
+			slog.F("mtu", daemonConf.MTU),
+			slog.F("address_pools", daemonConf.AddressPools),
+			slog.F("registry_mirrors", daemonConf.RegistryMirrors),
+			slog.F("insecure_registries", daemonConf.InsecureRegistries),
+		)
+		err = writeInnerDaemonConfig(ctx, client, containerID, daemonConf)
+		if err != nil {
+			blog.Errorf("Failed to write %s: %v", dockerutil.DaemonConfigPath, err)
+			blog.Info("This is not a fatal error, but the Docker daemon in the workspace will use its defaults.")
+			log.Error(ctx, "write inner daemon config", slog.Error(err))
+		}
+	}
+
 	// TODO fix iptables when istio detected.
 
 	blog.Info("Starting up workspace...")
@@ -760,6 +1119,59 @@ func runDockerCVM(ctx context.Context, log slog.Logger, client dockerutil.Client
 		return "", xerrors.Errorf("start container: %w", err)
 	}
 
+	go func() {
+		err := dockerutil.StreamContainerLogs(ctx, client, log, containerID)
+		if err != nil {
+			log.Error(ctx, "stream container logs", slog.Error(err))
+		}
+	}()
+
+	if createUser != nil {
+		createUser.ContainerID = containerID
+		blog.Infof("Creating user %q...", createUser.Username)
+		out, err := dockerutil.CreateUser(ctx, client, *createUser)
+		if err != nil {
+			return "", xerrors.Errorf("create user: %w", err)
+		}
+		log.Debug(ctx, "created user", slog.F("username", createUser.Username), slog.F("output", string(out)))
+	}
+
+	if addDockerGroup {
+		blog.Infof("Adding user to the %q group...", dockerutil.DockerGroup)
+		out, err := dockerutil.AddGroupMember(ctx, client, containerID, dockerutil.DockerGroup, flags.innerUsername)
+		if err != nil {
+			blog.Infof("Unable to add user to the %q group: %s", dockerutil.DockerGroup, err.Error())
+			blog.Info("This is not a fatal error, but the user may not be able to use the inner Docker daemon.")
+		} else {
+			log.Debug(ctx, "added user to group", slog.F("group", dockerutil.DockerGroup), slog.F("output", string(out)))
+		}
+	}
+
+	// Secrets may be owned by a user that was just created.
+	if len(secrets) > 0 {
+		blog.Infof("Writing %d secrets to %q...", len(secrets), InnerSecretsDir)
+		err = dockerutil.WriteSecrets(ctx, client, containerID, InnerSecretsDir, secrets)
+		if err != nil {
+			return "", xerrors.Errorf("write secrets: %w", err)
+		}
+	}
+
+	if len(fileSpecs) > 0 {
+		blog.Info("Copying files into the workspace...")
+		err = copyFiles(ctx, log, blog, client, containerID, fileSpecs, imgMeta.HomeDir, int(uid), int(gid))
+		if err != nil {
+			return "", xerrors.Errorf("copy files: %w", err)
+		}
+	}
+
+	if flags.innerRegistryAuth {
+		err = passRegistryCredentials(ctx, log, blog, client, containerID, flags, registryPatterns, ref.Context().RegistryStr(), dockerAuth, imgMeta.HomeDir, int(uid), int(gid))
+		if err != nil {
+			blog.Errorf("Failed to pass registry credentials to the workspace: %v", err)
+			log.Error(ctx, "pass registry credentials", slog.Error(err))
+		}
+	}
+
 	log.Debug(ctx, "creating bootstrap directory", slog.F("directory", imgMeta.HomeDir))
 
 	// Create the directory to which we will download the agent.
@@ -798,12 +1210,66 @@ func runDockerCVM(ctx context.Context, log slog.Logger, client dockerutil.Client
 		}
 	}
 
+	if outerMemoryErr == nil && flags.memory > 0 {
+		memLimit := xunix.MemoryLimit{Limit: int64(flags.memory), CGroup: outerMemory.CGroup}
+		log.Debug(ctx, "setting memory limit",
+			slog.F("limit", memLimit.Limit),
+			slog.F("cgroup", memLimit.CGroup.String()),
+		)
+
+		// Like the CPU quota, the limit must be visible inside the inner
+		// container for runtimes like the JVM to size their heaps.
+		if err := dockerutil.SetContainerMemoryLimit(ctx, containerID, memLimit); err != nil {
+			blog.Infof("Unable to set memory limit for inner container: %s", err.Error())
+			blog.Info("This is not a fatal error, but it may cause cgroup-aware applications to misbehave.")
+		}
+	}
+
+	if flags.resizeInterval > 0 {
+		go dockerutil.WatchResize(ctx, dockerutil.ResizeConfig{
+			Log:         log.Named("resize"),
+			Client:      client,
+			ContainerID: containerID,
+			Interval:    flags.resizeInterval,
+			UpdateCPUs:  flags.cpus == 0,
+			// An unlimited outer container at startup may be given a
+			// limit later on.
+			UpdateMemory: memoryDerived || (outerMemoryErr == nil && flags.memory == 0),
+			MemorySwap:   resources.memorySwap,
+		})
+	}
+
 	blog.Info("Envbox startup complete!")
 	if flags.boostrapScript == "" {
 		return "", nil
 	}
 	blog.Infof("Bootstrapping workspace...")
 
+	if flags.bootstrapMode == bootstrapModeSystemd {
+		// The agent can only be a unit if systemd is PID 1.
+		runsSystemd := imgMeta.Init == dockerutil.InitSystemd &&
+			(entrypoint == dockerutil.EntrypointAuto || entrypoint == dockerutil.EntrypointInit)
+		if runsSystemd {
+			blog.Infof("Starting the agent as systemd unit %q...", dockerutil.AgentUnitName)
+			err = dockerutil.BootstrapSystemdUnit(ctx, client, dockerutil.SystemdBootstrapConfig{
+				ContainerID: containerID,
+				UID:         imgMeta.UID,
+				GID:         imgMeta.GID,
+				Groups:      groups,
+				HomeDir:     imgMeta.HomeDir,
+				Script:      flags.boostrapScript,
+				Env:         append(slices.Clone(envs), fmt.Sprintf("BINARY_DIR=%s", bootDir)),
+			})
+			if err != nil {
+				return "", xerrors.Errorf("bootstrap systemd unit: %w", err)
+			}
+			// systemd stops the agent when the container is stopped so
+			// there is no exec to forward signals to.
+			return "", nil
+		}
+		blog.Infof("Inner container is not running systemd (init %q), bootstrapping with exec instead", imgMeta.Init)
+	}
+
 	bootstrapExec, err := client.ContainerExecCreate(ctx, containerID, container.ExecOptions{
 		User:         imgMeta.UID,
 		Cmd:          []string{"/bin/sh", "-s"},
@@ -849,6 +1315,38 @@ func runDockerCVM(ctx context.Context, log slog.Logger, client dockerutil.Client
 	return bootstrapExec.ID, nil
 }
 
+const (
+	bootstrapModeExec    = "exec"
+	bootstrapModeSystemd = "systemd"
+)
+
+// imageAuth resolves the credentials to use when pulling ref. Credentials
+// found in the docker config file take precedence over the image pull secret.
+func imageAuth(ctx context.Context, log slog.Logger, ref name.Reference, imagePullSecret, dockerConfig string) (dockerutil.AuthConfig, error) {
+	var (
+		fs         = xunix.GetFS(ctx)
+		dockerAuth dockerutil.AuthConfig
+		err        error
+	)
+	if imagePullSecret != "" {
+		dockerAuth, err = dockerutil.AuthConfigFromString(imagePullSecret, ref.Context().RegistryStr())
+		if err != nil {
+			return dockerutil.AuthConfig{}, xerrors.Errorf("parse auth config: %w", err)
+		}
+	}
+
+	log.Info(ctx, "checking for docker config file", slog.F("path", dockerConfig))
+	if _, err := fs.Stat(dockerConfig); err == nil {
+		log.Info(ctx, "detected file", slog.F("image", ref.Name()))
+		dockerAuth, err = dockerutil.AuthConfigFromPath(dockerConfig, ref.Context().RegistryStr())
+		if err != nil && !xerrors.Is(err, os.ErrNotExist) {
+			return dockerutil.AuthConfig{}, xerrors.Errorf("auth config from file: %w", err)
+		}
+	}
+
+	return dockerAuth, nil
+}
+
 //nolint:revive
 func dockerdArgs(link, cidr string, isNoSpace bool) ([]string, error) {
 	// We need to adjust the MTU for the host otherwise packets will fail delivery.
@@ -870,7 +1368,7 @@ func dockerdArgs(link, cidr string, isNoSpace bool) ([]string, error) {
 		"--debug",
 		"--log-level=debug",
 		fmt.Sprintf("--mtu=%d", mtu),
-		"--userns-remap=coder",
+		"--userns-remap=" + userNamespaceUser,
 		"--storage-driver=overlay2",
 		fmt.Sprintf("--bip=%s/%d", dockerBip, prefixLen),
 	}
@@ -886,94 +1384,99 @@ func dockerdArgs(link, cidr string, isNoSpace bool) ([]string, error) {
 }
 
 // dockerdBinName is the post-exec cmdline of the wrapped dockerd (unshare ->
-// sh -> dockerd), used for background.Process exit detection.
+// envbox delegate-cgroups -> dockerd), used for background.Process exit
+// detection.
 const dockerdBinName = "dockerd"
 
 // dockerdSubtreeControlMaxAttempts bounds the cgroup-subtree-control retry
-// loop in wrap_dockerd.sh. Diverges from moby's hack/dind (unbounded).
+// loop in cgroup.Delegate. Diverges from moby's hack/dind (unbounded).
 const dockerdSubtreeControlMaxAttempts = 100
 
-//go:embed wrap_dockerd.sh
-var wrapDockerdScript string
-
-// wrapDockerdCmd wraps dockerd with `unshare --cgroup` + cgroup2 remount and
-// delegation (see wrap_dockerd.sh) so inner container cgroups become
-// descendants of the envbox container's own cgroup on the host, restoring
-// pod attribution for cgroup-aware tools (Tetragon, Falco, etc.).
+// wrapDockerdCmd wraps dockerd with `unshare --cgroup` and a re-exec of
+// envbox that remounts cgroup2 and delegates it (see cgroup.Delegate) so
+// inner container cgroups become descendants of the envbox container's own
+// cgroup on the host, restoring pod attribution for cgroup-aware tools
+// (Tetragon, Falco, etc.). If controllers are given only those are enabled
+// for the inner containers, otherwise all available controllers are.
 //
 // We do NOT pass --mount on unshare: the remount intentionally leaks into
 // envbox's mount namespace so sysbox-fs's /var/lib/sysboxfs/ mounts stay
-// visible to sysbox-runc. xunix.readCPUQuotaCGroupV2 has a fallback for
-// the resulting cpu.max path change.
+// visible to sysbox-runc. The cgroup package resolves paths relative to
+// the remounted hierarchy so limits are still read from the right place.
 //
 // See: https://github.com/moby/moby/issues/45378#issuecomment-2886261231
-func wrapDockerdCmd(dargs []string) (string, []string) {
-	shellCmd := fmt.Sprintf("envbox_max_attempts=%d\n%s", dockerdSubtreeControlMaxAttempts, wrapDockerdScript)
+func wrapDockerdCmd(controllers, dargs []string) (string, []string) {
 	wrapperArgs := []string{
 		"--cgroup",
-		"/bin/sh",
-		"-c",
-		shellCmd,
-		dockerdBinName,
+		envboxBin(),
+		delegateCGroupsCmdName,
+	}
+	if len(controllers) > 0 {
+		wrapperArgs = append(wrapperArgs, "--controllers="+strings.Join(controllers, ","))
 	}
+	wrapperArgs = append(wrapperArgs, "--", dockerdBinName)
 	wrapperArgs = append(wrapperArgs, dargs...)
 	return "unshare", wrapperArgs
 }
 
-// TODO This is bad code.
-func filterElements(ss []string, filters ...string) []string {
-	filtered := make([]string, 0, len(ss))
-	for _, f := range filters {
-		f = strings.TrimSpace(f)
-		for _, s := range ss {
-			toks := strings.Split(s, "=")
-			if len(toks) < 2 {
-				// Malformed environment variable.
-				continue
-			}
-
-			key := toks[0]
-
-			if strings.HasSuffix(f, "*") {
-				filter := strings.TrimSuffix(f, "*")
-				if strings.HasPrefix(key, filter) {
-					filtered = append(filtered, s)
-				}
-			} else if key == f {
-				filtered = append(filtered, s)
-			}
-		}
+// envboxBin returns the path of the running envbox binary so it can re-exec
+// itself.
+func envboxBin() string {
+	bin, err := os.Executable()
+	if err != nil {
+		return "/envbox"
 	}
-
-	return filtered
+	return bin
 }
 
 // parseMounts parses a list of mounts from containerMounts. The format should
-// be "src:dst[:ro],src:dst[:ro]".
-func parseMounts(containerMounts string) ([]xunix.Mount, error) {
+// be "src:dst[:ro],src:dst[:ro]". Paths containing ':' or ',' can't be
+// expressed, use parseMountSpecs for those. Relative paths and options other
+// than 'ro' have always been accepted, any option but 'ro' meaning 'rw', so
+// they are returned as warnings instead of failing existing deployments.
+func parseMounts(containerMounts string) ([]xunix.Mount, []string, error) {
 	if containerMounts == "" {
-		return nil, nil
+		return nil, nil, nil
 	}
 
 	mountsStr := strings.Split(containerMounts, ",")
 
-	mounts := make([]xunix.Mount, 0, len(mountsStr))
+	var (
+		mounts   = make([]xunix.Mount, 0, len(mountsStr))
+		warnings []string
+	)
 	for _, mount := range mountsStr {
 		tokens := strings.Split(mount, ":")
 		if len(tokens) < 2 || len(tokens) > 3 {
-			return nil, xerrors.Errorf("malformed mounts value %q", containerMounts)
+			return nil, nil, xerrors.Errorf("malformed mounts value %q", containerMounts)
 		}
 		m := xunix.Mount{
 			Source:     tokens[0],
 			Mountpoint: tokens[1],
 		}
+		if !path.IsAbs(m.Source) || !path.IsAbs(m.Mountpoint) {
+			warnings = append(warnings, fmt.Sprintf("mount %q should use absolute paths", mount))
+		}
 		if len(tokens) == 3 {
 			m.ReadOnly = tokens[2] == "ro"
+			if tokens[2] != "ro" && tokens[2] != "rw" {
+				warnings = append(warnings, fmt.Sprintf("unknown option %q for mount %q is treated as 'rw', use 'ro' or 'rw'", tokens[2], mount))
+			}
 		}
 		mounts = append(mounts, m)
 	}
 
-	return mounts, nil
+	return mounts, warnings, nil
+}
+
+// splitEnvSpec splits the value of CODER_INNER_ENVS into entries. Entries
+// are separated by newlines if there are any, so that literal values may
+// contain commas, and by commas otherwise.
+func splitEnvSpec(spec string) []string {
+	if strings.Contains(spec, "\n") {
+		return strings.Split(spec, "\n")
+	}
+	return strings.Split(spec, ",")
 }
 
 // defaultContainerEnvs returns environment variables that should always
@@ -1049,6 +1552,116 @@ func isHomeDir(fpath string) bool {
 
 // shiftedID returns the ID but shifted to the user namespace offset we
 // use for the inner container.
-func shiftedID(id int) int {
-	return id + UserNamespaceOffset
+func shiftedID(offset, id int) int {
+	return id + offset
+}
+
+// supplementaryGroups returns the GIDs of the groups added to the inner
+// container's processes: the user's groups in the image, extra and the
+// image's docker group. Names in extra are resolved against the image's
+// groups, the names of groups the image doesn't have are returned as
+// missing.
+func supplementaryGroups(meta dockerutil.ImageMetadata, extra []string) ([]string, []string, error) {
+	var (
+		groups  = slices.Clone(meta.Groups)
+		missing []string
+	)
+	// Group names can't contain commas so they're split from flags as well.
+	for _, g := range strings.Split(strings.Join(extra, ","), ",") {
+		g = strings.TrimSpace(g)
+		if g == "" {
+			continue
+		}
+		if gid, err := strconv.Atoi(g); err == nil {
+			if gid < 0 || gid >= userNamespaceSize {
+				return nil, nil, xerrors.Errorf("GID %d must be between 0 and %d", gid, userNamespaceSize-1)
+			}
+			groups = append(groups, g)
+			continue
+		}
+		gid, ok := meta.GroupGIDs[g]
+		if !ok {
+			missing = append(missing, g)
+			continue
+		}
+		groups = append(groups, gid)
+	}
+	if meta.HasDockerd && meta.DockerGID != "" {
+		groups = append(groups, meta.DockerGID)
+	}
+
+	var deduped []string
+	for _, g := range groups {
+		if !slices.Contains(deduped, g) {
+			deduped = append(deduped, g)
+		}
+	}
+	return deduped, missing, nil
+}
+
+// newCreateUserConfig returns the user to create in the inner container
+// according to flags.
+func newCreateUserConfig(flags flags) (*dockerutil.CreateUserConfig, error) {
+	err := dockerutil.ValidateUsername(flags.innerUsername)
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range []int{flags.createUserUID, flags.createUserGID} {
+		if id < 0 || id >= userNamespaceSize {
+			return nil, xerrors.Errorf("ID %d must be between 0 and %d", id, userNamespaceSize-1)
+		}
+	}
+
+	home := flags.createUserHome
+	if home == "" {
+		home = path.Join("/home", flags.innerUsername)
+	}
+	if !path.IsAbs(home) {
+		return nil, xerrors.Errorf("home directory %q must be an absolute path", home)
+	}
+
+	return &dockerutil.CreateUserConfig{
+		Username: flags.innerUsername,
+		UID:      flags.createUserUID,
+		GID:      flags.createUserGID,
+		HomeDir:  path.Clean(home),
+		Shell:    flags.createUserShell,
+		Sudo:     flags.createUserSudo,
+	}, nil
+}
+
+// setUserNamespaceOffset makes the userNamespaceSize IDs beginning at
+// offset the only subordinate ID range of userNamespaceUser in /etc/subuid
+// and /etc/subgid so that dockerd maps the inner container's user
+// namespace to them. It must be called before dockerd starts.
+func setUserNamespaceOffset(ctx context.Context, log slog.Logger, offset int) error {
+	if offset <= 0 {
+		return xerrors.Errorf("offset %d must be positive", offset)
+	}
+
+	fs := xunix.GetFS(ctx)
+	for _, fpath := range []string{xunix.SubUIDPath, xunix.SubGIDPath} {
+		raw, err := afero.ReadFile(fs, fpath)
+		if err != nil && !xerrors.Is(err, os.ErrNotExist) {
+			return xerrors.Errorf("read %q: %w", fpath, err)
+		}
+		content, err := xunix.SetSubIDRange(raw, xunix.SubIDRange{
+			Name:  userNamespaceUser,
+			Start: offset,
+			Count: userNamespaceSize,
+		})
+		if err != nil {
+			return xerrors.Errorf("set range in %q: %w", fpath, err)
+		}
+		if bytes.Equal(content, raw) {
+			continue
+		}
+
+		log.Info(ctx, "setting user namespace offset", slog.F("path", fpath), slog.F("offset", offset))
+		err = afero.WriteFile(fs, fpath, content, 0o644)
+		if err != nil {
+			return xerrors.Errorf("write %q: %w", fpath, err)
+		}
+	}
+	return nil
 }
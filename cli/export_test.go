@@ -2,7 +2,6 @@ package cli
 
 // Aliases to expose internal helpers to the external _test package.
 var (
-	WrapDockerdCmd                   = wrapDockerdCmd
-	DockerdBinName                   = dockerdBinName
-	DockerdSubtreeControlMaxAttempts = dockerdSubtreeControlMaxAttempts
+	WrapDockerdCmd = wrapDockerdCmd
+	DockerdBinName = dockerdBinName
 )
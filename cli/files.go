@@ -0,0 +1,280 @@
+package cli
+
+import (
+	"context"
+	"encoding/csv"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/afero"
+	"golang.org/x/xerrors"
+
+	"cdr.dev/slog/v3"
+	"github.com/coder/envbox/buildlog"
+	"github.com/coder/envbox/dockerutil"
+	"github.com/coder/envbox/xunix"
+)
+
+// overwritePolicy decides what happens to files that already exist in the
+// inner container.
+type overwritePolicy string
+
+const (
+	overwriteNever  overwritePolicy = "never"
+	overwriteAlways overwritePolicy = "always"
+)
+
+// fileSpec is a file or directory copied from the outer container into the
+// inner container once it has started.
+type fileSpec struct {
+	Source string
+	// Target is the path in the inner container. A leading '~' is the
+	// user's home directory.
+	Target string
+	// Owner is who the copied files are owned by, one of ownerUser,
+	// ownerRoot or ownerID. UID and GID are the IDs used by ownerID.
+	Owner ownerMode
+	UID   int
+	GID   int
+	// Mode overrides the mode of copied files, directories keep the mode
+	// of their source.
+	Mode      os.FileMode
+	Overwrite overwritePolicy
+}
+
+// parseFileSpec parses a file in the form of a comma separated list of
+// '<key>=<value>' fields. Fields may be quoted so that values can contain
+// commas.
+//
+// Supported fields:
+//   - source, src: the file or directory in the outer container. Required.
+//   - target, destination, dst: the path in the inner container, '~' is the
+//     user's home directory. Required.
+//   - owner: who the files are owned by, one of 'user' (default), 'root' or
+//     '<uid>:<gid>'
+//   - mode: the octal mode of the files (default the mode of the source)
+//   - overwrite: 'never' (default) or 'always'
+func parseFileSpec(spec string) (fileSpec, error) {
+	r := csv.NewReader(strings.NewReader(spec))
+	fields, err := r.Read()
+	if err != nil {
+		return fileSpec{}, xerrors.Errorf("malformed file %q: %w", spec, err)
+	}
+
+	f := fileSpec{
+		Owner:     ownerUser,
+		Overwrite: overwriteNever,
+	}
+	for _, field := range fields {
+		key, val, ok := strings.Cut(strings.TrimSpace(field), "=")
+		if !ok {
+			return fileSpec{}, xerrors.Errorf("file field %q requires a value", key)
+		}
+		switch strings.ToLower(key) {
+		case "source", "src":
+			f.Source = val
+		case "target", "destination", "dst":
+			f.Target = val
+		case "owner":
+			f.Owner, f.UID, f.GID, err = parseOwner(val)
+			if err != nil {
+				return fileSpec{}, err
+			}
+			if f.Owner == ownerAuto || f.Owner == ownerNone {
+				return fileSpec{}, xerrors.Errorf("invalid owner %q, must be one of 'user', 'root' or '<uid>:<gid>'", val)
+			}
+		case "mode":
+			mode, err := strconv.ParseUint(val, 8, 32)
+			if err != nil || mode > 0o777 {
+				return fileSpec{}, xerrors.Errorf("invalid mode %q: must be octal permission bits", val)
+			}
+			f.Mode = os.FileMode(mode)
+		case "overwrite":
+			f.Overwrite = overwritePolicy(val)
+			if f.Overwrite != overwriteNever && f.Overwrite != overwriteAlways {
+				return fileSpec{}, xerrors.Errorf("invalid overwrite %q, must be one of %q or %q", val, overwriteNever, overwriteAlways)
+			}
+		default:
+			return fileSpec{}, xerrors.Errorf("unknown file field %q", key)
+		}
+	}
+
+	if !path.IsAbs(f.Source) {
+		return fileSpec{}, xerrors.Errorf("invalid file %q: source must be an absolute path", spec)
+	}
+	if !path.IsAbs(f.Target) && f.Target != "~" && !strings.HasPrefix(f.Target, "~/") {
+		return fileSpec{}, xerrors.Errorf("invalid file %q: target must be an absolute path or start with '~/'", spec)
+	}
+	return f, nil
+}
+
+func parseFileSpecs(specs []string) ([]fileSpec, error) {
+	files := make([]fileSpec, 0, len(specs))
+	for _, spec := range specs {
+		f, err := parseFileSpec(spec)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, f)
+	}
+	return files, nil
+}
+
+// copyFiles copies specs into the inner container. uid and gid are the
+// IDs of the image user. Files that exist in the inner container are only
+// replaced if their spec says so and existing directories are left as
+// they are. Missing parents of targets in the home directory are created
+// with the owner of the target, the daemon would create them as root.
+func copyFiles(ctx context.Context, log slog.Logger, blog buildlog.Logger, client dockerutil.Client, containerID string, specs []fileSpec, homeDir string, uid, gid int) error {
+	var (
+		fs = xunix.GetFS(ctx)
+		// parents are the parent directories already added to files.
+		parents = map[string]bool{}
+		files   []dockerutil.ContainerFile
+	)
+	for _, spec := range specs {
+		target := spec.Target
+		if target == "~" || strings.HasPrefix(target, "~/") {
+			target = path.Join(homeDir, strings.TrimPrefix(target, "~"))
+		}
+		target = path.Clean(target)
+
+		var fileUID, fileGID int
+		switch spec.Owner {
+		case ownerUser:
+			fileUID, fileGID = uid, gid
+		case ownerID:
+			fileUID, fileGID = spec.UID, spec.GID
+		}
+
+		found, err := readFileSpec(fs, spec.Source, target, spec.Mode, fileUID, fileGID)
+		if err != nil {
+			return xerrors.Errorf("read %q: %w", spec.Source, err)
+		}
+
+		dirs, err := missingHomeParents(ctx, client, containerID, homeDir, target, parents)
+		if err != nil {
+			return err
+		}
+		for _, dir := range dirs {
+			parents[dir] = true
+			files = append(files, dockerutil.ContainerFile{
+				Path: dir,
+				Mode: 0o755,
+				UID:  fileUID,
+				GID:  fileGID,
+				Dir:  true,
+			})
+		}
+
+		var copied, skipped int
+		for _, f := range found {
+			exists, err := dockerutil.PathExists(ctx, client, containerID, f.Path)
+			if err != nil {
+				return err
+			}
+			switch {
+			case exists && f.Dir:
+				continue
+			case exists && spec.Overwrite == overwriteNever:
+				skipped++
+				continue
+			case !f.Dir:
+				copied++
+			}
+			files = append(files, f)
+		}
+
+		log.Debug(ctx, "copying files",
+			slog.F("source", spec.Source),
+			slog.F("target", target),
+			slog.F("copied", copied),
+			slog.F("skipped", skipped),
+		)
+		if skipped > 0 {
+			blog.Infof("Copying %d files from %q to %q, %d already exist and were skipped", copied, spec.Source, target, skipped)
+		} else {
+			blog.Infof("Copying %d files from %q to %q", copied, spec.Source, target)
+		}
+	}
+
+	if len(files) == 0 {
+		return nil
+	}
+	return dockerutil.CopyFilesToContainer(ctx, client, containerID, files)
+}
+
+// missingHomeParents returns the parents of target below homeDir that
+// don't exist in the container and aren't in added, outermost first.
+func missingHomeParents(ctx context.Context, client dockerutil.Client, containerID, homeDir, target string, added map[string]bool) ([]string, error) {
+	homeDir = path.Clean(homeDir)
+	if homeDir == "/" || !strings.HasPrefix(target, homeDir+"/") {
+		return nil, nil
+	}
+
+	var dirs []string
+	for dir := path.Dir(target); dir != homeDir && !added[dir]; dir = path.Dir(dir) {
+		exists, err := dockerutil.PathExists(ctx, client, containerID, dir)
+		if err != nil {
+			return nil, err
+		}
+		if exists {
+			break
+		}
+		dirs = append([]string{dir}, dirs...)
+	}
+	return dirs, nil
+}
+
+// readFileSpec reads source, which may be a directory, into files rooted
+// at target. Symbolic links are followed since ConfigMaps and Secrets are
+// mounted as links into a hidden directory, which is skipped.
+func readFileSpec(fs xunix.FS, source, target string, mode os.FileMode, uid, gid int) ([]dockerutil.ContainerFile, error) {
+	fi, err := fs.Stat(source)
+	if err != nil {
+		return nil, err
+	}
+
+	if !fi.IsDir() {
+		content, err := afero.ReadFile(fs, source)
+		if err != nil {
+			return nil, err
+		}
+		if mode == 0 {
+			mode = fi.Mode().Perm()
+		}
+		return []dockerutil.ContainerFile{{
+			Path:    target,
+			Content: content,
+			Mode:    int64(mode),
+			UID:     uid,
+			GID:     gid,
+		}}, nil
+	}
+
+	files := []dockerutil.ContainerFile{{
+		Path: target,
+		Mode: int64(fi.Mode().Perm()),
+		UID:  uid,
+		GID:  gid,
+		Dir:  true,
+	}}
+	entries, err := afero.ReadDir(fs, source)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), "..") {
+			continue
+		}
+		children, err := readFileSpec(fs, filepath.Join(source, e.Name()), path.Join(target, e.Name()), mode, uid, gid)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, children...)
+	}
+	return files, nil
+}
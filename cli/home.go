@@ -0,0 +1,220 @@
+package cli
+
+import (
+	"archive/tar"
+	"context"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/afero"
+	"golang.org/x/xerrors"
+
+	"cdr.dev/slog/v3"
+	"github.com/coder/envbox/buildlog"
+	"github.com/coder/envbox/dockerutil"
+	"github.com/coder/envbox/xunix"
+)
+
+// homeMarkerFile is written to the source of the mount of the user's home
+// directory once it has been initialized.
+const homeMarkerFile = ".envbox-home"
+
+// skelDir holds the files useradd copies into new home directories.
+const skelDir = "/etc/skel"
+
+// initHome populates source, the mount of the user's home directory, with
+// the contents of the home directory in the image or /etc/skel if the image
+// doesn't have one. A new volume would otherwise hide the dotfiles baked
+// into the image. It only happens once per volume and existing files are
+// never overwritten. uid and gid are the user's IDs in the inner container.
+func initHome(ctx context.Context, log slog.Logger, blog buildlog.Logger, fs xunix.FS, client dockerutil.Client, img, source, homeDir string, uid, gid, offset int) error {
+	fi, err := fs.Stat(source)
+	if err != nil {
+		return xerrors.Errorf("stat %q: %w", source, err)
+	}
+	if !fi.IsDir() {
+		return nil
+	}
+
+	markerPath := filepath.Join(source, homeMarkerFile)
+	_, err = fs.Stat(markerPath)
+	if err == nil {
+		return nil
+	}
+	if !xerrors.Is(err, os.ErrNotExist) {
+		return xerrors.Errorf("stat %q: %w", markerPath, err)
+	}
+
+	// A volume that is in use already, e.g. one created before envbox
+	// initialized home directories, is left alone so that files the user
+	// deleted don't reappear.
+	empty, err := isEmptyHome(fs, source)
+	if err != nil {
+		return err
+	}
+	if !empty {
+		log.Debug(ctx, "home directory is not empty, not initializing it", slog.F("source", source))
+		return writeHomeMarker(fs, markerPath, "")
+	}
+
+	// Files from the image keep their owners while /etc/skel, which is
+	// owned by root, is given to the user like useradd does.
+	from := homeDir
+	copied, err := copyImagePath(ctx, fs, client, img, homeDir, source, func(hdr *tar.Header) (int, int) {
+		return shiftedID(offset, hdr.Uid), shiftedID(offset, hdr.Gid)
+	})
+	if err != nil && !xerrors.Is(err, os.ErrNotExist) {
+		return xerrors.Errorf("copy %s from image: %w", homeDir, err)
+	}
+	if copied == 0 {
+		from = skelDir
+		copied, err = copyImagePath(ctx, fs, client, img, skelDir, source, func(*tar.Header) (int, int) {
+			return shiftedID(offset, uid), shiftedID(offset, gid)
+		})
+		if err != nil && !xerrors.Is(err, os.ErrNotExist) {
+			return xerrors.Errorf("copy %s from image: %w", skelDir, err)
+		}
+	}
+
+	log.Debug(ctx, "initialized home directory",
+		slog.F("source", source),
+		slog.F("from", from),
+		slog.F("copied", copied),
+	)
+	if copied > 0 {
+		blog.Infof("Initialized home directory %q with %d files from %s in the image", homeDir, copied, from)
+	}
+
+	return writeHomeMarker(fs, markerPath, from)
+}
+
+// isEmptyHome returns whether dir contains nothing but files created by
+// envbox or mkfs.
+func isEmptyHome(fs xunix.FS, dir string) (bool, error) {
+	names, err := afero.ReadDir(fs, dir)
+	if err != nil {
+		return false, xerrors.Errorf("read dir %q: %w", dir, err)
+	}
+	for _, fi := range names {
+		switch fi.Name() {
+		case ownershipMarkerFile, "lost+found":
+			continue
+		}
+		return false, nil
+	}
+	return true, nil
+}
+
+// writeHomeMarker records that the home directory was initialized from
+// the directory from in the image, if any.
+func writeHomeMarker(fs xunix.FS, fpath, from string) error {
+	err := afero.WriteFile(fs, fpath, []byte(from+"\n"), 0o644)
+	if err != nil {
+		return xerrors.Errorf("write %q: %w", fpath, err)
+	}
+	return nil
+}
+
+// copyImagePath copies the contents of the directory p in img into dest,
+// skipping files that already exist in dest. owner returns the host IDs of
+// a copied file. It returns the number of files copied.
+func copyImagePath(ctx context.Context, fs xunix.FS, client dockerutil.Client, img, p, dest string, owner func(*tar.Header) (int, int)) (int, error) {
+	var copied int
+	err := dockerutil.ReadImagePath(ctx, client, img, p, func(tr *tar.Reader) error {
+		for {
+			hdr, err := tr.Next()
+			if xerrors.Is(err, io.EOF) {
+				return nil
+			}
+			if err != nil {
+				return xerrors.Errorf("read archive: %w", err)
+			}
+
+			// Entries are named relative to the parent of p so the first
+			// component is p itself.
+			_, rel, _ := strings.Cut(path.Clean(hdr.Name), "/")
+			if rel == "" {
+				continue
+			}
+			target := filepath.Join(dest, rel)
+			if !strings.HasPrefix(target, dest+string(filepath.Separator)) {
+				continue
+			}
+
+			ok, err := copyTarEntry(fs, tr, hdr, target)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				continue
+			}
+
+			uid, gid := owner(hdr)
+			err = fs.Lchown(target, uid, gid)
+			if err != nil {
+				return xerrors.Errorf("chown %q: %w", target, err)
+			}
+			copied++
+		}
+	})
+	return copied, err
+}
+
+// copyTarEntry creates target from hdr unless it already exists. Only
+// directories, regular files and, if the filesystem supports them,
+// symbolic links are copied. It returns whether target was created.
+func copyTarEntry(fs xunix.FS, tr *tar.Reader, hdr *tar.Header, target string) (bool, error) {
+	_, err := fs.LStat(target)
+	if err == nil {
+		return false, nil
+	}
+	if !xerrors.Is(err, os.ErrNotExist) {
+		return false, xerrors.Errorf("stat %q: %w", target, err)
+	}
+
+	mode := hdr.FileInfo().Mode() & (os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky)
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		err = fs.Mkdir(target, mode.Perm())
+	case tar.TypeReg:
+		err = writeTarFile(fs, tr, target, mode.Perm())
+	case tar.TypeSymlink:
+		linker, ok := fs.(afero.Linker)
+		if !ok {
+			return false, nil
+		}
+		err = linker.SymlinkIfPossible(hdr.Linkname, target)
+		if err != nil {
+			return false, xerrors.Errorf("symlink %q: %w", target, err)
+		}
+		return true, nil
+	default:
+		return false, nil
+	}
+	if err != nil {
+		return false, xerrors.Errorf("create %q: %w", target, err)
+	}
+
+	// The mode given on creation is subject to the umask.
+	err = fs.Chmod(target, mode)
+	if err != nil {
+		return false, xerrors.Errorf("chmod %q: %w", target, err)
+	}
+	return true, nil
+}
+
+func writeTarFile(fs xunix.FS, r io.Reader, fpath string, mode os.FileMode) error {
+	f, err := fs.OpenFile(fpath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, r)
+	if err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,150 @@
+package cli
+
+import (
+	"os"
+	"sort"
+	"strconv"
+
+	"github.com/spf13/cobra"
+	"golang.org/x/xerrors"
+
+	"github.com/coder/envbox/dockerutil"
+)
+
+// ImageLabelPrefix namespaces the OCI labels on the inner image that
+// envbox consults for defaults.
+const ImageLabelPrefix = "com.coder.envbox."
+
+// imageLabel maps an inner image label to the flag it provides a default
+// for.
+type imageLabel struct {
+	// label is the name of the label without ImageLabelPrefix.
+	label string
+	// flag and env are the flag and environment variable that take
+	// precedence over the label.
+	flag string
+	env  string
+	// apply sets the value of the label on flags.
+	apply func(f *flags, val string) error
+}
+
+var imageLabels = []imageLabel{
+	{
+		label: "user",
+		flag:  "username",
+		env:   EnvInnerUsername,
+		apply: func(f *flags, val string) error {
+			f.innerUsername = val
+			return nil
+		},
+	},
+	{
+		label: "workdir",
+		flag:  "work-dir",
+		env:   EnvInnerWorkDir,
+		apply: func(f *flags, val string) error {
+			f.innerWorkDir = val
+			return nil
+		},
+	},
+	{
+		label: "inner-usr-lib-dir",
+		flag:  "inner-usr-lib-dir",
+		env:   EnvInnerUsrLibDir,
+		apply: func(f *flags, val string) error {
+			f.innerUsrLibDir = val
+			return nil
+		},
+	},
+	{
+		label: "add-fuse",
+		flag:  "add-fuse",
+		env:   EnvAddFuse,
+		apply: func(f *flags, val string) error {
+			b, err := strconv.ParseBool(val)
+			if err != nil {
+				return err
+			}
+			f.addFUSE = b
+			return nil
+		},
+	},
+	{
+		label: "add-tun",
+		flag:  "add-tun",
+		env:   EnvAddTun,
+		apply: func(f *flags, val string) error {
+			b, err := strconv.ParseBool(val)
+			if err != nil {
+				return err
+			}
+			f.addTUN = b
+			return nil
+		},
+	},
+	{
+		label: "init",
+		flag:  "init",
+		env:   EnvInnerInit,
+		apply: func(f *flags, val string) error {
+			_, err := dockerutil.ParseInitSystem(val)
+			if err != nil {
+				return err
+			}
+			f.innerInit = val
+			return nil
+		},
+	},
+}
+
+// explicitImageLabelFlags returns the set of flags that may be defaulted
+// from an image label but were explicitly provided via the command line or
+// the environment.
+func explicitImageLabelFlags(cmd *cobra.Command) map[string]bool {
+	explicit := make(map[string]bool)
+	for _, l := range imageLabels {
+		if cmd.Flags().Changed(l.flag) {
+			explicit[l.flag] = true
+			continue
+		}
+		if v, ok := os.LookupEnv(l.env); ok && v != "" {
+			explicit[l.flag] = true
+		}
+	}
+	return explicit
+}
+
+// appliedImageLabel is a label whose value was used in place of a flag.
+type appliedImageLabel struct {
+	Label string
+	Value string
+}
+
+// applyImageLabels sets any flags that were not explicitly provided to the
+// values of the corresponding labels on the inner image. It returns the
+// labels that were applied, sorted by name.
+func applyImageLabels(f *flags, labels map[string]string) ([]appliedImageLabel, error) {
+	var applied []appliedImageLabel
+	for _, l := range imageLabels {
+		name := ImageLabelPrefix + l.label
+		val, ok := labels[name]
+		if !ok {
+			continue
+		}
+		if f.explicit[l.flag] {
+			continue
+		}
+
+		err := l.apply(f, val)
+		if err != nil {
+			return nil, xerrors.Errorf("invalid value %q for image label %q: %w", val, name, err)
+		}
+		applied = append(applied, appliedImageLabel{Label: name, Value: val})
+	}
+
+	sort.Slice(applied, func(i, j int) bool {
+		return applied[i].Label < applied[j].Label
+	})
+
+	return applied, nil
+}
@@ -0,0 +1,452 @@
+package cli
+
+import (
+	"context"
+	"encoding/csv"
+	"os"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/docker/docker/api/types/mount"
+	"github.com/docker/go-units"
+	"github.com/spf13/afero"
+	"golang.org/x/xerrors"
+
+	"github.com/coder/envbox/xunix"
+)
+
+// mountSpec is a mount of the inner container given in the form of
+// 'docker run --mount' (e.g. type=tmpfs,target=/tmp,tmpfs-size=1g).
+type mountSpec struct {
+	mount.Mount
+	// CreateSource creates the source of a bind mount if it's missing.
+	CreateSource bool
+	// Ownership controls how the source of a bind mount is ID shifted.
+	Ownership mountOwnership
+}
+
+// ownerMode determines who the source of a bind mount is chowned to.
+type ownerMode string
+
+const (
+	// ownerAuto chowns home directories (/root and /home/*) to the image
+	// user and everything else to root.
+	ownerAuto ownerMode = "auto"
+	ownerUser ownerMode = "user"
+	ownerRoot ownerMode = "root"
+	// ownerID chowns to an explicit UID and GID of the inner container.
+	ownerID ownerMode = "id"
+	// ownerNone leaves ownership untouched.
+	ownerNone ownerMode = "none"
+)
+
+// mountOwnership controls how the source of a bind mount is prepared for
+// the inner container's user namespace.
+type mountOwnership struct {
+	Owner ownerMode
+	// UID and GID are the unshifted IDs used by ownerID.
+	UID int
+	GID int
+	// Recursive chowns everything below the source as well.
+	Recursive bool
+	// NoChmod skips setting the mode of the source to 02755.
+	NoChmod bool
+}
+
+// parseOwner parses the value of the 'owner' mount field. The UID and GID
+// are only set for ownerID.
+func parseOwner(val string) (ownerMode, int, int, error) {
+	switch o := ownerMode(strings.ToLower(val)); o {
+	case ownerAuto, ownerUser, ownerRoot, ownerNone:
+		return o, 0, 0, nil
+	}
+
+	uidStr, gidStr, ok := strings.Cut(val, ":")
+	if !ok {
+		return "", 0, 0, xerrors.Errorf("invalid owner %q, must be one of 'auto', 'user', 'root', 'none' or '<uid>:<gid>'", val)
+	}
+	uid, err := parseInnerID(uidStr)
+	if err != nil {
+		return "", 0, 0, xerrors.Errorf("invalid owner uid %q: %w", uidStr, err)
+	}
+	gid, err := parseInnerID(gidStr)
+	if err != nil {
+		return "", 0, 0, xerrors.Errorf("invalid owner gid %q: %w", gidStr, err)
+	}
+	return ownerID, uid, gid, nil
+}
+
+// parseInnerID parses an ID of the inner container. It must fit in the
+// range mapped by its user namespace.
+func parseInnerID(s string) (int, error) {
+	id, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, xerrors.New("must be a number")
+	}
+	if id < 0 || id >= userNamespaceSize {
+		return 0, xerrors.Errorf("must be between 0 and %d", userNamespaceSize-1)
+	}
+	return id, nil
+}
+
+// ids returns the unshifted UID and GID the source of m is chowned to given
+// the UID and GID of the image user. It returns false if ownership should
+// be left untouched.
+func (o mountOwnership) ids(source string, uid, gid int) (int, int, bool) {
+	switch o.Owner {
+	case ownerNone:
+		return 0, 0, false
+	case ownerUser:
+		return uid, gid, true
+	case ownerRoot:
+		return 0, 0, true
+	case ownerID:
+		return o.UID, o.GID, true
+	default:
+		// We want to ensure that home directories are ID shifted to the
+		// namespaced UID of the user in the inner container otherwise
+		// they won't be able to write files. Anything else we assume
+		// should be owned by root.
+		if isHomeDir(source) {
+			return uid, gid, true
+		}
+		return 0, 0, true
+	}
+}
+
+// bindOnlyFields are the fields without a type prefix that may only be
+// given for bind mounts.
+var bindOnlyFields = map[string]bool{
+	"owner":           true,
+	"owner-recursive": true,
+	"chmod":           true,
+}
+
+// tmpfsFlags are the flags that may be passed to a tmpfs mount.
+var tmpfsFlags = map[string]bool{
+	"exec":   true,
+	"noexec": true,
+	"suid":   true,
+	"nosuid": true,
+	"dev":    true,
+	"nodev":  true,
+}
+
+// parseMountSpec parses a mount in the form of a comma separated list of
+// '<key>[=<value>]' fields. Fields may be quoted so that values can contain
+// commas.
+//
+// Supported fields:
+//   - type: 'bind' (default), 'tmpfs' or 'volume'
+//   - source, src: the host path of a bind mount or the name of a volume
+//   - target, destination, dst: the path in the inner container
+//   - readonly, ro
+//   - bind-propagation: one of 'private', 'rprivate', 'shared', 'rshared',
+//     'slave' or 'rslave'
+//   - bind-nonrecursive
+//   - bind-create-src: create the source directory if it's missing
+//   - owner: who the source of a bind mount is chowned to, one of 'auto'
+//     (default), 'user', 'root', 'none' or '<uid>:<gid>'
+//   - owner-recursive: chown everything below the source as well
+//   - chmod: set the mode of the source to 02755 (default true)
+//   - volume-nocopy, volume-subpath
+//   - tmpfs-size, tmpfs-mode
+//   - exec, noexec, suid, nosuid, dev, nodev: tmpfs mount flags
+func parseMountSpec(spec string) (mountSpec, error) {
+	r := csv.NewReader(strings.NewReader(spec))
+	fields, err := r.Read()
+	if err != nil {
+		return mountSpec{}, xerrors.Errorf("malformed mount %q: %w", spec, err)
+	}
+
+	var (
+		m = mountSpec{
+			Mount:     mount.Mount{Type: mount.TypeBind},
+			Ownership: mountOwnership{Owner: ownerAuto},
+		}
+		bindOpt = &mount.BindOptions{}
+		volOpt  = &mount.VolumeOptions{}
+		tmpOpt  = &mount.TmpfsOptions{}
+		// prefixed records which type specific fields were given so
+		// they can be checked against the type.
+		prefixed []string
+	)
+	for _, field := range fields {
+		key, val, hasVal := strings.Cut(strings.TrimSpace(field), "=")
+		key = strings.ToLower(key)
+
+		if tmpfsFlags[key] {
+			if hasVal {
+				return mountSpec{}, xerrors.Errorf("mount flag %q does not take a value", key)
+			}
+			tmpOpt.Options = append(tmpOpt.Options, []string{key})
+			prefixed = append(prefixed, key)
+			continue
+		}
+
+		switch key {
+		case "readonly", "ro", "bind-nonrecursive", "bind-create-src", "volume-nocopy", "owner-recursive", "chmod":
+			b := true
+			if hasVal {
+				b, err = strconv.ParseBool(val)
+				if err != nil {
+					return mountSpec{}, xerrors.Errorf("invalid value %q for %q", val, key)
+				}
+			}
+			switch key {
+			case "readonly", "ro":
+				m.ReadOnly = b
+			case "bind-nonrecursive":
+				bindOpt.NonRecursive = b
+			case "bind-create-src":
+				m.CreateSource = b
+			case "volume-nocopy":
+				volOpt.NoCopy = b
+			case "owner-recursive":
+				m.Ownership.Recursive = b
+			case "chmod":
+				m.Ownership.NoChmod = !b
+			}
+			if key != "readonly" && key != "ro" {
+				prefixed = append(prefixed, key)
+			}
+			continue
+		}
+
+		if !hasVal {
+			return mountSpec{}, xerrors.Errorf("mount field %q requires a value", key)
+		}
+		switch key {
+		case "type":
+			m.Type = mount.Type(val)
+		case "source", "src":
+			m.Source = val
+		case "target", "destination", "dst":
+			m.Target = val
+		case "owner":
+			m.Ownership.Owner, m.Ownership.UID, m.Ownership.GID, err = parseOwner(val)
+			if err != nil {
+				return mountSpec{}, err
+			}
+			prefixed = append(prefixed, key)
+		case "bind-propagation":
+			bindOpt.Propagation = mount.Propagation(val)
+			if !slices.Contains(mount.Propagations, bindOpt.Propagation) {
+				return mountSpec{}, xerrors.Errorf("invalid bind-propagation %q, must be one of %v", val, mount.Propagations)
+			}
+			prefixed = append(prefixed, key)
+		case "volume-subpath":
+			volOpt.Subpath = val
+			prefixed = append(prefixed, key)
+		case "tmpfs-size":
+			size, err := units.RAMInBytes(val)
+			if err != nil {
+				return mountSpec{}, xerrors.Errorf("invalid tmpfs-size %q: %w", val, err)
+			}
+			if size <= 0 {
+				return mountSpec{}, xerrors.Errorf("tmpfs-size %q must be positive", val)
+			}
+			tmpOpt.SizeBytes = size
+			prefixed = append(prefixed, key)
+		case "tmpfs-mode":
+			mode, err := strconv.ParseUint(val, 8, 32)
+			if err != nil {
+				return mountSpec{}, xerrors.Errorf("invalid tmpfs-mode %q: must be octal", val)
+			}
+			tmpOpt.Mode = os.FileMode(mode)
+			prefixed = append(prefixed, key)
+		default:
+			return mountSpec{}, xerrors.Errorf("unknown mount field %q", key)
+		}
+	}
+
+	err = validateMountSpec(&m, prefixed)
+	if err != nil {
+		return mountSpec{}, xerrors.Errorf("invalid mount %q: %w", spec, err)
+	}
+
+	switch m.Type {
+	case mount.TypeBind:
+		if *bindOpt != (mount.BindOptions{}) {
+			m.BindOptions = bindOpt
+		}
+	case mount.TypeVolume:
+		if volOpt.NoCopy || volOpt.Subpath != "" {
+			m.VolumeOptions = volOpt
+		}
+	case mount.TypeTmpfs:
+		if tmpOpt.SizeBytes != 0 || tmpOpt.Mode != 0 || len(tmpOpt.Options) > 0 {
+			m.TmpfsOptions = tmpOpt
+		}
+	}
+	return m, nil
+}
+
+func validateMountSpec(m *mountSpec, prefixed []string) error {
+	if m.Target == "" {
+		return xerrors.New("target is required")
+	}
+	if !path.IsAbs(m.Target) {
+		return xerrors.Errorf("target %q must be an absolute path", m.Target)
+	}
+	m.Target = path.Clean(m.Target)
+	if m.Target == "/" {
+		return xerrors.New("target must not be /")
+	}
+
+	var allowed string
+	switch m.Type {
+	case mount.TypeBind:
+		allowed = "bind-"
+		if m.Source == "" {
+			return xerrors.New("source is required for bind mounts")
+		}
+		if !path.IsAbs(m.Source) {
+			return xerrors.Errorf("source %q must be an absolute path", m.Source)
+		}
+		m.Source = path.Clean(m.Source)
+	case mount.TypeVolume:
+		allowed = "volume-"
+		if strings.Contains(m.Source, "/") {
+			return xerrors.Errorf("volume name %q must not be a path", m.Source)
+		}
+	case mount.TypeTmpfs:
+		allowed = "tmpfs-"
+		if m.Source != "" {
+			return xerrors.New("source is not supported for tmpfs mounts")
+		}
+	default:
+		return xerrors.Errorf("unknown type %q, must be one of %q, %q or %q", m.Type, mount.TypeBind, mount.TypeTmpfs, mount.TypeVolume)
+	}
+
+	for _, key := range prefixed {
+		if tmpfsFlags[key] {
+			if m.Type != mount.TypeTmpfs {
+				return xerrors.Errorf("%q is only supported for tmpfs mounts", key)
+			}
+			continue
+		}
+		if bindOnlyFields[key] {
+			if m.Type != mount.TypeBind {
+				return xerrors.Errorf("%q is only supported for bind mounts", key)
+			}
+			continue
+		}
+		if !strings.HasPrefix(key, allowed) {
+			return xerrors.Errorf("%q is not supported for %s mounts", key, m.Type)
+		}
+	}
+	return nil
+}
+
+// parseMountSpecs parses every spec and ensures that no two mounts of the
+// inner container share a target, including the bind mounts in binds.
+func parseMountSpecs(specs []string, binds []xunix.Mount) ([]mountSpec, error) {
+	targets := make(map[string]bool, len(specs)+len(binds))
+	for _, b := range binds {
+		targets[path.Clean(b.Mountpoint)] = true
+	}
+
+	mounts := make([]mountSpec, 0, len(specs))
+	for _, spec := range specs {
+		m, err := parseMountSpec(spec)
+		if err != nil {
+			return nil, err
+		}
+		if targets[m.Target] {
+			return nil, xerrors.Errorf("duplicate mount target %q", m.Target)
+		}
+		targets[m.Target] = true
+		mounts = append(mounts, m)
+	}
+	return mounts, nil
+}
+
+// prepareMountSources ensures the sources of bind mounts exist, creating
+// them if requested.
+func prepareMountSources(ctx context.Context, specs []mountSpec) error {
+	fs := xunix.GetFS(ctx)
+	for _, m := range specs {
+		if m.Type != mount.TypeBind {
+			continue
+		}
+
+		_, err := fs.Stat(m.Source)
+		if err == nil {
+			continue
+		}
+		if !xerrors.Is(err, os.ErrNotExist) {
+			return xerrors.Errorf("stat bind source %q: %w", m.Source, err)
+		}
+		if !m.CreateSource {
+			return xerrors.Errorf("bind source %q does not exist, set bind-create-src to create it", m.Source)
+		}
+
+		err = fs.MkdirAll(m.Source, 0o755)
+		if err != nil {
+			return xerrors.Errorf("create bind source %q: %w", m.Source, err)
+		}
+	}
+	return nil
+}
+
+// shiftMount is a mount whose source is ID shifted for the inner container.
+type shiftMount struct {
+	xunix.Mount
+	mountOwnership
+}
+
+// shiftMounts returns the mounts whose sources are ID shifted. The legacy
+// binds always use the default ownership.
+func shiftMounts(binds []xunix.Mount, specs []mountSpec) []shiftMount {
+	mounts := make([]shiftMount, 0, len(binds)+len(specs))
+	for _, m := range binds {
+		mounts = append(mounts, shiftMount{
+			Mount:          m,
+			mountOwnership: mountOwnership{Owner: ownerAuto},
+		})
+	}
+	for _, m := range specs {
+		if m.Type != mount.TypeBind {
+			continue
+		}
+		mounts = append(mounts, shiftMount{
+			Mount: xunix.Mount{
+				Source:     m.Source,
+				Mountpoint: m.Target,
+				ReadOnly:   m.ReadOnly,
+			},
+			mountOwnership: m.Ownership,
+		})
+	}
+	return mounts
+}
+
+// chownTree chowns root and everything below it. Symbolic links are
+// skipped since chown follows them and they may point outside of root.
+func chownTree(fs xunix.FS, root string, uid, gid int) error {
+	return afero.Walk(fs, root, func(fpath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return nil
+		}
+		err = fs.Chown(fpath, uid, gid)
+		if err != nil {
+			return xerrors.Errorf("chown %q: %w", fpath, err)
+		}
+		return nil
+	})
+}
+
+// dockerMounts returns the Docker API mounts of specs.
+func dockerMounts(specs []mountSpec) []mount.Mount {
+	mounts := make([]mount.Mount, 0, len(specs))
+	for _, m := range specs {
+		mounts = append(mounts, m.Mount)
+	}
+	return mounts
+}
@@ -0,0 +1,169 @@
+package cli
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/spf13/afero"
+	"golang.org/x/xerrors"
+
+	"cdr.dev/slog/v3"
+	"github.com/coder/envbox/buildlog"
+	"github.com/coder/envbox/xunix"
+	"github.com/coder/envbox/xunix/idshift"
+)
+
+// ownershipMarkerFile is written to the source of a mount to record the
+// IDs it was last chowned to.
+const ownershipMarkerFile = ".envbox-ownership"
+
+// ownershipRepairProgressInterval is the number of files between progress
+// updates in the build log.
+const ownershipRepairProgressInterval = 10000
+
+type ownerIDs struct {
+	UID int `json:"uid"`
+	GID int `json:"gid"`
+}
+
+type ownershipMarker struct {
+	ownerIDs
+	// Pending is set while a repair to new IDs hasn't completed.
+	Pending *ownerIDs `json:"pending,omitempty"`
+}
+
+// repairOwnership re-chowns the files below source that are still owned by
+// the shifted IDs recorded in its marker file to uid and gid. This happens
+// when the user of the inner image changes, e.g. a template switches
+// images, since only the top-level directory of a mount is chowned
+// otherwise.
+//
+// The repair stops after timeout and is resumed on the next start. Failing
+// to repair is not fatal since the workspace is usable albeit with files
+// the user can't write.
+func repairOwnership(ctx context.Context, log slog.Logger, blog buildlog.Logger, fs xunix.FS, source string, uid, gid int, timeout time.Duration) error {
+	fi, err := fs.Stat(source)
+	if err != nil {
+		return xerrors.Errorf("stat %q: %w", source, err)
+	}
+	if !fi.IsDir() {
+		return nil
+	}
+
+	var (
+		markerPath = filepath.Join(source, ownershipMarkerFile)
+		want       = ownerIDs{UID: uid, GID: gid}
+	)
+	marker, ok, err := readOwnershipMarker(fs, markerPath)
+	if err != nil {
+		return xerrors.Errorf("read ownership marker: %w", err)
+	}
+	if !ok {
+		// We don't know who owned the files before so there's nothing to
+		// repair.
+		return writeOwnershipMarker(fs, markerPath, ownershipMarker{ownerIDs: want})
+	}
+
+	var idMap idshift.Map
+	for _, from := range []*ownerIDs{&marker.ownerIDs, marker.Pending} {
+		if from == nil {
+			continue
+		}
+		idMap.UIDs = addIDRange(idMap.UIDs, from.UID, want.UID)
+		idMap.GIDs = addIDRange(idMap.GIDs, from.GID, want.GID)
+	}
+	if len(idMap.UIDs) == 0 && len(idMap.GIDs) == 0 {
+		if marker.Pending != nil {
+			return writeOwnershipMarker(fs, markerPath, ownershipMarker{ownerIDs: want})
+		}
+		return nil
+	}
+
+	if marker.Pending != nil {
+		blog.Infof("Resuming ownership repair of %q from %d:%d to %d:%d", source, marker.UID, marker.GID, uid, gid)
+	} else {
+		blog.Infof("Owner of %q changed from %d:%d to %d:%d, repairing ownership", source, marker.UID, marker.GID, uid, gid)
+	}
+
+	// Record the repair before starting it so that it's resumed if envbox
+	// is killed midway.
+	marker.Pending = &want
+	err = writeOwnershipMarker(fs, markerPath, marker)
+	if err != nil {
+		return err
+	}
+
+	shiftCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	progress, err := idshift.Shift(shiftCtx, idshift.Options{
+		FS:   fs,
+		Root: source,
+		Map:  idMap,
+		OnProgress: func(p idshift.Progress) {
+			blog.Infof("Repairing ownership of %q: checked %d files, changed %d", source, p.Visited, p.Changed)
+		},
+		ProgressInterval: ownershipRepairProgressInterval,
+	})
+	log.Debug(ctx, "repaired ownership",
+		slog.F("source", source),
+		slog.F("uid_map", idMap.UIDs),
+		slog.F("gid_map", idMap.GIDs),
+		slog.F("visited", progress.Visited),
+		slog.F("changed", progress.Changed),
+		slog.Error(err),
+	)
+	if xerrors.Is(err, context.DeadlineExceeded) && ctx.Err() == nil {
+		blog.Infof("Ownership repair of %q timed out after %s (changed %d files), it will resume on the next start", source, timeout, progress.Changed)
+		return nil
+	}
+	if err != nil {
+		blog.Errorf("Failed to repair ownership of %q, it will be retried on the next start: %v", source, err)
+		return nil
+	}
+
+	blog.Infof("Repaired ownership of %q (changed %d files)", source, progress.Changed)
+	return writeOwnershipMarker(fs, markerPath, ownershipMarker{ownerIDs: want})
+}
+
+// addIDRange adds a mapping of the single ID from to to unless it's a no-op
+// or already mapped.
+func addIDRange(ranges []idshift.Range, from, to int) []idshift.Range {
+	if from == to || slices.ContainsFunc(ranges, func(r idshift.Range) bool { return r.From == from }) {
+		return ranges
+	}
+	return append(ranges, idshift.Range{From: from, To: to, Size: 1})
+}
+
+func readOwnershipMarker(fs xunix.FS, fpath string) (ownershipMarker, bool, error) {
+	raw, err := afero.ReadFile(fs, fpath)
+	if xerrors.Is(err, os.ErrNotExist) {
+		return ownershipMarker{}, false, nil
+	}
+	if err != nil {
+		return ownershipMarker{}, false, xerrors.Errorf("read %q: %w", fpath, err)
+	}
+
+	var marker ownershipMarker
+	err = json.Unmarshal(raw, &marker)
+	if err != nil {
+		return ownershipMarker{}, false, xerrors.Errorf("unmarshal %q: %w", fpath, err)
+	}
+	return marker, true, nil
+}
+
+func writeOwnershipMarker(fs xunix.FS, fpath string, marker ownershipMarker) error {
+	raw, err := json.Marshal(marker)
+	if err != nil {
+		return xerrors.Errorf("marshal ownership marker: %w", err)
+	}
+	err = afero.WriteFile(fs, fpath, raw, 0o644)
+	if err != nil {
+		return xerrors.Errorf("write %q: %w", fpath, err)
+	}
+	return nil
+}
@@ -0,0 +1,131 @@
+package cli
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/spf13/cobra"
+	"golang.org/x/xerrors"
+
+	"cdr.dev/slog/v3"
+	"cdr.dev/slog/v3/sloggers/slogjson"
+	"github.com/coder/envbox/cli/cliflag"
+	"github.com/coder/envbox/dockerutil"
+	"github.com/coder/envbox/xhttp"
+)
+
+var (
+	EnvPrepullImages   = "CODER_PREPULL_IMAGES"
+	EnvPrepullInterval = "CODER_PREPULL_INTERVAL"
+)
+
+type prepullFlags struct {
+	images          []string
+	cacheDir        string
+	imagePullSecret string
+	dockerConfig    string
+	extraCertsPath  string
+	interval        time.Duration
+}
+
+// prepullCmd populates a node-level image cache that envbox containers can
+// load their inner image from instead of pulling it from the registry. It is
+// intended to be run either as an init container (one-shot) or as a DaemonSet
+// (with --interval) writing to a hostPath that is mounted read-only into
+// envbox pods.
+func prepullCmd() *cobra.Command {
+	var flags prepullFlags
+
+	cmd := &cobra.Command{
+		Use:   "prepull",
+		Short: "Populate a shared image cache for envbox containers",
+		RunE: func(cmd *cobra.Command, _ []string) error {
+			var (
+				ctx = cmd.Context()
+				log = slog.Make(slogjson.Sink(cmd.ErrOrStderr())).Leveled(slog.LevelDebug)
+			)
+
+			if len(flags.images) == 0 {
+				return xerrors.Errorf("at least one image must be specified")
+			}
+			if flags.cacheDir == "" {
+				return xerrors.Errorf("%q must be specified", EnvImageCacheDir)
+			}
+
+			httpClient, err := xhttp.Client(log, flags.extraCertsPath)
+			if err != nil {
+				return xerrors.Errorf("http client: %w", err)
+			}
+
+			err = prepullImages(ctx, log, httpClient.Transport, flags)
+			if err != nil {
+				return err
+			}
+
+			if flags.interval <= 0 {
+				return nil
+			}
+
+			ticker := time.NewTicker(flags.interval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ctx.Done():
+					return nil
+				case <-ticker.C:
+				}
+
+				// When running continuously a failure shouldn't take down
+				// the cache, we'll just try again on the next tick.
+				err = prepullImages(ctx, log, httpClient.Transport, flags)
+				if err != nil {
+					log.Error(ctx, "prepull images", slog.Error(err))
+				}
+			}
+		},
+	}
+
+	cliflag.StringArrayVarP(cmd.Flags(), &flags.images, "image", "", EnvPrepullImages, nil, "The images to add to the cache. May be specified multiple times.")
+	cliflag.StringVarP(cmd.Flags(), &flags.cacheDir, "cache-dir", "", EnvImageCacheDir, "", "The directory of the image cache. It is written as an OCI image layout. Required.")
+	cliflag.StringVarP(cmd.Flags(), &flags.imagePullSecret, "image-secret", "", EnvBoxPullImageSecretEnvVar, "", "The secret to use to pull the images.")
+	cliflag.StringVarP(cmd.Flags(), &flags.dockerConfig, "docker-config", "", EnvDockerConfig, "/root/.docker/config.json", "The path to the docker config to consult when pulling an image.")
+	cliflag.StringVarP(cmd.Flags(), &flags.extraCertsPath, "extra-certs-path", "", EnvExtraCertsPath, "", "The path to a directory or file containing extra CA certificates.")
+	cliflag.DurationVarP(cmd.Flags(), &flags.interval, "interval", "", EnvPrepullInterval, 0, "If set, refresh the cache at this interval instead of exiting. Useful when running as a DaemonSet.")
+
+	return cmd
+}
+
+func prepullImages(ctx context.Context, log slog.Logger, transport http.RoundTripper, flags prepullFlags) error {
+	for _, image := range flags.images {
+		ref, err := name.ParseReference(image)
+		if err != nil {
+			return xerrors.Errorf("parse ref %q: %w", image, err)
+		}
+
+		auth, err := imageAuth(ctx, log, ref, flags.imagePullSecret, flags.dockerConfig)
+		if err != nil {
+			return xerrors.Errorf("image auth: %w", err)
+		}
+
+		log.Info(ctx, "caching image", slog.F("image", image), slog.F("cache_dir", flags.cacheDir))
+		start := time.Now()
+		digest, err := dockerutil.CacheImage(ctx, dockerutil.CacheImageConfig{
+			Dir:       flags.cacheDir,
+			Image:     image,
+			Auth:      auth,
+			Transport: transport,
+		})
+		if err != nil {
+			return xerrors.Errorf("cache image %q: %w", image, err)
+		}
+		log.Info(ctx, "cached image",
+			slog.F("image", image),
+			slog.F("digest", digest.String()),
+			slog.F("elapsed", time.Since(start)),
+		)
+	}
+
+	return nil
+}
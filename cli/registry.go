@@ -0,0 +1,325 @@
+package cli
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/cpuguy83/dockercfg"
+	"github.com/spf13/afero"
+	"golang.org/x/xerrors"
+
+	"cdr.dev/slog/v3"
+	"github.com/coder/envbox/buildlog"
+	"github.com/coder/envbox/dockerutil"
+	"github.com/coder/envbox/xunix"
+)
+
+// innerCertsDir is where the inner Docker daemon looks for registry
+// certificates.
+const innerCertsDir = "/etc/docker/certs.d"
+
+// registryAllowlist returns the registry host patterns credentials may be
+// passed to the inner container for. It defaults to the inner image's
+// registry.
+func registryAllowlist(entries []string, imageRegistry string) ([]string, error) {
+	var patterns []string
+	for _, entry := range entries {
+		for _, p := range strings.Split(entry, ",") {
+			p = strings.TrimSpace(p)
+			if p == "" {
+				continue
+			}
+			if _, err := path.Match(p, ""); err != nil {
+				return nil, xerrors.Errorf("invalid registry pattern %q: %w", p, err)
+			}
+			patterns = append(patterns, dockerutil.RegistryHost(p))
+		}
+	}
+	if len(patterns) == 0 {
+		patterns = []string{dockerutil.RegistryHost(imageRegistry)}
+	}
+	return patterns, nil
+}
+
+// registryAllowed returns whether host matches one of patterns.
+func registryAllowed(patterns []string, host string) bool {
+	return slices.ContainsFunc(patterns, func(p string) bool {
+		ok, _ := path.Match(p, host)
+		return ok
+	})
+}
+
+// passRegistryCredentials writes the credentials for the registries
+// allowed by patterns into the user's docker config file in the inner
+// container and the extra certificates into the inner Docker daemon's
+// certificate directories, so that the user can pull from the same
+// registries as envbox.
+func passRegistryCredentials(ctx context.Context, log slog.Logger, blog buildlog.Logger, client dockerutil.Client, containerID string, flags flags, patterns []string, imageRegistry string, imageAuth dockerutil.AuthConfig, homeDir string, uid, gid int) error {
+	auths, err := innerRegistryAuths(ctx, patterns, imageRegistry, imageAuth, flags.imagePullSecret, flags.dockerConfig)
+	if err != nil {
+		return xerrors.Errorf("registry credentials: %w", err)
+	}
+
+	if len(auths) > 0 {
+		err = writeInnerDockerConfig(ctx, log, client, containerID, auths, homeDir, uid, gid)
+		if err != nil {
+			return xerrors.Errorf("write docker config: %w", err)
+		}
+		hosts := innerRegistryHosts(nil, auths)
+		log.Debug(ctx, "passed registry credentials", slog.F("registries", hosts))
+		blog.Infof("Passed credentials for %s to the workspace", strings.Join(hosts, ", "))
+	} else {
+		blog.Info("No registry credentials to pass to the workspace")
+	}
+
+	if flags.extraCertsPath == "" {
+		return nil
+	}
+	written, err := writeInnerRegistryCerts(ctx, client, containerID, flags.extraCertsPath, innerRegistryHosts(patterns, auths))
+	if err != nil {
+		return xerrors.Errorf("write registry certs: %w", err)
+	}
+	if len(written) > 0 {
+		blog.Infof("Copied certificates from %q to %s for %s", flags.extraCertsPath, innerCertsDir, strings.Join(written, ", "))
+	}
+	return nil
+}
+
+// innerRegistryAuths returns the credentials for the registries allowed by
+// patterns, keyed like the auths of a docker config file. They come from
+// the image pull secret, the docker config file, which takes precedence
+// like it does when pulling the image, and the credentials resolved for the
+// inner image. Credential helpers can't be passed through, only their
+// result for the inner image's registry.
+func innerRegistryAuths(ctx context.Context, patterns []string, imageRegistry string, imageAuth dockerutil.AuthConfig, imagePullSecret, dockerConfig string) (map[string]dockercfg.AuthConfig, error) {
+	auths := map[string]dockercfg.AuthConfig{}
+
+	if imagePullSecret != "" {
+		var cfg dockercfg.Config
+		err := json.Unmarshal([]byte(imagePullSecret), &cfg)
+		if err != nil {
+			return nil, xerrors.Errorf("parse image pull secret: %w", err)
+		}
+		addAllowedAuths(auths, patterns, cfg.AuthConfigs)
+	}
+
+	b, err := afero.ReadFile(xunix.GetFS(ctx), dockerConfig)
+	if err != nil && !xerrors.Is(err, os.ErrNotExist) {
+		return nil, xerrors.Errorf("read %q: %w", dockerConfig, err)
+	}
+	if err == nil {
+		var cfg dockercfg.Config
+		err = json.Unmarshal(b, &cfg)
+		if err != nil {
+			return nil, xerrors.Errorf("parse %q: %w", dockerConfig, err)
+		}
+		addAllowedAuths(auths, patterns, cfg.AuthConfigs)
+	}
+
+	host := dockerutil.RegistryHost(imageRegistry)
+	hasAuth := imageAuth.Username != "" || imageAuth.IdentityToken != "" || imageAuth.RegistryToken != ""
+	for key := range auths {
+		// Credentials from a config file are passed as they are.
+		if dockerutil.RegistryHost(key) == host {
+			hasAuth = false
+		}
+	}
+	if hasAuth && registryAllowed(patterns, host) {
+		auth := dockercfg.AuthConfig{
+			IdentityToken: imageAuth.IdentityToken,
+			RegistryToken: imageAuth.RegistryToken,
+		}
+		if imageAuth.Username != "" {
+			auth.Auth = base64.StdEncoding.EncodeToString([]byte(imageAuth.Username + ":" + imageAuth.Password))
+		}
+		auths[dockercfg.ResolveRegistryHost(host)] = auth
+	}
+
+	return auths, nil
+}
+
+func addAllowedAuths(auths map[string]dockercfg.AuthConfig, patterns []string, from map[string]dockercfg.AuthConfig) {
+	for key, auth := range from {
+		if registryAllowed(patterns, dockerutil.RegistryHost(key)) {
+			auths[key] = auth
+		}
+	}
+}
+
+// mergeDockerConfig adds auths to the docker config file existing, keeping
+// everything else in it. existing may be empty.
+func mergeDockerConfig(existing []byte, auths map[string]dockercfg.AuthConfig) ([]byte, error) {
+	cfg := map[string]json.RawMessage{}
+	if len(existing) > 0 {
+		err := json.Unmarshal(existing, &cfg)
+		if err != nil {
+			return nil, xerrors.Errorf("parse existing config: %w", err)
+		}
+	}
+
+	merged := map[string]json.RawMessage{}
+	if raw, ok := cfg["auths"]; ok {
+		err := json.Unmarshal(raw, &merged)
+		if err != nil {
+			return nil, xerrors.Errorf("parse existing auths: %w", err)
+		}
+	}
+	for key, auth := range auths {
+		raw, err := json.Marshal(auth)
+		if err != nil {
+			return nil, xerrors.Errorf("marshal auth: %w", err)
+		}
+		merged[key] = raw
+	}
+
+	raw, err := json.Marshal(merged)
+	if err != nil {
+		return nil, xerrors.Errorf("marshal auths: %w", err)
+	}
+	cfg["auths"] = raw
+
+	b, err := json.MarshalIndent(cfg, "", "\t")
+	if err != nil {
+		return nil, xerrors.Errorf("marshal config: %w", err)
+	}
+	return append(b, '\n'), nil
+}
+
+// writeInnerDockerConfig writes auths to the user's docker config file in
+// the inner container, merging them into the file if it exists. It is only
+// readable by the user. uid and gid are the IDs of the image user.
+func writeInnerDockerConfig(ctx context.Context, log slog.Logger, client dockerutil.Client, containerID string, auths map[string]dockercfg.AuthConfig, homeDir string, uid, gid int) error {
+	var (
+		dir   = path.Join(homeDir, ".docker")
+		fpath = path.Join(dir, "config.json")
+	)
+
+	existing, err := dockerutil.ReadContainerFile(ctx, client, containerID, fpath)
+	if err != nil && !xerrors.Is(err, os.ErrNotExist) {
+		return xerrors.Errorf("read existing config: %w", err)
+	}
+	if strings.Contains(string(existing), `"credsStore"`) {
+		log.Info(ctx, "inner docker config uses a credential store, passed through credentials may be ignored", slog.F("path", fpath))
+	}
+
+	content, err := mergeDockerConfig(existing, auths)
+	if err != nil {
+		return err
+	}
+
+	var files []dockerutil.ContainerFile
+	exists, err := dockerutil.PathExists(ctx, client, containerID, dir)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		files = append(files, dockerutil.ContainerFile{
+			Path: dir,
+			Mode: 0o700,
+			UID:  uid,
+			GID:  gid,
+			Dir:  true,
+		})
+	}
+	files = append(files, dockerutil.ContainerFile{
+		Path:    fpath,
+		Content: content,
+		Mode:    0o600,
+		UID:     uid,
+		GID:     gid,
+	})
+	return dockerutil.CopyFilesToContainer(ctx, client, containerID, files)
+}
+
+// writeInnerRegistryCerts copies the certificates in certsPath, a file or
+// a directory, into the inner Docker daemon's certificate directory of
+// each registry. Registries that already have a directory, e.g. one baked
+// into the image, are left alone like WriteCertsForRegistry does for the
+// outer daemon. It returns the registries certificates were written for.
+func writeInnerRegistryCerts(ctx context.Context, client dockerutil.Client, containerID, certsPath string, registries []string) ([]string, error) {
+	fs := xunix.GetFS(ctx)
+
+	fi, err := fs.Stat(certsPath)
+	if err != nil {
+		return nil, xerrors.Errorf("stat %q: %w", certsPath, err)
+	}
+	certs := map[string][]byte{}
+	if fi.IsDir() {
+		entries, err := afero.ReadDir(fs, certsPath)
+		if err != nil {
+			return nil, xerrors.Errorf("read dir %q: %w", certsPath, err)
+		}
+		for _, e := range entries {
+			if e.IsDir() {
+				continue
+			}
+			b, err := afero.ReadFile(fs, filepath.Join(certsPath, e.Name()))
+			if err != nil {
+				return nil, xerrors.Errorf("read %q: %w", e.Name(), err)
+			}
+			certs[e.Name()] = b
+		}
+	} else {
+		b, err := afero.ReadFile(fs, certsPath)
+		if err != nil {
+			return nil, xerrors.Errorf("read %q: %w", certsPath, err)
+		}
+		certs["ca.crt"] = b
+	}
+
+	var (
+		files   []dockerutil.ContainerFile
+		written []string
+	)
+	for _, registry := range registries {
+		dir := path.Join(innerCertsDir, registry)
+		exists, err := dockerutil.PathExists(ctx, client, containerID, dir)
+		if err != nil {
+			return nil, err
+		}
+		if exists {
+			continue
+		}
+
+		files = append(files, dockerutil.ContainerFile{
+			Path: dir,
+			Mode: 0o755,
+			Dir:  true,
+		})
+		for name, content := range certs {
+			files = append(files, dockerutil.ContainerFile{
+				Path:    path.Join(dir, name),
+				Content: content,
+				Mode:    0o644,
+			})
+		}
+		written = append(written, registry)
+	}
+	if len(files) == 0 {
+		return nil, nil
+	}
+	return written, dockerutil.CopyFilesToContainer(ctx, client, containerID, files)
+}
+
+// innerRegistryHosts returns the hosts of the registries given by auths and
+// the patterns without wildcards, sorted and without duplicates.
+func innerRegistryHosts(patterns []string, auths map[string]dockercfg.AuthConfig) []string {
+	var hosts []string
+	for key := range auths {
+		hosts = append(hosts, dockerutil.RegistryHost(key))
+	}
+	for _, p := range patterns {
+		if !strings.ContainsAny(p, "*?[") {
+			hosts = append(hosts, p)
+		}
+	}
+	sort.Strings(hosts)
+	return slices.Compact(hosts)
+}
@@ -0,0 +1,190 @@
+package cli
+
+import (
+	"context"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/go-units"
+	"golang.org/x/xerrors"
+
+	"cdr.dev/slog/v3"
+
+	"github.com/coder/envbox/xunix"
+)
+
+// innerResources are the resource limits of the inner container beyond its
+// CPU and memory limits.
+type innerResources struct {
+	memorySwap        int64
+	memoryReservation int64
+	pidsLimit         int64
+	cpusetCPUs        string
+	blkioWeight       uint16
+	shmSize           int64
+	ulimits           []*container.Ulimit
+}
+
+// parseInnerResources validates the resource flags against the limits of
+// the outer container. Asking for more than the outer container has would
+// otherwise only surface as an opaque error from the daemon or, worse, be
+// silently clamped.
+func parseInnerResources(ctx context.Context, log slog.Logger, flags flags) (innerResources, error) {
+	limits, err := xunix.ReadCGroupLimits(ctx)
+	if err != nil {
+		log.Warn(ctx, "unable to read outer cgroup limits, not validating resource limits against them", slog.Error(err))
+		limits = xunix.CGroupLimits{PidsMax: -1, MemoryMax: -1}
+	}
+
+	var (
+		memory = int64(flags.memory)
+		res    = innerResources{
+			memorySwap:        int64(flags.memorySwap),
+			memoryReservation: int64(flags.memoryReservation),
+			pidsLimit:         int64(flags.pidsLimit),
+			cpusetCPUs:        flags.cpusetCPUs,
+			shmSize:           int64(flags.shmSize),
+		}
+	)
+
+	// The daemon rejects CPU quotas below 1ms.
+	if flags.cpus < 0 || (flags.cpus > 0 && flags.cpus < 10) {
+		return innerResources{}, xerrors.Errorf("cpus %s must be at least 10m", flags.cpus)
+	}
+
+	if res.pidsLimit < 0 {
+		return innerResources{}, xerrors.Errorf("pids limit %d must not be negative", res.pidsLimit)
+	}
+	if res.pidsLimit > 0 && limits.PidsMax > 0 && res.pidsLimit > limits.PidsMax {
+		return innerResources{}, xerrors.Errorf("pids limit %d exceeds the outer container's limit of %d", res.pidsLimit, limits.PidsMax)
+	}
+
+	if res.memorySwap != 0 {
+		if memory <= 0 {
+			return innerResources{}, xerrors.Errorf("memory swap requires a memory limit")
+		}
+		if res.memorySwap != -1 && res.memorySwap < memory {
+			return innerResources{}, xerrors.Errorf("memory swap %d must be at least the memory limit %d or -1 for unlimited swap", res.memorySwap, memory)
+		}
+	}
+
+	if res.memoryReservation < 0 {
+		return innerResources{}, xerrors.Errorf("memory reservation %d must not be negative", res.memoryReservation)
+	}
+	if res.memoryReservation > 0 {
+		if memory > 0 && res.memoryReservation > memory {
+			return innerResources{}, xerrors.Errorf("memory reservation %d exceeds the memory limit %d", res.memoryReservation, memory)
+		}
+		if limits.MemoryMax > 0 && res.memoryReservation > limits.MemoryMax {
+			return innerResources{}, xerrors.Errorf("memory reservation %d exceeds the outer container's memory limit of %d", res.memoryReservation, limits.MemoryMax)
+		}
+	}
+
+	if res.shmSize < 0 {
+		return innerResources{}, xerrors.Errorf("shm size %d must not be negative", res.shmSize)
+	}
+	if res.shmSize > 0 {
+		if memory > 0 && res.shmSize > memory {
+			return innerResources{}, xerrors.Errorf("shm size %d exceeds the memory limit %d", res.shmSize, memory)
+		}
+		if limits.MemoryMax > 0 && res.shmSize > limits.MemoryMax {
+			return innerResources{}, xerrors.Errorf("shm size %d exceeds the outer container's memory limit of %d", res.shmSize, limits.MemoryMax)
+		}
+	}
+
+	if res.cpusetCPUs != "" {
+		err = validateCPUSet(res.cpusetCPUs, limits.CPUSet)
+		if err != nil {
+			return innerResources{}, err
+		}
+	}
+
+	if flags.blkioWeight != 0 {
+		if flags.blkioWeight < 10 || flags.blkioWeight > 1000 {
+			return innerResources{}, xerrors.Errorf("blkio weight %d must be between 10 and 1000", flags.blkioWeight)
+		}
+		if !limits.IOWeight {
+			return innerResources{}, xerrors.Errorf("blkio weight requires the %s controller to be available to the outer container", ioController(limits.CGroup))
+		}
+		res.blkioWeight = uint16(flags.blkioWeight)
+	}
+
+	if len(flags.ulimits) > 0 {
+		res.ulimits, err = parseUlimits(flags.ulimits)
+		if err != nil {
+			return innerResources{}, err
+		}
+
+		rlimits, err := xunix.ReadRLimits(ctx)
+		if err != nil {
+			log.Warn(ctx, "unable to read own resource limits, not validating ulimits against them", slog.Error(err))
+		}
+		for _, ul := range res.ulimits {
+			outer, ok := rlimits[ul.Name]
+			if !ok || outer.Hard == -1 {
+				continue
+			}
+			if ul.Hard == -1 || ul.Hard > outer.Hard {
+				return innerResources{}, xerrors.Errorf("ulimit %s hard limit %d exceeds the outer container's hard limit of %d", ul.Name, ul.Hard, outer.Hard)
+			}
+		}
+	}
+
+	return res, nil
+}
+
+// validateCPUSet ensures every CPU in requested is in available. An empty
+// available set means the outer cpuset is unknown.
+func validateCPUSet(requested, available string) error {
+	cpus, err := xunix.ParseCPUSet(requested)
+	if err != nil {
+		return xerrors.Errorf("parse cpuset %q: %w", requested, err)
+	}
+	if len(cpus) == 0 {
+		return xerrors.Errorf("cpuset %q is empty", requested)
+	}
+	if available == "" {
+		return nil
+	}
+
+	outer, err := xunix.ParseCPUSet(available)
+	if err != nil {
+		return xerrors.Errorf("parse outer cpuset %q: %w", available, err)
+	}
+	allowed := make(map[int]bool, len(outer))
+	for _, cpu := range outer {
+		allowed[cpu] = true
+	}
+	for _, cpu := range cpus {
+		if !allowed[cpu] {
+			return xerrors.Errorf("cpu %d in cpuset %q is not available to the outer container (%s)", cpu, requested, available)
+		}
+	}
+	return nil
+}
+
+// parseUlimits parses ulimits in the form '<name>=<soft>[:<hard>]'.
+func parseUlimits(specs []string) ([]*container.Ulimit, error) {
+	var (
+		ulimits = make([]*container.Ulimit, 0, len(specs))
+		seen    = make(map[string]bool, len(specs))
+	)
+	for _, spec := range specs {
+		ul, err := units.ParseUlimit(spec)
+		if err != nil {
+			return nil, xerrors.Errorf("parse ulimit %q: %w", spec, err)
+		}
+		if seen[ul.Name] {
+			return nil, xerrors.Errorf("ulimit %q specified more than once", ul.Name)
+		}
+		seen[ul.Name] = true
+		ulimits = append(ulimits, ul)
+	}
+	return ulimits, nil
+}
+
+func ioController(c xunix.CGroup) string {
+	if c == xunix.CGroupV2 {
+		return "io"
+	}
+	return "blkio"
+}
@@ -15,6 +15,6 @@ func Root() *cobra.Command {
 		},
 	}
 
-	cmd.AddCommand(dockerCmd())
+	cmd.AddCommand(dockerCmd(), prepullCmd(), delegateCGroupsCmd(), shiftOwnershipCmd())
 	return cmd
 }
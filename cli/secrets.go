@@ -0,0 +1,215 @@
+package cli
+
+import (
+	"context"
+	"encoding/csv"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/docker/docker/api/types/mount"
+	"github.com/spf13/afero"
+	"golang.org/x/xerrors"
+
+	"github.com/coder/envbox/dockerutil"
+	"github.com/coder/envbox/xunix"
+)
+
+const (
+	// InnerSecretsDir is the tmpfs of the inner container secrets are
+	// written to.
+	InnerSecretsDir = "/run/coder/secrets"
+	// agentTokenSecret is the name of the secret holding the agent token.
+	agentTokenSecret = "agent-token"
+	// envAgentTokenFile is read by the agent instead of CODER_AGENT_TOKEN.
+	envAgentTokenFile = "CODER_AGENT_TOKEN_FILE"
+	// secretsTmpfsSize is the maximum size of all secrets.
+	secretsTmpfsSize = 16 << 20
+)
+
+// secretSpec is a secret written to a file in InnerSecretsDir.
+type secretSpec struct {
+	Name string
+	// Env or File is where the value is read from in the outer container.
+	Env  string
+	File string
+	// Owner is who the file is owned by, one of ownerUser, ownerRoot or
+	// ownerID. UID and GID are the IDs used by ownerID.
+	Owner ownerMode
+	UID   int
+	GID   int
+	Mode  os.FileMode
+}
+
+// parseSecretSpec parses a secret in the form of a comma separated list of
+// '<key>=<value>' fields. Fields may be quoted so that values can contain
+// commas.
+//
+// Supported fields:
+//   - name: the name of the file in InnerSecretsDir. Required.
+//   - env: the outer environment variable holding the value
+//   - file: the outer file holding the value
+//   - owner: who the file is owned by, one of 'user' (default), 'root' or
+//     '<uid>:<gid>'
+//   - mode: the octal mode of the file (default 0400)
+//
+// Exactly one of env or file must be given.
+func parseSecretSpec(spec string) (secretSpec, error) {
+	r := csv.NewReader(strings.NewReader(spec))
+	fields, err := r.Read()
+	if err != nil {
+		return secretSpec{}, xerrors.Errorf("malformed secret %q: %w", spec, err)
+	}
+
+	s := secretSpec{
+		Owner: ownerUser,
+		Mode:  0o400,
+	}
+	for _, field := range fields {
+		key, val, ok := strings.Cut(strings.TrimSpace(field), "=")
+		if !ok {
+			return secretSpec{}, xerrors.Errorf("secret field %q requires a value", key)
+		}
+		switch strings.ToLower(key) {
+		case "name":
+			s.Name = val
+		case "env":
+			s.Env = val
+		case "file":
+			s.File = val
+		case "owner":
+			s.Owner, s.UID, s.GID, err = parseOwner(val)
+			if err != nil {
+				return secretSpec{}, err
+			}
+			if s.Owner == ownerAuto || s.Owner == ownerNone {
+				return secretSpec{}, xerrors.Errorf("invalid owner %q, must be one of 'user', 'root' or '<uid>:<gid>'", val)
+			}
+		case "mode":
+			mode, err := strconv.ParseUint(val, 8, 32)
+			if err != nil || mode > 0o777 {
+				return secretSpec{}, xerrors.Errorf("invalid mode %q: must be octal permission bits", val)
+			}
+			s.Mode = os.FileMode(mode)
+		default:
+			return secretSpec{}, xerrors.Errorf("unknown secret field %q", key)
+		}
+	}
+
+	switch {
+	case s.Name == "" || s.Name == "." || s.Name == ".." || strings.Contains(s.Name, "/"):
+		return secretSpec{}, xerrors.Errorf("invalid secret %q: name must be a file name", spec)
+	case (s.Env == "") == (s.File == ""):
+		return secretSpec{}, xerrors.Errorf("invalid secret %q: exactly one of env or file is required", spec)
+	}
+	return s, nil
+}
+
+// parseSecretSpecs parses every spec and ensures that their names are
+// unique.
+func parseSecretSpecs(specs []string) ([]secretSpec, error) {
+	names := map[string]bool{agentTokenSecret: true}
+	secrets := make([]secretSpec, 0, len(specs))
+	for _, spec := range specs {
+		s, err := parseSecretSpec(spec)
+		if err != nil {
+			return nil, err
+		}
+		if names[s.Name] {
+			return nil, xerrors.Errorf("duplicate secret name %q", s.Name)
+		}
+		names[s.Name] = true
+		secrets = append(secrets, s)
+	}
+	return secrets, nil
+}
+
+// resolveSecrets reads the values of specs from the outer container. uid
+// and gid are the IDs of the image user.
+func resolveSecrets(ctx context.Context, specs []secretSpec, uid, gid int) ([]dockerutil.Secret, error) {
+	secrets := make([]dockerutil.Secret, 0, len(specs))
+	for _, s := range specs {
+		var value []byte
+		if s.Env != "" {
+			v, ok := lookupEnv(xunix.Environ(ctx), s.Env)
+			if !ok {
+				return nil, xerrors.Errorf("secret %q: environment variable %q is not set", s.Name, s.Env)
+			}
+			value = []byte(v)
+		} else {
+			var err error
+			value, err = afero.ReadFile(xunix.GetFS(ctx), s.File)
+			if err != nil {
+				return nil, xerrors.Errorf("secret %q: %w", s.Name, err)
+			}
+		}
+
+		secret := dockerutil.Secret{
+			Name:  s.Name,
+			Value: value,
+			Mode:  s.Mode,
+		}
+		switch s.Owner {
+		case ownerUser:
+			secret.UID, secret.GID = uid, gid
+		case ownerID:
+			secret.UID, secret.GID = s.UID, s.GID
+		}
+		secrets = append(secrets, secret)
+	}
+	return secrets, nil
+}
+
+// secretEnvNames returns the names of the variables secrets are read from.
+func secretEnvNames(specs []secretSpec) []string {
+	var names []string
+	for _, s := range specs {
+		if s.Env != "" {
+			names = append(names, s.Env)
+		}
+	}
+	return names
+}
+
+// withoutEnvs returns environ without the variables in names, so that they
+// can't be passed to the inner container's config by name, pattern or
+// rename.
+func withoutEnvs(environ, names []string) []string {
+	kept := make([]string, 0, len(environ))
+	for _, e := range environ {
+		name, _, _ := strings.Cut(e, "=")
+		if slices.Contains(names, name) {
+			continue
+		}
+		kept = append(kept, e)
+	}
+	return kept
+}
+
+// secretsMount is the tmpfs secrets are written to.
+func secretsMount() mount.Mount {
+	return mount.Mount{
+		Type:   mount.TypeTmpfs,
+		Target: InnerSecretsDir,
+		TmpfsOptions: &mount.TmpfsOptions{
+			SizeBytes: secretsTmpfsSize,
+			Mode:      0o755,
+			Options:   [][]string{{"noexec"}, {"nosuid"}, {"nodev"}},
+		},
+	}
+}
+
+func lookupEnv(environ []string, name string) (string, bool) {
+	var (
+		value string
+		found bool
+	)
+	// The last entry wins like it does for os.Getenv.
+	for _, e := range environ {
+		if k, v, ok := strings.Cut(e, "="); ok && k == name {
+			value, found = v, true
+		}
+	}
+	return value, found
+}
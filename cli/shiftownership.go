@@ -0,0 +1,259 @@
+package cli
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/afero"
+	"github.com/spf13/cobra"
+	"golang.org/x/xerrors"
+
+	"cdr.dev/slog/v3"
+	"cdr.dev/slog/v3/sloggers/slogjson"
+	"github.com/coder/envbox/xunix"
+	"github.com/coder/envbox/xunix/idshift"
+)
+
+// shiftOwnershipCheckpointInterval is the number of files between writes of
+// the state file.
+const shiftOwnershipCheckpointInterval = 10000
+
+type shiftOwnershipFlags struct {
+	fromOffset int
+	toOffset   int
+	size       int
+	uidMaps    []string
+	gidMaps    []string
+	dryRun     bool
+	verbose    bool
+	stateFile  string
+	resume     bool
+}
+
+// shiftState is the progress of shift-ownership persisted to its state
+// file so that an interrupted run can be resumed.
+type shiftState struct {
+	Root     string      `json:"root"`
+	Map      idshift.Map `json:"map"`
+	Visited  int         `json:"visited"`
+	Complete bool        `json:"complete"`
+}
+
+// shiftOwnershipCmd rewrites the ownership of a directory tree from one ID
+// mapping to another. It is meant to be run against volumes while no
+// workspace is using them, e.g. to move a cluster to a different
+// CODER_USERNS_OFFSET.
+func shiftOwnershipCmd() *cobra.Command {
+	var flags shiftOwnershipFlags
+
+	cmd := &cobra.Command{
+		Use:   "shift-ownership <dir>",
+		Short: "Rewrite the ownership of a directory tree from one user namespace offset or ID mapping to another",
+		Long: "Rewrite the ownership of a directory tree from one user namespace offset or ID mapping to another. " +
+			"Owners and the IDs in POSIX ACLs are mapped, setuid and setgid bits are preserved and other filesystems are not crossed. " +
+			"The tree must not be in use while it is shifted.",
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			var (
+				ctx  = cmd.Context()
+				log  = slog.Make(slogjson.Sink(cmd.ErrOrStderr())).Leveled(slog.LevelDebug)
+				fs   = xunix.GetFS(ctx)
+				out  = cmd.OutOrStdout()
+				root = filepath.Clean(args[0])
+			)
+
+			idMap, err := shiftOwnershipMap(flags)
+			if err != nil {
+				return err
+			}
+			err = idMap.Validate()
+			if err != nil {
+				return xerrors.Errorf("invalid mapping: %w", err)
+			}
+
+			if flags.resume && flags.stateFile == "" {
+				return xerrors.New("--resume requires --state-file")
+			}
+			var skip int
+			if flags.resume {
+				state, err := readShiftState(fs, flags.stateFile)
+				if err != nil {
+					return err
+				}
+				if state.Root != root || !shiftMapsEqual(state.Map, idMap) {
+					return xerrors.Errorf("state file %q is for a different directory or mapping", flags.stateFile)
+				}
+				if state.Complete {
+					_, _ = fmt.Fprintf(out, "%s was already shifted\n", root)
+					return nil
+				}
+				skip = state.Visited
+			}
+
+			// The state file is written to record progress only while
+			// actually shifting.
+			checkpoint := func(p idshift.Progress, complete bool) error {
+				if flags.stateFile == "" || flags.dryRun {
+					return nil
+				}
+				return writeShiftState(fs, flags.stateFile, shiftState{
+					Root:     root,
+					Map:      idMap,
+					Visited:  p.Visited,
+					Complete: complete,
+				})
+			}
+
+			var checkpointErr error
+			progress, err := idshift.Shift(ctx, idshift.Options{
+				FS:     fs,
+				Root:   root,
+				Map:    idMap,
+				DryRun: flags.dryRun,
+				Skip:   skip,
+				OnChange: func(c idshift.Change) {
+					if !flags.verbose && !flags.dryRun {
+						return
+					}
+					line := fmt.Sprintf("%s %d:%d -> %d:%d", c.Path, c.UID, c.GID, c.NewUID, c.NewGID)
+					if c.ACL {
+						line += " (acl)"
+					}
+					_, _ = fmt.Fprintln(out, line)
+				},
+				OnProgress: func(p idshift.Progress) {
+					log.Info(ctx, "shifting ownership", slog.F("root", root), slog.F("visited", p.Visited), slog.F("changed", p.Changed))
+					if checkpointErr == nil {
+						checkpointErr = checkpoint(p, false)
+					}
+				},
+				ProgressInterval: shiftOwnershipCheckpointInterval,
+			})
+			if err != nil {
+				return xerrors.Errorf("shift %q (visited %d files): %w", root, progress.Visited, err)
+			}
+			if checkpointErr != nil {
+				return xerrors.Errorf("checkpoint: %w", checkpointErr)
+			}
+			err = checkpoint(progress, true)
+			if err != nil {
+				return xerrors.Errorf("checkpoint: %w", err)
+			}
+
+			verb := "Changed"
+			if flags.dryRun {
+				verb = "Would change"
+			}
+			_, _ = fmt.Fprintf(out, "%s %d of %d files in %s\n", verb, progress.Changed, progress.Visited-skip, root)
+			return nil
+		},
+	}
+
+	cmd.Flags().IntVar(&flags.fromOffset, "from-offset", 0, "The user namespace offset the tree is currently shifted to.")
+	cmd.Flags().IntVar(&flags.toOffset, "to-offset", 0, "The user namespace offset to shift the tree to.")
+	cmd.Flags().IntVar(&flags.size, "size", userNamespaceSize, "The number of IDs shifted from --from-offset to --to-offset.")
+	cmd.Flags().StringArrayVar(&flags.uidMaps, "uid-map", nil, "Map UIDs in the form of '<from>:<to>[:<size>]'. May be repeated.")
+	cmd.Flags().StringArrayVar(&flags.gidMaps, "gid-map", nil, "Map GIDs in the form of '<from>:<to>[:<size>]'. May be repeated.")
+	cmd.Flags().BoolVar(&flags.dryRun, "dry-run", false, "Print the files that would change without changing them.")
+	cmd.Flags().BoolVar(&flags.verbose, "verbose", false, "Print every changed file.")
+	cmd.Flags().StringVar(&flags.stateFile, "state-file", "", "A file to record progress in so that an interrupted run can be resumed with --resume. It should be outside of the tree being shifted.")
+	cmd.Flags().BoolVar(&flags.resume, "resume", false, "Resume an interrupted run from --state-file.")
+
+	return cmd
+}
+
+// shiftOwnershipMap returns the mapping described by flags. The offsets
+// apply to both UIDs and GIDs.
+func shiftOwnershipMap(flags shiftOwnershipFlags) (idshift.Map, error) {
+	var m idshift.Map
+	if flags.fromOffset != flags.toOffset {
+		r := idshift.Range{From: flags.fromOffset, To: flags.toOffset, Size: flags.size}
+		m.UIDs = append(m.UIDs, r)
+		m.GIDs = append(m.GIDs, r)
+	}
+	for _, spec := range flags.uidMaps {
+		r, err := parseIDRange(spec)
+		if err != nil {
+			return idshift.Map{}, xerrors.Errorf("parse uid map: %w", err)
+		}
+		m.UIDs = append(m.UIDs, r)
+	}
+	for _, spec := range flags.gidMaps {
+		r, err := parseIDRange(spec)
+		if err != nil {
+			return idshift.Map{}, xerrors.Errorf("parse gid map: %w", err)
+		}
+		m.GIDs = append(m.GIDs, r)
+	}
+	if len(m.UIDs) == 0 && len(m.GIDs) == 0 {
+		return idshift.Map{}, xerrors.New("no mapping given, set --from-offset and --to-offset or --uid-map and --gid-map")
+	}
+	return m, nil
+}
+
+// parseIDRange parses an ID range in the form of '<from>:<to>[:<size>]'.
+func parseIDRange(spec string) (idshift.Range, error) {
+	fields := strings.Split(spec, ":")
+	if len(fields) < 2 || len(fields) > 3 {
+		return idshift.Range{}, xerrors.Errorf("malformed range %q, must be '<from>:<to>[:<size>]'", spec)
+	}
+	if len(fields) == 2 {
+		fields = append(fields, "1")
+	}
+
+	ids := make([]int, 0, len(fields))
+	for _, f := range fields {
+		id, err := strconv.Atoi(f)
+		if err != nil {
+			return idshift.Range{}, xerrors.Errorf("malformed range %q: %q is not a number", spec, f)
+		}
+		ids = append(ids, id)
+	}
+	return idshift.Range{From: ids[0], To: ids[1], Size: ids[2]}, nil
+}
+
+func shiftMapsEqual(a, b idshift.Map) bool {
+	return slices.Equal(a.UIDs, b.UIDs) && slices.Equal(a.GIDs, b.GIDs)
+}
+
+func readShiftState(fs xunix.FS, fpath string) (shiftState, error) {
+	raw, err := afero.ReadFile(fs, fpath)
+	if xerrors.Is(err, os.ErrNotExist) {
+		return shiftState{}, xerrors.Errorf("state file %q does not exist, run without --resume to start", fpath)
+	}
+	if err != nil {
+		return shiftState{}, xerrors.Errorf("read state file: %w", err)
+	}
+
+	var state shiftState
+	err = json.Unmarshal(raw, &state)
+	if err != nil {
+		return shiftState{}, xerrors.Errorf("unmarshal state file %q: %w", fpath, err)
+	}
+	return state, nil
+}
+
+func writeShiftState(fs xunix.FS, fpath string, state shiftState) error {
+	raw, err := json.Marshal(state)
+	if err != nil {
+		return xerrors.Errorf("marshal state: %w", err)
+	}
+
+	// Write atomically so that an interrupted write doesn't lose the
+	// previous checkpoint.
+	tmp := fpath + ".tmp"
+	err = afero.WriteFile(fs, tmp, raw, 0o600)
+	if err != nil {
+		return xerrors.Errorf("write state file: %w", err)
+	}
+	err = fs.Rename(tmp, fpath)
+	if err != nil {
+		return xerrors.Errorf("rename state file: %w", err)
+	}
+	return nil
+}
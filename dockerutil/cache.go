@@ -0,0 +1,359 @@
+package dockerutil
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	goruntime "runtime"
+
+	dockerclient "github.com/docker/docker/client"
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/google/go-containerregistry/pkg/v1/match"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"golang.org/x/sys/unix"
+	"golang.org/x/xerrors"
+)
+
+// imageCacheLockFile is the file in the root of an image cache used to
+// serialize updates to the cache's index.json and the removal of blobs with
+// reading images from it.
+const imageCacheLockFile = ".envbox.lock"
+
+// imageCacheWriteLockFile is the file in the root of an image cache used to
+// serialize writers, so that blobs written by one aren't removed by another
+// before they are referenced by the index.
+const imageCacheWriteLockFile = ".envbox-write.lock"
+
+// refNameAnnotation is the OCI annotation used to record the reference an
+// image in the cache was fetched from.
+const refNameAnnotation = "org.opencontainers.image.ref.name"
+
+type CacheImageConfig struct {
+	// Dir is the root of the OCI image layout used as the cache. It is
+	// created if it does not exist.
+	Dir   string
+	Image string
+	Auth  AuthConfig
+	// Transport is used to talk to the registry. If nil
+	// http.DefaultTransport is used.
+	Transport http.RoundTripper
+}
+
+// CacheImage fetches an image from its registry and writes it to the OCI
+// image layout at conf.Dir so that it may later be loaded via
+// LoadCachedImage. Layers that already exist in the cache are not
+// downloaded again. An existing entry for the same reference is replaced and
+// the blobs no image in the cache references anymore are removed.
+func CacheImage(ctx context.Context, conf CacheImageConfig) (v1.Hash, error) {
+	ref, err := name.ParseReference(conf.Image)
+	if err != nil {
+		return v1.Hash{}, xerrors.Errorf("parse ref: %w", err)
+	}
+
+	transport := conf.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+
+	img, err := remote.Image(ref,
+		remote.WithContext(ctx),
+		remote.WithAuth(conf.Auth.Authenticator()),
+		remote.WithTransport(transport),
+		remote.WithPlatform(v1.Platform{
+			OS:           "linux",
+			Architecture: goruntime.GOARCH,
+		}),
+	)
+	if err != nil {
+		return v1.Hash{}, xerrors.Errorf("fetch image: %w", err)
+	}
+
+	digest, err := img.Digest()
+	if err != nil {
+		return v1.Hash{}, xerrors.Errorf("image digest: %w", err)
+	}
+
+	err = os.MkdirAll(conf.Dir, 0o755)
+	if err != nil {
+		return v1.Hash{}, xerrors.Errorf("create cache dir: %w", err)
+	}
+
+	unlockWrite, err := lockImageCache(conf.Dir, imageCacheWriteLockFile, unix.LOCK_EX)
+	if err != nil {
+		return v1.Hash{}, xerrors.Errorf("lock cache for writing: %w", err)
+	}
+	defer unlockWrite()
+
+	p, err := layout.FromPath(conf.Dir)
+	if err != nil {
+		p, err = layout.Write(conf.Dir, empty.Index)
+		if err != nil {
+			return v1.Hash{}, xerrors.Errorf("init image layout: %w", err)
+		}
+	}
+
+	// Blobs are content addressed so writing them doesn't require holding
+	// the lock. This keeps the window where readers are blocked small even
+	// for large images.
+	err = p.WriteImage(img)
+	if err != nil {
+		return v1.Hash{}, xerrors.Errorf("write image: %w", err)
+	}
+
+	unlock, err := lockImageCache(conf.Dir, imageCacheLockFile, unix.LOCK_EX)
+	if err != nil {
+		return v1.Hash{}, xerrors.Errorf("lock cache: %w", err)
+	}
+	defer unlock()
+
+	err = p.ReplaceImage(img, match.Name(ref.Name()), layout.WithAnnotations(map[string]string{
+		refNameAnnotation: ref.Name(),
+	}))
+	if err != nil {
+		return v1.Hash{}, xerrors.Errorf("update index: %w", err)
+	}
+
+	// Otherwise every update of a moving tag grows the cache.
+	err = removeUnreferencedBlobs(p)
+	if err != nil {
+		return v1.Hash{}, xerrors.Errorf("remove unreferenced blobs: %w", err)
+	}
+
+	return digest, nil
+}
+
+// removeUnreferencedBlobs removes the blobs of the image layout at p that
+// aren't referenced by any image in its index. The caller must hold both of
+// the cache's locks.
+func removeUnreferencedBlobs(p layout.Path) error {
+	idx, err := p.ImageIndex()
+	if err != nil {
+		return xerrors.Errorf("read index: %w", err)
+	}
+	referenced := map[v1.Hash]bool{}
+	err = addReferencedBlobs(idx, referenced)
+	if err != nil {
+		return err
+	}
+
+	blobsDir := filepath.Join(string(p), "blobs")
+	algs, err := os.ReadDir(blobsDir)
+	if err != nil {
+		return xerrors.Errorf("read blobs: %w", err)
+	}
+	for _, alg := range algs {
+		if !alg.IsDir() {
+			continue
+		}
+		blobs, err := os.ReadDir(filepath.Join(blobsDir, alg.Name()))
+		if err != nil {
+			return xerrors.Errorf("read blobs: %w", err)
+		}
+		for _, blob := range blobs {
+			h, err := v1.NewHash(alg.Name() + ":" + blob.Name())
+			// Leave anything that isn't a blob alone.
+			if err != nil || referenced[h] {
+				continue
+			}
+			err = os.Remove(filepath.Join(blobsDir, alg.Name(), blob.Name()))
+			if err != nil && !xerrors.Is(err, os.ErrNotExist) {
+				return xerrors.Errorf("remove blob %s: %w", h, err)
+			}
+		}
+	}
+	return nil
+}
+
+// addReferencedBlobs adds the digests of the manifests, configs and layers
+// of every image in idx to referenced.
+func addReferencedBlobs(idx v1.ImageIndex, referenced map[v1.Hash]bool) error {
+	manifest, err := idx.IndexManifest()
+	if err != nil {
+		return xerrors.Errorf("read index manifest: %w", err)
+	}
+	for _, desc := range manifest.Manifests {
+		referenced[desc.Digest] = true
+		if desc.MediaType.IsIndex() {
+			child, err := idx.ImageIndex(desc.Digest)
+			if err != nil {
+				return xerrors.Errorf("read index %s: %w", desc.Digest, err)
+			}
+			err = addReferencedBlobs(child, referenced)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		img, err := idx.Image(desc.Digest)
+		if err != nil {
+			return xerrors.Errorf("read image %s: %w", desc.Digest, err)
+		}
+		m, err := img.Manifest()
+		if err != nil {
+			return xerrors.Errorf("read manifest %s: %w", desc.Digest, err)
+		}
+		referenced[m.Config.Digest] = true
+		for _, layer := range m.Layers {
+			referenced[layer.Digest] = true
+		}
+	}
+	return nil
+}
+
+// LoadCachedImage loads the provided image into the Docker daemon from the
+// OCI image layout at dir. It returns false if the image is not present in
+// the cache. Only tagged references are supported since images loaded from
+// an archive do not carry a repository digest that Docker can resolve.
+func LoadCachedImage(ctx context.Context, client Client, dir, image string) (bool, error) {
+	ref, err := name.ParseReference(image)
+	if err != nil {
+		return false, xerrors.Errorf("parse ref: %w", err)
+	}
+
+	tag, ok := ref.(name.Tag)
+	if !ok {
+		return false, nil
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "index.json")); xerrors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+
+	// Blobs are read lazily so the lock is held until the image is loaded,
+	// otherwise they may be removed by CacheImage in the meantime.
+	unlock, err := lockImageCache(dir, imageCacheLockFile, unix.LOCK_SH)
+	if err != nil {
+		return false, xerrors.Errorf("lock cache: %w", err)
+	}
+	defer unlock()
+
+	img, err := cachedImage(dir, tag)
+	if err != nil {
+		return false, xerrors.Errorf("read cache: %w", err)
+	}
+	if img == nil {
+		return false, nil
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		_ = pw.CloseWithError(tarball.Write(tag, img, pw))
+	}()
+	defer pr.Close()
+
+	resp, err := client.ImageLoad(ctx, pr, dockerclient.ImageLoadWithQuiet(true))
+	if err != nil {
+		return false, xerrors.Errorf("load image: %w", err)
+	}
+	defer resp.Body.Close()
+
+	err = processImageLoadEvents(resp.Body)
+	if err != nil {
+		return false, xerrors.Errorf("load image: %w", err)
+	}
+
+	return true, nil
+}
+
+func cachedImage(dir string, tag name.Tag) (v1.Image, error) {
+	p, err := layout.FromPath(dir)
+	if err != nil {
+		return nil, xerrors.Errorf("open image layout: %w", err)
+	}
+
+	idx, err := p.ImageIndex()
+	if err != nil {
+		return nil, xerrors.Errorf("read index: %w", err)
+	}
+
+	manifest, err := idx.IndexManifest()
+	if err != nil {
+		return nil, xerrors.Errorf("read index manifest: %w", err)
+	}
+
+	matcher := match.Name(tag.Name())
+	for _, desc := range manifest.Manifests {
+		if !matcher(desc) {
+			continue
+		}
+		img, err := idx.Image(desc.Digest)
+		if err != nil {
+			return nil, xerrors.Errorf("read image %s: %w", desc.Digest, err)
+		}
+		return img, nil
+	}
+
+	return nil, nil
+}
+
+// lockImageCache takes a flock on one of the cache's lock files. The cache
+// is typically mounted read-only into envbox containers so a missing lock
+// file is not treated as an error when acquiring a shared lock.
+func lockImageCache(dir, file string, how int) (func(), error) {
+	flag := os.O_RDONLY
+	if how == unix.LOCK_EX {
+		flag = os.O_RDWR | os.O_CREATE
+	}
+
+	f, err := os.OpenFile(filepath.Join(dir, file), flag, 0o644)
+	if err != nil {
+		if how == unix.LOCK_SH && xerrors.Is(err, os.ErrNotExist) {
+			return func() {}, nil
+		}
+		return nil, xerrors.Errorf("open lock file: %w", err)
+	}
+
+	//nolint:gosec // Fd fits in an int.
+	err = unix.Flock(int(f.Fd()), how)
+	if err != nil {
+		_ = f.Close()
+		return nil, xerrors.Errorf("flock: %w", err)
+	}
+
+	return func() {
+		//nolint:gosec // Fd fits in an int.
+		_ = unix.Flock(int(f.Fd()), unix.LOCK_UN)
+		_ = f.Close()
+	}, nil
+}
+
+func processImageLoadEvents(r io.Reader) error {
+	decoder := json.NewDecoder(r)
+	for {
+		var event struct {
+			Error string `json:"error"`
+		}
+		if err := decoder.Decode(&event); err != nil {
+			if xerrors.Is(err, io.EOF) {
+				return nil
+			}
+			return xerrors.Errorf("decode image load output: %w", err)
+		}
+		if event.Error != "" {
+			return xerrors.New(event.Error)
+		}
+	}
+}
+
+// Authenticator returns the registry authenticator for the auth config.
+func (a AuthConfig) Authenticator() authn.Authenticator {
+	if a == (AuthConfig{}) {
+		return authn.Anonymous
+	}
+	return authn.FromConfig(authn.AuthConfig{
+		Username:      a.Username,
+		Password:      a.Password,
+		Auth:          a.Auth,
+		IdentityToken: a.IdentityToken,
+		RegistryToken: a.RegistryToken,
+	})
+}
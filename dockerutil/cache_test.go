@@ -0,0 +1,251 @@
+package dockerutil_test
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/docker/docker/api/types/image"
+	dockerclient "github.com/docker/docker/client"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/stretchr/testify/require"
+
+	"github.com/coder/envbox/dockerutil"
+	"github.com/coder/envbox/dockerutil/dockerfake"
+)
+
+func TestImageCache(t *testing.T) {
+	t.Parallel()
+
+	t.Run("OK", func(t *testing.T) {
+		t.Parallel()
+
+		var (
+			ctx      = context.Background()
+			cacheDir = t.TempDir()
+			imgRef   = pushRandomImage(t, "test/image:latest")
+		)
+
+		digest, err := dockerutil.CacheImage(ctx, dockerutil.CacheImageConfig{
+			Dir:   cacheDir,
+			Image: imgRef,
+		})
+		require.NoError(t, err)
+
+		// Caching the same image twice should replace the existing entry.
+		digest2, err := dockerutil.CacheImage(ctx, dockerutil.CacheImageConfig{
+			Dir:   cacheDir,
+			Image: imgRef,
+		})
+		require.NoError(t, err)
+		require.Equal(t, digest, digest2)
+
+		var repoTags []string
+		client := dockerfake.MockClient{
+			ImageLoadFn: func(_ context.Context, input io.Reader, _ ...dockerclient.ImageLoadOption) (image.LoadResponse, error) {
+				repoTags = tarballRepoTags(t, input)
+				return image.LoadResponse{Body: io.NopCloser(strings.NewReader(`{"stream":"Loaded image"}`))}, nil
+			},
+		}
+
+		loaded, err := dockerutil.LoadCachedImage(ctx, client, cacheDir, imgRef)
+		require.NoError(t, err)
+		require.True(t, loaded)
+
+		ref, err := name.ParseReference(imgRef)
+		require.NoError(t, err)
+		require.Equal(t, []string{ref.Name()}, repoTags)
+	})
+
+	// Test that the blobs of an image replaced by a new one for the same tag
+	// are removed.
+	t.Run("RemovesReplacedBlobs", func(t *testing.T) {
+		t.Parallel()
+
+		var (
+			ctx      = context.Background()
+			cacheDir = t.TempDir()
+			host     = newRegistry(t)
+		)
+
+		imgRef, old := pushImage(t, host, "test/image:latest")
+		_, err := dockerutil.CacheImage(ctx, dockerutil.CacheImageConfig{
+			Dir:   cacheDir,
+			Image: imgRef,
+		})
+		require.NoError(t, err)
+		// The manifest, config and both layers.
+		require.Len(t, cachedBlobs(t, cacheDir), 4)
+
+		// Move the tag to a new image.
+		_, img := pushImage(t, host, "test/image:latest")
+		_, err = dockerutil.CacheImage(ctx, dockerutil.CacheImageConfig{
+			Dir:   cacheDir,
+			Image: imgRef,
+		})
+		require.NoError(t, err)
+
+		blobs := cachedBlobs(t, cacheDir)
+		require.Len(t, blobs, 4)
+		oldDigest, err := old.Digest()
+		require.NoError(t, err)
+		require.NotContains(t, blobs, oldDigest.Hex)
+		digest, err := img.Digest()
+		require.NoError(t, err)
+		require.Contains(t, blobs, digest.Hex)
+
+		// Images for other tags are kept.
+		otherRef, _ := pushImage(t, host, "test/image:other")
+		_, err = dockerutil.CacheImage(ctx, dockerutil.CacheImageConfig{
+			Dir:   cacheDir,
+			Image: otherRef,
+		})
+		require.NoError(t, err)
+		require.Len(t, cachedBlobs(t, cacheDir), 8)
+	})
+
+	t.Run("NotCached", func(t *testing.T) {
+		t.Parallel()
+
+		var (
+			ctx      = context.Background()
+			cacheDir = t.TempDir()
+			imgRef   = pushRandomImage(t, "test/image:latest")
+		)
+
+		_, err := dockerutil.CacheImage(ctx, dockerutil.CacheImageConfig{
+			Dir:   cacheDir,
+			Image: imgRef,
+		})
+		require.NoError(t, err)
+
+		loaded, err := dockerutil.LoadCachedImage(ctx, dockerfake.MockClient{}, cacheDir, strings.Replace(imgRef, ":latest", ":other", 1))
+		require.NoError(t, err)
+		require.False(t, loaded)
+
+		// An empty cache directory is not an error.
+		loaded, err = dockerutil.LoadCachedImage(ctx, dockerfake.MockClient{}, t.TempDir(), imgRef)
+		require.NoError(t, err)
+		require.False(t, loaded)
+	})
+
+	t.Run("Digest", func(t *testing.T) {
+		t.Parallel()
+
+		loaded, err := dockerutil.LoadCachedImage(context.Background(), dockerfake.MockClient{}, t.TempDir(),
+			"gcr.io/images/helloworld@sha256:13e101dd511a26a2147e123456bdff5845c9461aaa53d856845745b063001234")
+		require.NoError(t, err)
+		require.False(t, loaded)
+	})
+
+	t.Run("LoadError", func(t *testing.T) {
+		t.Parallel()
+
+		var (
+			ctx      = context.Background()
+			cacheDir = t.TempDir()
+			imgRef   = pushRandomImage(t, "test/image:latest")
+		)
+
+		_, err := dockerutil.CacheImage(ctx, dockerutil.CacheImageConfig{
+			Dir:   cacheDir,
+			Image: imgRef,
+		})
+		require.NoError(t, err)
+
+		client := dockerfake.MockClient{
+			ImageLoadFn: func(_ context.Context, input io.Reader, _ ...dockerclient.ImageLoadOption) (image.LoadResponse, error) {
+				_, _ = io.Copy(io.Discard, input)
+				return image.LoadResponse{Body: io.NopCloser(strings.NewReader(`{"error":"no space left on device"}`))}, nil
+			},
+		}
+
+		loaded, err := dockerutil.LoadCachedImage(ctx, client, cacheDir, imgRef)
+		require.ErrorContains(t, err, "no space left on device")
+		require.False(t, loaded)
+	})
+}
+
+// pushRandomImage pushes a random image to an in-memory registry and returns
+// its reference.
+func pushRandomImage(t *testing.T, repo string) string {
+	t.Helper()
+
+	ref, _ := pushImage(t, newRegistry(t), repo)
+	return ref
+}
+
+// newRegistry starts an in-memory registry and returns its host.
+func newRegistry(t *testing.T) string {
+	t.Helper()
+
+	srv := httptest.NewServer(registry.New())
+	t.Cleanup(srv.Close)
+
+	u, err := url.Parse(srv.URL)
+	require.NoError(t, err)
+	return u.Host
+}
+
+// pushImage pushes a random image with two layers to the registry at host.
+func pushImage(t *testing.T, host, repo string) (string, v1.Image) {
+	t.Helper()
+
+	img, err := random.Image(1024, 2)
+	require.NoError(t, err)
+
+	ref, err := name.ParseReference(host + "/" + repo)
+	require.NoError(t, err)
+	require.NoError(t, remote.Write(ref, img))
+
+	return ref.String(), img
+}
+
+// cachedBlobs returns the names of the blobs in the cache at dir.
+func cachedBlobs(t *testing.T, dir string) []string {
+	t.Helper()
+
+	entries, err := os.ReadDir(filepath.Join(dir, "blobs", "sha256"))
+	require.NoError(t, err)
+	names := make([]string, 0, len(entries))
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	return names
+}
+
+func tarballRepoTags(t *testing.T, r io.Reader) []string {
+	t.Helper()
+
+	tr := tar.NewReader(r)
+	var tags []string
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		if hdr.Name != "manifest.json" {
+			continue
+		}
+		var manifest []struct {
+			RepoTags []string
+		}
+		require.NoError(t, json.NewDecoder(tr).Decode(&manifest))
+		for _, m := range manifest {
+			tags = append(tags, m.RepoTags...)
+		}
+	}
+	return tags
+}
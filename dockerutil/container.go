@@ -1,20 +1,23 @@
 package dockerutil
 
 import (
+	"bytes"
 	"context"
 	"fmt"
 	"io"
-	"path/filepath"
+	"path"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/docker/docker/api/types/container"
-	"github.com/spf13/afero"
+	"github.com/docker/docker/api/types/mount"
+	"github.com/docker/docker/pkg/stdcopy"
 	"golang.org/x/xerrors"
 
 	"cdr.dev/slog/v3"
 	"github.com/coder/envbox/xunix"
+	"github.com/coder/envbox/xunix/cgroup"
 	"github.com/coder/retry"
 )
 
@@ -22,22 +25,53 @@ const (
 	runtime = "sysbox-runc"
 	// Default CPU period for containers.
 	DefaultCPUPeriod uint64 = 1e5
+
+	// MinMemoryHeadroom and MaxMemoryHeadroom bound the memory reserved
+	// for dockerd, sysbox and envbox when the inner container's memory
+	// limit is derived from the outer container's.
+	MinMemoryHeadroom int64 = 256 << 20
+	MaxMemoryHeadroom int64 = 1 << 30
 )
 
 type ContainerConfig struct {
-	Log        slog.Logger
-	Mounts     []xunix.Mount
-	Devices    []container.DeviceMapping
-	Envs       []string
-	Name       string
-	Image      string
-	WorkingDir string
-	Hostname   string
-	// HasInit dictates whether the entrypoint of the container is /sbin/init
-	// or 'sleep infinity'.
-	HasInit     bool
-	CPUs        int64
+	Log    slog.Logger
+	Mounts []xunix.Mount
+	// DockerMounts are passed as-is to the daemon. Unlike Mounts they
+	// support tmpfs and volume mounts as well as bind propagation.
+	DockerMounts []mount.Mount
+	Devices      []container.DeviceMapping
+	Envs         []string
+	Name         string
+	Image        string
+	WorkingDir   string
+	Hostname     string
+	// Init is the init system to boot from InitPath. When Entrypoint is
+	// EntrypointAuto and Init is InitNone 'sleep infinity' is run instead.
+	Init     InitSystem
+	InitPath string
+	// Labels are applied to the container.
+	Labels map[string]string
+	// GroupAdd are supplementary groups, names or GIDs, the daemon adds to
+	// the container's processes, including every exec.
+	GroupAdd []string
+	// Entrypoint dictates what the container runs as PID 1. Defaults to
+	// EntrypointAuto.
+	Entrypoint EntrypointMode
+	// EntrypointCmd is the command to run when Entrypoint is
+	// EntrypointCustom.
+	EntrypointCmd []string
+	// MilliCPUs is the CPU limit in thousandths of a CPU.
+	MilliCPUs   int64
 	MemoryLimit int64
+	// MemorySwap is the combined memory and swap limit, -1 for unlimited
+	// swap.
+	MemorySwap        int64
+	MemoryReservation int64
+	PidsLimit         int64
+	CPUSetCPUs        string
+	BlkioWeight       uint16
+	ShmSize           int64
+	Ulimits           []*container.Ulimit
 }
 
 // CreateContainer creates a sysbox-runc container.
@@ -54,18 +88,37 @@ func CreateContainer(ctx context.Context, client Client, conf *ContainerConfig)
 			// These will not be visible inside the child container.
 			// See: https://github.com/nestybox/sysbox/issues/582
 			CPUPeriod: int64(DefaultCPUPeriod),
-			CPUQuota:  conf.CPUs * int64(DefaultCPUPeriod),
+			CPUQuota:  conf.MilliCPUs * int64(DefaultCPUPeriod) / 1000,
 			Memory:    conf.MemoryLimit,
+
+			MemorySwap:        conf.MemorySwap,
+			MemoryReservation: conf.MemoryReservation,
+			CpusetCpus:        conf.CPUSetCPUs,
+			BlkioWeight:       conf.BlkioWeight,
+			Ulimits:           conf.Ulimits,
 		},
+		ShmSize:    conf.ShmSize,
+		GroupAdd:   conf.GroupAdd,
 		ExtraHosts: []string{"host.docker.internal:host-gateway"},
 		Binds:      generateBindMounts(conf.Mounts),
+		Mounts:     conf.DockerMounts,
+	}
+	if conf.PidsLimit != 0 {
+		host.Resources.PidsLimit = &conf.PidsLimit
 	}
 
-	entrypoint := []string{"sleep", "infinity"}
-	if conf.HasInit {
-		entrypoint = []string{"/sbin/init"}
+	entrypoint, cmd, stopSignal, err := containerEntrypoint(ctx, client, conf)
+	if err != nil {
+		return "", xerrors.Errorf("entrypoint: %w", err)
 	}
 
+	conf.Log.Debug(ctx, "using container entrypoint",
+		slog.F("mode", conf.Entrypoint),
+		slog.F("entrypoint", entrypoint),
+		slog.F("cmd", cmd),
+		slog.F("stop_signal", stopSignal),
+	)
+
 	if conf.Hostname == "" {
 		conf.Hostname = conf.Name
 	}
@@ -73,12 +126,14 @@ func CreateContainer(ctx context.Context, client Client, conf *ContainerConfig)
 	cnt := &container.Config{
 		Image:      conf.Image,
 		Entrypoint: entrypoint,
-		Cmd:        []string{},
+		Cmd:        cmd,
 		Env:        conf.Envs,
 		Hostname:   conf.Hostname,
 		WorkingDir: conf.WorkingDir,
 		Tty:        false,
 		User:       "root",
+		StopSignal: stopSignal,
+		Labels:     conf.Labels,
 	}
 
 	c, err := client.ContainerCreate(ctx, cnt, host, nil, nil, conf.Name)
@@ -88,6 +143,70 @@ func CreateContainer(ctx context.Context, client Client, conf *ContainerConfig)
 	return c.ID, nil
 }
 
+// StreamContainerLogs follows the stdout and stderr of a container and logs
+// each line until the container exits or ctx is canceled.
+func StreamContainerLogs(ctx context.Context, client Client, log slog.Logger, containerID string) error {
+	rc, err := client.ContainerLogs(ctx, containerID, container.LogsOptions{
+		ShowStdout: true,
+		ShowStderr: true,
+		Follow:     true,
+	})
+	if err != nil {
+		return xerrors.Errorf("container logs: %w", err)
+	}
+	defer rc.Close()
+
+	var (
+		stdout = newLineWriter(func(line string) {
+			log.Info(ctx, "container output", slog.F("stream", "stdout"), slog.F("line", line))
+		})
+		stderr = newLineWriter(func(line string) {
+			log.Info(ctx, "container output", slog.F("stream", "stderr"), slog.F("line", line))
+		})
+	)
+	defer stdout.Flush()
+	defer stderr.Flush()
+
+	// The container is created without a TTY so the output is multiplexed.
+	_, err = stdcopy.StdCopy(stdout, stderr, rc)
+	if err != nil && ctx.Err() == nil {
+		return xerrors.Errorf("copy container logs: %w", err)
+	}
+
+	return nil
+}
+
+// lineWriter calls fn for every complete line written to it.
+type lineWriter struct {
+	fn  func(string)
+	buf []byte
+}
+
+func newLineWriter(fn func(string)) *lineWriter {
+	return &lineWriter{fn: fn}
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			break
+		}
+		w.fn(strings.TrimSuffix(string(w.buf[:i]), "\r"))
+		w.buf = w.buf[i+1:]
+	}
+	return len(p), nil
+}
+
+// Flush calls fn with any trailing partial line.
+func (w *lineWriter) Flush() {
+	if len(w.buf) > 0 {
+		w.fn(string(w.buf))
+		w.buf = nil
+	}
+}
+
 type BootstrapConfig struct {
 	ContainerID string
 	User        string
@@ -137,57 +256,104 @@ func BootstrapContainer(ctx context.Context, client Client, conf BootstrapConfig
 // that applications inside the container know how much CPU they have to work with.
 //
 // For cgroupv2:
-// - /sys/fs/cgroup/<subpath>/init.scope/cpu.max
+// - <mount>/docker/<id>/init.scope/cpu.max
 //
 // For cgroupv1:
-// - /sys/fs/cgroup/cpu,cpuacct/<subpath>/syscont-cgroup-root/cpu.cfs_quota_us
-// - /sys/fs/cgroup/cpu,cpuacct/<subpath>/syscont-cgroup-root/cpu.cfs_period_us
+// - <cpu mount>/docker/<id>/syscont-cgroup-root/cpu.cfs_quota_us
+// - <cpu mount>/docker/<id>/syscont-cgroup-root/cpu.cfs_period_us
+//
+// The mounts are typically /sys/fs/cgroup and /sys/fs/cgroup/cpu,cpuacct.
 func SetContainerQuota(ctx context.Context, containerID string, quota xunix.CPUQuota) error {
+	cg, err := cgroup.Load(xunix.GetFS(ctx))
+	if err != nil {
+		return xerrors.Errorf("load cgroups: %w", err)
+	}
+
 	switch quota.CGroup {
 	case xunix.CGroupV2:
-		return setContainerQuotaCGroupV2(ctx, containerID, quota)
+		content := fmt.Sprintf("%d %d\n", quota.Quota, quota.Period)
+		if quota.Quota < 0 {
+			content = fmt.Sprintf("max %d\n", quota.Period)
+		}
+
+		err = cg.WriteFile(cgroup.V2, "cpu", innerCGroupPath(quota.CGroup, containerID), "cpu.max", []byte(content))
+		if err != nil {
+			return xerrors.Errorf("write cpu.max to inner container cgroup: %w", err)
+		}
 	case xunix.CGroupV1:
-		return setContainerQuotaCGroupV1(ctx, containerID, quota)
+		rel := innerCGroupPath(quota.CGroup, containerID)
+		err = cg.WriteFile(cgroup.V1, "cpu", rel, "cpu.cfs_period_us", []byte(strconv.Itoa(quota.Period)))
+		if err != nil {
+			return xerrors.Errorf("write cpu.cfs_period_us to inner container cgroup: %w", err)
+		}
+
+		err = cg.WriteFile(cgroup.V1, "cpu", rel, "cpu.cfs_quota_us", []byte(strconv.Itoa(quota.Quota)))
+		if err != nil {
+			return xerrors.Errorf("write cpu.cfs_quota_us to inner container cgroup: %w", err)
+		}
 	default:
 		return xerrors.Errorf("Unknown cgroup %d", quota.CGroup)
 	}
-}
 
-func setContainerQuotaCGroupV2(ctx context.Context, containerID string, quota xunix.CPUQuota) error {
-	var (
-		fs         = xunix.GetFS(ctx)
-		cgroupBase = fmt.Sprintf("/sys/fs/cgroup/docker/%s/init.scope/", containerID)
-	)
+	return nil
+}
 
-	var content string
-	if quota.Quota < 0 {
-		content = fmt.Sprintf("max %d\n", quota.Period)
-	} else {
-		content = fmt.Sprintf("%d %d\n", quota.Quota, quota.Period)
+// innerCGroupPath returns the cgroup that is the root of the inner
+// container's cgroup namespace relative to the mount of its hierarchy.
+func innerCGroupPath(v xunix.CGroup, containerID string) string {
+	if v == xunix.CGroupV2 {
+		return path.Join("docker", containerID, "init.scope")
 	}
+	return path.Join("docker", containerID, "syscont-cgroup-root")
+}
 
-	err := afero.WriteFile(fs, filepath.Join(cgroupBase, "cpu.max"), []byte(content), 0o644)
-	if err != nil {
-		return xerrors.Errorf("write cpu.max to inner container cgroup: %w", err)
+// InnerMemoryLimit returns the memory limit for the inner container given
+// the memory limit of the outer container. 10% of the outer limit, bounded
+// by MinMemoryHeadroom and MaxMemoryHeadroom, is left for the processes
+// running alongside the inner container. At most half of the outer limit is
+// reserved. It returns -1 if the outer limit is unlimited.
+func InnerMemoryLimit(outer int64) int64 {
+	if outer < 0 {
+		return -1
 	}
 
-	return nil
+	headroom := outer / 10
+	headroom = max(headroom, MinMemoryHeadroom)
+	headroom = min(headroom, MaxMemoryHeadroom, outer/2)
+	return outer - headroom
 }
 
-func setContainerQuotaCGroupV1(ctx context.Context, containerID string, quota xunix.CPUQuota) error {
+// SetContainerMemoryLimit writes the memory limit into the cgroup that is
+// the root of the inner container's cgroup namespace. Docker only sets the
+// limit on the container's cgroup which sysbox hides so processes inside
+// the container would otherwise see no limit.
+func SetContainerMemoryLimit(ctx context.Context, containerID string, limit xunix.MemoryLimit) error {
+	cg, err := cgroup.Load(xunix.GetFS(ctx))
+	if err != nil {
+		return xerrors.Errorf("load cgroups: %w", err)
+	}
+
 	var (
-		fs         = xunix.GetFS(ctx)
-		cgroupBase = fmt.Sprintf("/sys/fs/cgroup/cpu,cpuacct/docker/%s/syscont-cgroup-root/", containerID)
+		name    string
+		content string
 	)
-
-	err := afero.WriteFile(fs, filepath.Join(cgroupBase, "cpu.cfs_period_us"), []byte(strconv.Itoa(quota.Period)), 0o644)
-	if err != nil {
-		return xerrors.Errorf("write cpu.cfs_period_us to inner container cgroup: %w", err)
+	switch limit.CGroup {
+	case xunix.CGroupV2:
+		name = "memory.max"
+		content = "max"
+		if limit.Limit >= 0 {
+			content = strconv.FormatInt(limit.Limit, 10)
+		}
+	case xunix.CGroupV1:
+		name = "memory.limit_in_bytes"
+		content = strconv.FormatInt(limit.Limit, 10)
+	default:
+		return xerrors.Errorf("Unknown cgroup %d", limit.CGroup)
 	}
 
-	err = afero.WriteFile(fs, filepath.Join(cgroupBase, "cpu.cfs_quota_us"), []byte(strconv.Itoa(quota.Quota)), 0o644)
+	err = cg.WriteFile(limit.CGroup, "memory", innerCGroupPath(limit.CGroup, containerID), name, []byte(content))
 	if err != nil {
-		return xerrors.Errorf("write cpu.cfs_quota_us to inner container cgroup: %w", err)
+		return xerrors.Errorf("write %s to inner container cgroup: %w", name, err)
 	}
 
 	return nil
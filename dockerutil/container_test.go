@@ -80,3 +80,66 @@ func TestSetContainerQuota(t *testing.T) {
 		})
 	}
 }
+
+func TestInnerMemoryLimit(t *testing.T) {
+	t.Parallel()
+
+	const gib = int64(1 << 30)
+
+	// Unlimited.
+	require.Equal(t, int64(-1), dockerutil.InnerMemoryLimit(-1))
+	// 10% headroom.
+	require.Equal(t, 4*gib-4*gib/10, dockerutil.InnerMemoryLimit(4*gib))
+	// Headroom is at least MinMemoryHeadroom.
+	require.Equal(t, gib-dockerutil.MinMemoryHeadroom, dockerutil.InnerMemoryLimit(gib))
+	// Headroom is at most MaxMemoryHeadroom.
+	require.Equal(t, 64*gib-dockerutil.MaxMemoryHeadroom, dockerutil.InnerMemoryLimit(64*gib))
+	// No more than half is reserved.
+	require.Equal(t, int64(200<<20), dockerutil.InnerMemoryLimit(400<<20))
+}
+
+func TestSetContainerMemoryLimit(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		Name       string
+		Limit      xunix.MemoryLimit
+		ExpectedFS map[string]string
+	}{
+		{
+			Name:  "CGroupV1",
+			Limit: xunix.MemoryLimit{Limit: 1 << 30, CGroup: xunix.CGroupV1},
+			ExpectedFS: map[string]string{
+				"/sys/fs/cgroup/memory/docker/dummy/syscont-cgroup-root/memory.limit_in_bytes": "1073741824",
+			},
+		},
+		{
+			Name:  "CGroupV2",
+			Limit: xunix.MemoryLimit{Limit: 1 << 30, CGroup: xunix.CGroupV2},
+			ExpectedFS: map[string]string{
+				"/sys/fs/cgroup/docker/dummy/init.scope/memory.max": "1073741824",
+			},
+		},
+		{
+			Name:  "CGroupV2Max",
+			Limit: xunix.MemoryLimit{Limit: -1, CGroup: xunix.CGroupV2},
+			ExpectedFS: map[string]string{
+				"/sys/fs/cgroup/docker/dummy/init.scope/memory.max": "max",
+			},
+		},
+	} {
+		tc := tc
+		t.Run(tc.Name, func(t *testing.T) {
+			t.Parallel()
+			tmpfs := xunixfake.NewMemFS()
+			ctx := xunix.WithFS(context.Background(), tmpfs)
+			err := dockerutil.SetContainerMemoryLimit(ctx, "dummy", tc.Limit)
+			require.NoError(t, err)
+			for path, content := range tc.ExpectedFS {
+				actualContent, err := afero.ReadFile(tmpfs, path)
+				require.NoError(t, err)
+				require.Equal(t, content, string(bytes.TrimSpace(actualContent)))
+			}
+		})
+	}
+}
@@ -0,0 +1,157 @@
+package dockerutil
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	cerrdefs "github.com/containerd/errdefs"
+	"github.com/docker/docker/api/types/container"
+	"golang.org/x/xerrors"
+)
+
+// ContainerFile is a file to write into a container.
+type ContainerFile struct {
+	// Path is the absolute path of the file inside the container.
+	Path    string
+	Content []byte
+	Mode    int64
+	// UID and GID are relative to the container's user namespace.
+	UID int
+	GID int
+	// Dir creates a directory instead of a file.
+	Dir bool
+}
+
+// CopyFilesToContainer writes files into a container. Missing parent
+// directories that aren't in files are created by the daemon and owned by
+// root.
+func CopyFilesToContainer(ctx context.Context, client Client, containerID string, files []ContainerFile) error {
+	var (
+		buf bytes.Buffer
+		tw  = tar.NewWriter(&buf)
+		now = time.Now()
+	)
+
+	for _, f := range files {
+		if !strings.HasPrefix(f.Path, "/") {
+			return xerrors.Errorf("path %q must be absolute", f.Path)
+		}
+
+		hdr := &tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     strings.TrimPrefix(f.Path, "/"),
+			Size:     int64(len(f.Content)),
+			Mode:     f.Mode,
+			Uid:      f.UID,
+			Gid:      f.GID,
+			ModTime:  now,
+		}
+		if f.Dir {
+			hdr.Typeflag = tar.TypeDir
+			hdr.Name += "/"
+			hdr.Size = 0
+		}
+		err := tw.WriteHeader(hdr)
+		if err != nil {
+			return xerrors.Errorf("write header for %q: %w", f.Path, err)
+		}
+		if f.Dir {
+			continue
+		}
+
+		_, err = tw.Write(f.Content)
+		if err != nil {
+			return xerrors.Errorf("write %q: %w", f.Path, err)
+		}
+	}
+
+	err := tw.Close()
+	if err != nil {
+		return xerrors.Errorf("close tar: %w", err)
+	}
+
+	err = client.CopyToContainer(ctx, containerID, "/", &buf, container.CopyToContainerOptions{})
+	if err != nil {
+		return xerrors.Errorf("copy to container: %w", err)
+	}
+
+	return nil
+}
+
+// PathExists returns whether p exists in a container.
+func PathExists(ctx context.Context, client Client, containerID, p string) (bool, error) {
+	_, err := client.ContainerStatPath(ctx, containerID, p)
+	if cerrdefs.IsNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, xerrors.Errorf("stat %s: %w", p, err)
+	}
+	return true, nil
+}
+
+// ReadContainerFile returns the contents of the regular file p in a
+// container. An error wrapping os.ErrNotExist is returned if p doesn't
+// exist.
+func ReadContainerFile(ctx context.Context, client Client, containerID, p string) ([]byte, error) {
+	rc, _, err := client.CopyFromContainer(ctx, containerID, p)
+	if cerrdefs.IsNotFound(err) {
+		return nil, xerrors.Errorf("copy %s: %w", p, os.ErrNotExist)
+	}
+	if err != nil {
+		return nil, xerrors.Errorf("copy %s: %w", p, err)
+	}
+	defer rc.Close()
+
+	tr := tar.NewReader(rc)
+	hdr, err := tr.Next()
+	if err != nil {
+		return nil, xerrors.Errorf("read archive: %w", err)
+	}
+	if hdr.Typeflag != tar.TypeReg {
+		return nil, xerrors.Errorf("%s is not a regular file", p)
+	}
+	b, err := io.ReadAll(tr)
+	if err != nil {
+		return nil, xerrors.Errorf("read %s: %w", p, err)
+	}
+	return b, nil
+}
+
+// ReadImagePath calls fn with a tar archive of p in img. Like 'docker cp'
+// the archive's entries are named relative to p's parent. A container is
+// created from the image to read it from but it is never started. An error
+// wrapping os.ErrNotExist is returned if p doesn't exist in the image.
+func ReadImagePath(ctx context.Context, client Client, img, p string, fn func(tr *tar.Reader) error) error {
+	created, err := client.ContainerCreate(ctx, &container.Config{
+		Image:      img,
+		Entrypoint: []string{"sleep"},
+		Cmd:        []string{"infinity"},
+	}, &container.HostConfig{}, nil, nil, "")
+	if err != nil {
+		return xerrors.Errorf("create container: %w", err)
+	}
+
+	defer func() {
+		// We wanna remove this, but it's not a huge deal if it fails.
+		_ = client.ContainerRemove(ctx, created.ID, container.RemoveOptions{
+			Force: true,
+		})
+	}()
+
+	rc, _, err := client.CopyFromContainer(ctx, created.ID, p)
+	if cerrdefs.IsNotFound(err) {
+		return xerrors.Errorf("copy %s: %w", p, os.ErrNotExist)
+	}
+	if err != nil {
+		return xerrors.Errorf("copy %s: %w", p, err)
+	}
+	defer rc.Close()
+
+	return fn(tar.NewReader(rc))
+}
@@ -0,0 +1,159 @@
+package dockerutil
+
+import (
+	"encoding/json"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+
+	"golang.org/x/xerrors"
+)
+
+// DaemonConfigPath is the path of a Docker daemon's configuration file.
+const DaemonConfigPath = "/etc/docker/daemon.json"
+
+// AddressPool is a range of networks a Docker daemon allocates the subnets
+// of its networks from.
+type AddressPool struct {
+	Base string `json:"base"`
+	// Size is the prefix length of the subnets.
+	Size int `json:"size"`
+}
+
+// defaultAddressPools are the pools a Docker daemon uses if none are
+// configured.
+var defaultAddressPools = func() []AddressPool {
+	pools := make([]AddressPool, 0, 16)
+	for i := 17; i <= 31; i++ {
+		pools = append(pools, AddressPool{Base: net.IPv4(172, byte(i), 0, 0).String() + "/16", Size: 16})
+	}
+	return append(pools, AddressPool{Base: "192.168.0.0/16", Size: 20})
+}()
+
+// AddressPoolsExcluding returns a Docker daemon's default address pools
+// without the ones that overlap any of the networks in exclude, e.g. the
+// networks a container running the daemon is attached to.
+func AddressPoolsExcluding(exclude []*net.IPNet) []AddressPool {
+	pools := make([]AddressPool, 0, len(defaultAddressPools))
+	for _, pool := range defaultAddressPools {
+		base := mustParseIPv4Net(pool.Base)
+		if slices.ContainsFunc(exclude, func(n *net.IPNet) bool {
+			return base.Contains(n.IP) || n.Contains(base.IP)
+		}) {
+			continue
+		}
+		pools = append(pools, pool)
+	}
+	return pools
+}
+
+// ParseAddressPool parses a pool in the form of '<base>[:<size>]' (e.g.
+// 10.10.0.0/16:24). The size defaults to 24.
+func ParseAddressPool(s string) (AddressPool, error) {
+	base := s
+	pool := AddressPool{Size: 24}
+	// IPv6 bases contain colons so the size follows the prefix length.
+	if i := strings.LastIndex(s, "/"); i >= 0 {
+		if prefix, size, ok := strings.Cut(s[i:], ":"); ok {
+			base = s[:i] + prefix
+			n, err := strconv.Atoi(size)
+			if err != nil {
+				return AddressPool{}, xerrors.Errorf("invalid size %q in address pool %q", size, s)
+			}
+			pool.Size = n
+		}
+	}
+
+	_, n, err := net.ParseCIDR(base)
+	if err != nil {
+		return AddressPool{}, xerrors.Errorf("invalid base of address pool %q: %w", s, err)
+	}
+	ones, bits := n.Mask.Size()
+	if pool.Size < ones || pool.Size > bits {
+		return AddressPool{}, xerrors.Errorf("invalid address pool %q: size must be between %d and %d", s, ones, bits)
+	}
+	pool.Base = n.String()
+	return pool, nil
+}
+
+// DaemonConfig holds the settings envbox manages in a Docker daemon's
+// configuration file.
+type DaemonConfig struct {
+	// MTU is set if it isn't zero.
+	MTU int
+	// AddressPools replace any existing pools if OverrideAddressPools is
+	// set, otherwise they are only used if there are none.
+	AddressPools         []AddressPool
+	OverrideAddressPools bool
+	// RegistryMirrors and InsecureRegistries are added to existing ones.
+	RegistryMirrors    []string
+	InsecureRegistries []string
+}
+
+// MergeDaemonConfig applies conf to the Docker daemon configuration file
+// existing, keeping every setting it doesn't manage. existing may be
+// empty.
+func MergeDaemonConfig(existing []byte, conf DaemonConfig) ([]byte, error) {
+	cfg := map[string]json.RawMessage{}
+	if len(existing) > 0 {
+		err := json.Unmarshal(existing, &cfg)
+		if err != nil {
+			return nil, xerrors.Errorf("parse existing config: %w", err)
+		}
+	}
+
+	set := func(key string, v any) error {
+		raw, err := json.Marshal(v)
+		if err != nil {
+			return xerrors.Errorf("marshal %s: %w", key, err)
+		}
+		cfg[key] = raw
+		return nil
+	}
+	union := func(key string, add []string) error {
+		if len(add) == 0 {
+			return nil
+		}
+		var list []string
+		if raw, ok := cfg[key]; ok {
+			err := json.Unmarshal(raw, &list)
+			if err != nil {
+				return xerrors.Errorf("parse existing %s: %w", key, err)
+			}
+		}
+		for _, v := range add {
+			if !slices.Contains(list, v) {
+				list = append(list, v)
+			}
+		}
+		return set(key, list)
+	}
+
+	if conf.MTU > 0 {
+		err := set("mtu", conf.MTU)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if _, ok := cfg["default-address-pools"]; (!ok || conf.OverrideAddressPools) && len(conf.AddressPools) > 0 {
+		err := set("default-address-pools", conf.AddressPools)
+		if err != nil {
+			return nil, err
+		}
+	}
+	err := union("registry-mirrors", conf.RegistryMirrors)
+	if err != nil {
+		return nil, err
+	}
+	err = union("insecure-registries", conf.InsecureRegistries)
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := json.MarshalIndent(cfg, "", "\t")
+	if err != nil {
+		return nil, xerrors.Errorf("marshal config: %w", err)
+	}
+	return append(b, '\n'), nil
+}
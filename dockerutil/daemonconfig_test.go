@@ -0,0 +1,176 @@
+package dockerutil_test
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/coder/envbox/dockerutil"
+)
+
+func TestAddressPoolsExcluding(t *testing.T) {
+	t.Parallel()
+
+	pools := dockerutil.AddressPoolsExcluding(nil)
+	require.Len(t, pools, 16)
+	require.Equal(t, dockerutil.AddressPool{Base: "172.17.0.0/16", Size: 16}, pools[0])
+	require.Equal(t, dockerutil.AddressPool{Base: "192.168.0.0/16", Size: 20}, pools[15])
+
+	var exclude []*net.IPNet
+	for _, cidr := range []string{"172.19.0.0/30", "172.16.0.0/13", "192.168.1.0/24", "10.0.0.0/8"} {
+		_, n, err := net.ParseCIDR(cidr)
+		require.NoError(t, err)
+		exclude = append(exclude, n)
+	}
+	pools = dockerutil.AddressPoolsExcluding(exclude)
+	require.Len(t, pools, 8)
+	for _, p := range pools {
+		require.NotContains(t, []string{"172.17.0.0/16", "172.19.0.0/16", "172.23.0.0/16", "192.168.0.0/16"}, p.Base)
+	}
+	require.Equal(t, "172.24.0.0/16", pools[0].Base)
+}
+
+func TestParseAddressPool(t *testing.T) {
+	t.Parallel()
+
+	type testcase struct {
+		name     string
+		pool     string
+		expected dockerutil.AddressPool
+		err      string
+	}
+
+	testcases := []testcase{
+		{
+			name:     "DefaultSize",
+			pool:     "10.10.0.0/16",
+			expected: dockerutil.AddressPool{Base: "10.10.0.0/16", Size: 24},
+		},
+		{
+			name:     "Size",
+			pool:     "10.10.0.0/16:20",
+			expected: dockerutil.AddressPool{Base: "10.10.0.0/16", Size: 20},
+		},
+		{
+			name:     "IPv6",
+			pool:     "fd00:1::/48:64",
+			expected: dockerutil.AddressPool{Base: "fd00:1::/48", Size: 64},
+		},
+		{
+			name:     "Normalized",
+			pool:     "10.10.1.2/16",
+			expected: dockerutil.AddressPool{Base: "10.10.0.0/16", Size: 24},
+		},
+		{
+			name: "SizeTooSmall",
+			pool: "10.10.0.0/16:8",
+			err:  "size must be between 16 and 32",
+		},
+		{
+			name: "InvalidSize",
+			pool: "10.10.0.0/16:big",
+			err:  "invalid size",
+		},
+		{
+			name: "InvalidBase",
+			pool: "10.10.0.0",
+			err:  "invalid base",
+		},
+	}
+
+	for _, tc := range testcases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			pool, err := dockerutil.ParseAddressPool(tc.pool)
+			if tc.err != "" {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), tc.err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.expected, pool)
+		})
+	}
+}
+
+func TestMergeDaemonConfig(t *testing.T) {
+	t.Parallel()
+
+	conf := dockerutil.DaemonConfig{
+		MTU:                1460,
+		AddressPools:       []dockerutil.AddressPool{{Base: "10.10.0.0/16", Size: 24}},
+		RegistryMirrors:    []string{"https://mirror.example.com", "https://existing.example.com"},
+		InsecureRegistries: []string{"registry.local:5000"},
+	}
+
+	type testcase struct {
+		name     string
+		existing string
+		override bool
+		expected string
+	}
+
+	testcases := []testcase{
+		{
+			name: "Empty",
+			expected: `{
+				"mtu": 1460,
+				"default-address-pools": [{"base": "10.10.0.0/16", "size": 24}],
+				"registry-mirrors": ["https://mirror.example.com", "https://existing.example.com"],
+				"insecure-registries": ["registry.local:5000"]
+			}`,
+		},
+		{
+			// Settings that aren't managed are kept, lists are merged and
+			// existing pools win.
+			name: "Existing",
+			existing: `{
+				"log-driver": "local",
+				"mtu": 1500,
+				"default-address-pools": [{"base": "10.99.0.0/16", "size": 24}],
+				"registry-mirrors": ["https://existing.example.com"]
+			}`,
+			expected: `{
+				"log-driver": "local",
+				"mtu": 1460,
+				"default-address-pools": [{"base": "10.99.0.0/16", "size": 24}],
+				"registry-mirrors": ["https://existing.example.com", "https://mirror.example.com"],
+				"insecure-registries": ["registry.local:5000"]
+			}`,
+		},
+		{
+			name:     "OverridePools",
+			existing: `{"default-address-pools": [{"base": "10.99.0.0/16", "size": 24}]}`,
+			override: true,
+			expected: `{
+				"mtu": 1460,
+				"default-address-pools": [{"base": "10.10.0.0/16", "size": 24}],
+				"registry-mirrors": ["https://mirror.example.com", "https://existing.example.com"],
+				"insecure-registries": ["registry.local:5000"]
+			}`,
+		},
+	}
+
+	for _, tc := range testcases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			conf := conf
+			conf.OverrideAddressPools = tc.override
+			b, err := dockerutil.MergeDaemonConfig([]byte(tc.existing), conf)
+			require.NoError(t, err)
+			require.JSONEq(t, tc.expected, string(b))
+		})
+	}
+
+	t.Run("Invalid", func(t *testing.T) {
+		t.Parallel()
+
+		_, err := dockerutil.MergeDaemonConfig([]byte("{"), conf)
+		require.Error(t, err)
+	})
+}
@@ -25,6 +25,8 @@ var _ dockerutil.Client = MockClient{}
 // MockClient provides overrides for functions that are called in envbox.
 type MockClient struct {
 	ImagePullFn            func(_ context.Context, ref string, options image.PullOptions) (io.ReadCloser, error)
+	ImageLoadFn            func(_ context.Context, input io.Reader, _ ...dockerclient.ImageLoadOption) (image.LoadResponse, error)
+	ImageInspectFn         func(_ context.Context, image string) (image.InspectResponse, error)
 	ContainerCreateFn      func(_ context.Context, config *containertypes.Config, hostConfig *containertypes.HostConfig, networkingConfig *networktypes.NetworkingConfig, _ *specs.Platform, containerName string) (containertypes.CreateResponse, error)
 	ImagePruneFn           func(_ context.Context, pruneFilter filters.Args) (image.PruneReport, error)
 	ContainerStartFn       func(_ context.Context, container string, options containertypes.StartOptions) error
@@ -34,6 +36,11 @@ type MockClient struct {
 	ContainerExecInspectFn func(_ context.Context, execID string) (containertypes.ExecInspect, error)
 	ContainerInspectFn     func(_ context.Context, container string) (dockertypes.ContainerJSON, error)
 	ContainerRemoveFn      func(_ context.Context, container string, options containertypes.RemoveOptions) error
+	ContainerLogsFn        func(_ context.Context, container string, options containertypes.LogsOptions) (io.ReadCloser, error)
+	CopyToContainerFn      func(_ context.Context, container, path string, content io.Reader, options containertypes.CopyToContainerOptions) error
+	CopyFromContainerFn    func(_ context.Context, container, path string) (io.ReadCloser, containertypes.PathStat, error)
+	ContainerStatPathFn    func(_ context.Context, container, path string) (containertypes.PathStat, error)
+	ContainerUpdateFn      func(_ context.Context, container string, updateConfig containertypes.UpdateConfig) (containertypes.ContainerUpdateOKBody, error)
 	PingFn                 func(_ context.Context) (dockertypes.Ping, error)
 }
 
@@ -61,8 +68,11 @@ func (MockClient) ImageImport(_ context.Context, _ image.ImportSource, _ string,
 	panic("not implemented")
 }
 
-func (MockClient) ImageInspect(_ context.Context, _ string, _ ...dockerclient.ImageInspectOption) (image.InspectResponse, error) {
-	panic("not implemented")
+func (m MockClient) ImageInspect(ctx context.Context, img string, _ ...dockerclient.ImageInspectOption) (image.InspectResponse, error) {
+	if m.ImageInspectFn == nil {
+		return image.InspectResponse{}, nil
+	}
+	return m.ImageInspectFn(ctx, img)
 }
 
 func (MockClient) ImageInspectWithRaw(_ context.Context, _ string) (image.InspectResponse, []byte, error) {
@@ -73,8 +83,12 @@ func (MockClient) ImageList(_ context.Context, _ image.ListOptions) ([]image.Sum
 	panic("not implemented")
 }
 
-func (MockClient) ImageLoad(_ context.Context, _ io.Reader, _ ...dockerclient.ImageLoadOption) (image.LoadResponse, error) {
-	panic("not implemented")
+func (m MockClient) ImageLoad(ctx context.Context, input io.Reader, opts ...dockerclient.ImageLoadOption) (image.LoadResponse, error) {
+	if m.ImageLoadFn == nil {
+		_, _ = io.Copy(io.Discard, input)
+		return image.LoadResponse{Body: io.NopCloser(strings.NewReader(""))}, nil
+	}
+	return m.ImageLoadFn(ctx, input, opts...)
 }
 
 func (m MockClient) ImagePull(ctx context.Context, ref string, options image.PullOptions) (io.ReadCloser, error) {
@@ -211,8 +225,11 @@ func (MockClient) ContainerList(_ context.Context, _ containertypes.ListOptions)
 	panic("not implemented")
 }
 
-func (MockClient) ContainerLogs(_ context.Context, _ string, _ containertypes.LogsOptions) (io.ReadCloser, error) {
-	panic("not implemented")
+func (m MockClient) ContainerLogs(ctx context.Context, name string, options containertypes.LogsOptions) (io.ReadCloser, error) {
+	if m.ContainerLogsFn == nil {
+		return io.NopCloser(strings.NewReader("")), nil
+	}
+	return m.ContainerLogsFn(ctx, name, options)
 }
 
 func (MockClient) ContainerPause(_ context.Context, _ string) error {
@@ -238,8 +255,11 @@ func (MockClient) ContainerRestart(_ context.Context, _ string, _ containertypes
 	panic("not implemented")
 }
 
-func (MockClient) ContainerStatPath(_ context.Context, _ string, _ string) (containertypes.PathStat, error) {
-	panic("not implemented")
+func (m MockClient) ContainerStatPath(ctx context.Context, name, path string) (containertypes.PathStat, error) {
+	if m.ContainerStatPathFn == nil {
+		return containertypes.PathStat{}, nil
+	}
+	return m.ContainerStatPathFn(ctx, name, path)
 }
 
 func (MockClient) ContainerStats(_ context.Context, _ string, _ bool) (containertypes.StatsResponseReader, error) {
@@ -265,20 +285,30 @@ func (MockClient) ContainerUnpause(_ context.Context, _ string) error {
 	panic("not implemented")
 }
 
-func (MockClient) ContainerUpdate(_ context.Context, _ string, _ containertypes.UpdateConfig) (containertypes.ContainerUpdateOKBody, error) {
-	panic("not implemented")
+func (m MockClient) ContainerUpdate(ctx context.Context, name string, updateConfig containertypes.UpdateConfig) (containertypes.ContainerUpdateOKBody, error) {
+	if m.ContainerUpdateFn == nil {
+		return containertypes.ContainerUpdateOKBody{}, nil
+	}
+	return m.ContainerUpdateFn(ctx, name, updateConfig)
 }
 
 func (MockClient) ContainerWait(_ context.Context, _ string, _ containertypes.WaitCondition) (<-chan containertypes.WaitResponse, <-chan error) {
 	panic("not implemented")
 }
 
-func (MockClient) CopyFromContainer(_ context.Context, _ string, _ string) (io.ReadCloser, containertypes.PathStat, error) {
-	panic("not implemented")
+func (m MockClient) CopyFromContainer(ctx context.Context, name, path string) (io.ReadCloser, containertypes.PathStat, error) {
+	if m.CopyFromContainerFn == nil {
+		return io.NopCloser(strings.NewReader("")), containertypes.PathStat{}, nil
+	}
+	return m.CopyFromContainerFn(ctx, name, path)
 }
 
-func (MockClient) CopyToContainer(_ context.Context, _ string, _ string, _ io.Reader, _ containertypes.CopyToContainerOptions) error {
-	panic("not implemented")
+func (m MockClient) CopyToContainer(ctx context.Context, name, path string, content io.Reader, options containertypes.CopyToContainerOptions) error {
+	if m.CopyToContainerFn == nil {
+		_, _ = io.Copy(io.Discard, content)
+		return nil
+	}
+	return m.CopyToContainerFn(ctx, name, path, content, options)
 }
 
 func (MockClient) ContainersPrune(_ context.Context, _ filters.Args) (containertypes.PruneReport, error) {
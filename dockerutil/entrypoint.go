@@ -0,0 +1,120 @@
+package dockerutil
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+
+	"golang.org/x/xerrors"
+)
+
+// EntrypointMode dictates what the inner container runs as PID 1.
+type EntrypointMode string
+
+const (
+	// EntrypointAuto runs /sbin/init if the image has one, otherwise
+	// 'sleep infinity'.
+	EntrypointAuto EntrypointMode = "auto"
+	// EntrypointImage runs the ENTRYPOINT and CMD from the image's config.
+	EntrypointImage EntrypointMode = "image"
+	// EntrypointInit always runs /sbin/init.
+	EntrypointInit EntrypointMode = "init"
+	// EntrypointSleep always runs 'sleep infinity'.
+	EntrypointSleep EntrypointMode = "sleep"
+	// EntrypointCustom runs a user-provided command.
+	EntrypointCustom EntrypointMode = "custom"
+)
+
+var entrypointModes = []EntrypointMode{
+	EntrypointAuto,
+	EntrypointImage,
+	EntrypointInit,
+	EntrypointSleep,
+	EntrypointCustom,
+}
+
+// ParseEntrypointMode parses an entrypoint mode. An empty string is treated
+// as EntrypointAuto.
+func ParseEntrypointMode(s string) (EntrypointMode, error) {
+	if s == "" {
+		return EntrypointAuto, nil
+	}
+	for _, m := range entrypointModes {
+		if string(m) == s {
+			return m, nil
+		}
+	}
+	return "", xerrors.Errorf("unknown entrypoint mode %q, must be one of %v", s, entrypointModes)
+}
+
+// ParseEntrypointCommand parses a custom entrypoint command. Like a
+// Dockerfile ENTRYPOINT, a JSON array is used as-is (exec form) and
+// anything else is run with '/bin/sh -c' (shell form).
+func ParseEntrypointCommand(s string) ([]string, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return nil, xerrors.New("entrypoint command is empty")
+	}
+
+	if strings.HasPrefix(s, "[") {
+		var cmd []string
+		err := json.Unmarshal([]byte(s), &cmd)
+		if err != nil {
+			return nil, xerrors.Errorf("parse exec form: %w", err)
+		}
+		if len(cmd) == 0 {
+			return nil, xerrors.New("entrypoint command is empty")
+		}
+		return cmd, nil
+	}
+
+	return []string{"/bin/sh", "-c", s}, nil
+}
+
+// containerEntrypoint returns the entrypoint, cmd and stop signal for the
+// inner container based on conf.Entrypoint.
+func containerEntrypoint(ctx context.Context, client Client, conf *ContainerConfig) ([]string, []string, string, error) {
+	sleep := []string{"sleep", "infinity"}
+
+	switch conf.Entrypoint {
+	case EntrypointAuto, "":
+		if ep := conf.Init.Entrypoint(conf.InitPath); ep != nil {
+			return ep, []string{}, conf.Init.StopSignal(), nil
+		}
+		return sleep, []string{}, "", nil
+	case EntrypointInit:
+		initSys := conf.Init
+		if initSys == "" || initSys == InitNone {
+			initSys = InitUnknown
+		}
+		return initSys.Entrypoint(conf.InitPath), []string{}, initSys.StopSignal(), nil
+	case EntrypointSleep:
+		return sleep, []string{}, "", nil
+	case EntrypointCustom:
+		if len(conf.EntrypointCmd) == 0 {
+			return nil, nil, "", xerrors.Errorf("entrypoint mode %q requires a command", EntrypointCustom)
+		}
+		return conf.EntrypointCmd, []string{}, "", nil
+	case EntrypointImage:
+		inspect, err := client.ImageInspect(ctx, conf.Image)
+		if err != nil {
+			return nil, nil, "", xerrors.Errorf("inspect image: %w", err)
+		}
+		if inspect.Config == nil || (len(inspect.Config.Entrypoint) == 0 && len(inspect.Config.Cmd) == 0) {
+			return nil, nil, "", xerrors.Errorf("image %q does not define an ENTRYPOINT or CMD", conf.Image)
+		}
+		// Docker treats a nil slice as "use the image's value", we pass
+		// them explicitly so that the values we log are what runs.
+		entrypoint := inspect.Config.Entrypoint
+		if entrypoint == nil {
+			entrypoint = []string{}
+		}
+		cmd := inspect.Config.Cmd
+		if cmd == nil {
+			cmd = []string{}
+		}
+		return entrypoint, cmd, inspect.Config.StopSignal, nil
+	default:
+		return nil, nil, "", xerrors.Errorf("unknown entrypoint mode %q", conf.Entrypoint)
+	}
+}
@@ -3,6 +3,7 @@ package dockerutil
 import (
 	"bytes"
 	"context"
+	"fmt"
 	"io"
 	"time"
 
@@ -89,12 +90,23 @@ func ExecContainer(ctx context.Context, client Client, config ExecConfig) ([]byt
 	}
 
 	if inspect.ExitCode > 0 {
-		return nil, xerrors.Errorf("%s: exit code %d", buf.Bytes(), inspect.ExitCode)
+		return nil, &ExecError{Output: buf.Bytes(), ExitCode: inspect.ExitCode}
 	}
 
 	return buf.Bytes(), nil
 }
 
+// ExecError is returned by ExecContainer when the command exits with a
+// non-zero exit code.
+type ExecError struct {
+	Output   []byte
+	ExitCode int
+}
+
+func (e *ExecError) Error() string {
+	return fmt.Sprintf("%s: exit code %d", e.Output, e.ExitCode)
+}
+
 func GetExecPID(ctx context.Context, client Client, execID string) (int, error) {
 	for r := retry.New(time.Second, time.Second); r.Wait(ctx); {
 		inspect, err := client.ContainerExecInspect(ctx, execID)
@@ -6,6 +6,9 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"os"
+	"path"
+	"slices"
 	"strings"
 	"time"
 
@@ -45,6 +48,11 @@ type PullImageConfig struct {
 	Image      string
 	Auth       AuthConfig
 	ProgressFn ImagePullProgressFn
+	// CacheDir is an optional OCI image layout populated by 'envbox prepull'.
+	// If the image is found in the cache it is loaded from there instead of
+	// being pulled from the registry.
+	CacheDir string
+	Log      slog.Logger
 }
 
 type ImagePullEvent struct {
@@ -61,8 +69,32 @@ type ImagePullEvent struct {
 // image pull progress.
 type ImagePullProgressFn func(e ImagePullEvent) error
 
-// PullImage pulls the provided image.
+// PullImage pulls the provided image. If config.CacheDir is set the image is
+// loaded from the cache when present, falling back to the registry on any
+// error.
 func PullImage(ctx context.Context, config *PullImageConfig) error {
+	if config.CacheDir != "" {
+		loaded, err := LoadCachedImage(ctx, config.Client, config.CacheDir, config.Image)
+		if err != nil {
+			config.Log.Warn(ctx, "failed to load image from cache, pulling from registry",
+				slog.F("cache_dir", config.CacheDir),
+				slog.F("image", config.Image),
+				slog.Error(err),
+			)
+		}
+		if loaded {
+			if config.ProgressFn != nil {
+				err = config.ProgressFn(ImagePullEvent{
+					Status: fmt.Sprintf("Loaded %s from image cache", config.Image),
+				})
+				if err != nil {
+					return xerrors.Errorf("process image pull event: %w", err)
+				}
+			}
+			return nil
+		}
+	}
+
 	authStr, err := config.Auth.Base64()
 	if err != nil {
 		return xerrors.Errorf("base64 encode auth: %w", err)
@@ -166,16 +198,189 @@ func processImagePullEvents(r io.Reader, fn ImagePullProgressFn) error {
 }
 
 type ImageMetadata struct {
-	UID         string
-	GID         string
-	HomeDir     string
-	HasInit     bool
+	UID     string
+	GID     string
+	HomeDir string
+	// HasInit is true if the image has an init that supervises services.
+	HasInit bool
+	// Init is the init system detected in the image and InitPath the path
+	// to boot it from.
+	Init        InitSystem
+	InitPath    string
 	OsReleaseID string
+	// Groups are the GIDs of the user's supplementary groups.
+	Groups []string
+	// GroupGIDs maps the names of the image's groups to their GIDs.
+	GroupGIDs map[string]string
+	// HasDockerd is true if the image ships dockerd. DockerGID is the GID
+	// of the image's docker group if it has one.
+	HasDockerd bool
+	DockerGID  string
+}
+
+// DockerGroup is the group that may use the inner Docker daemon's socket.
+const DockerGroup = "docker"
+
+var dockerdPaths = []string{
+	"/usr/bin/dockerd",
+	"/usr/local/bin/dockerd",
+	"/usr/sbin/dockerd",
+}
+
+// detectDockerd returns true if the image contains dockerd.
+func detectDockerd(p initProber) bool {
+	for _, dockerd := range dockerdPaths {
+		if _, err := p.Realpath(dockerd); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// groupGID returns the GID of the group with the given name.
+func groupGID(groups []*xunix.Group, name string) string {
+	for _, g := range groups {
+		if g.Name == name {
+			return g.Gid
+		}
+	}
+	return ""
+}
+
+// groupGIDs returns the GIDs of groups keyed by their names.
+func groupGIDs(groups []*xunix.Group) map[string]string {
+	if len(groups) == 0 {
+		return nil
+	}
+	gids := make(map[string]string, len(groups))
+	for _, g := range groups {
+		if _, ok := gids[g.Name]; !ok {
+			gids[g.Name] = g.Gid
+		}
+	}
+	return gids
+}
+
+// userGroups returns the GIDs of the groups username is a supplementary
+// member of, excluding its primary group.
+func userGroups(groups []*xunix.Group, username, gid string) []string {
+	var gids []string
+	for _, g := range groups {
+		if g.Gid == gid || slices.Contains(gids, g.Gid) || !slices.Contains(g.Members, username) {
+			continue
+		}
+		gids = append(gids, g.Gid)
+	}
+	return gids
 }
 
+// ErrUserNotFound is returned by GetImageMetadata if the image doesn't
+// contain the requested user.
+var ErrUserNotFound = xerrors.New("user not found")
+
 // GetImageMetadata returns metadata about an image such as the UID/GID of the
 // provided username and whether it contains an /sbin/init that we should run.
+// If the user doesn't exist the metadata of the image is returned without the
+// user's along with an error wrapping ErrUserNotFound.
+// The image's filesystem is read directly from the storage driver when
+// possible, otherwise a throwaway container is started to probe it.
 func GetImageMetadata(ctx context.Context, log slog.Logger, client Client, img, username string) (ImageMetadata, error) {
+	meta, err := imageMetadataFromFS(ctx, log, client, img, username)
+	if err == nil || xerrors.Is(err, ErrUserNotFound) {
+		return meta, err
+	}
+	log.Info(ctx, "unable to read image metadata from image filesystem, falling back to container probe",
+		slog.F("image", img),
+		slog.Error(err),
+	)
+
+	return imageMetadataFromExec(ctx, log, client, img, username)
+}
+
+// imageMetadataFromFS reads image metadata from the image's layers on disk.
+// This avoids starting a container and works for images that don't ship
+// the binaries the container probe depends on (e.g. distroless).
+func imageMetadataFromFS(ctx context.Context, log slog.Logger, client Client, img, username string) (ImageMetadata, error) {
+	ifs, err := newImageFS(ctx, client, img)
+	if err != nil {
+		return ImageMetadata{}, xerrors.Errorf("image fs: %w", err)
+	}
+
+	initSys, initPath := detectInit(ifs)
+
+	// Minimal images frequently don't ship an os-release so we only
+	// complain if it exists and we fail to read it.
+	osReleaseID := "linux"
+	out, err := ifs.ReadFile(etcOsRelease)
+	switch {
+	case xerrors.Is(err, os.ErrNotExist):
+		log.Info(ctx, "image has no os-release, falling back to linux for os-release ID")
+	case err != nil:
+		log.Error(ctx, "read os-release", slog.Error(err))
+		log.Error(ctx, "falling back to linux for os-release ID")
+	default:
+		osReleaseID = GetOSReleaseID(out)
+	}
+
+	meta := ImageMetadata{
+		HasInit:     initSys.IsServiceManager(),
+		Init:        initSys,
+		InitPath:    initPath,
+		OsReleaseID: osReleaseID,
+		HasDockerd:  detectDockerd(ifs),
+	}
+
+	// Images don't need an /etc/group, the user just won't have any
+	// supplementary groups.
+	var groups []*xunix.Group
+	group, err := ifs.ReadFile("/etc/group")
+	switch {
+	case xerrors.Is(err, os.ErrNotExist):
+	case err != nil:
+		return ImageMetadata{}, xerrors.Errorf("read /etc/group: %w", err)
+	default:
+		groups, err = xunix.ParseGroup(bytes.NewReader(group))
+		if err != nil {
+			return ImageMetadata{}, xerrors.Errorf("parse /etc/group: %w", err)
+		}
+	}
+	meta.DockerGID = groupGID(groups, DockerGroup)
+	meta.GroupGIDs = groupGIDs(groups)
+
+	passwd, err := ifs.ReadFile("/etc/passwd")
+	if xerrors.Is(err, os.ErrNotExist) {
+		return meta, xerrors.Errorf("no /etc/passwd: %w", ErrUserNotFound)
+	}
+	if err != nil {
+		return ImageMetadata{}, xerrors.Errorf("read /etc/passwd: %w", err)
+	}
+
+	users, err := xunix.ParsePasswd(bytes.NewReader(passwd))
+	if err != nil {
+		return ImageMetadata{}, xerrors.Errorf("parse /etc/passwd: %w", err)
+	}
+
+	var user *xunix.User
+	for _, u := range users {
+		if u.Username == username {
+			user = u
+			break
+		}
+	}
+	if user == nil {
+		return meta, xerrors.Errorf("no /etc/passwd entry for username %s: %w", username, ErrUserNotFound)
+	}
+
+	meta.UID = user.Uid
+	meta.GID = user.Gid
+	meta.HomeDir = user.HomeDir
+	meta.Groups = userGroups(groups, username, user.Gid)
+	return meta, nil
+}
+
+// imageMetadataFromExec starts a throwaway container from the image and
+// executes commands inside it to determine its metadata.
+func imageMetadataFromExec(ctx context.Context, log slog.Logger, client Client, img, username string) (ImageMetadata, error) {
 	// Creating a dummy container to inspect the filesystem.
 	created, err := client.ContainerCreate(ctx,
 		&container.Config{
@@ -221,18 +426,60 @@ func GetImageMetadata(ctx context.Context, log slog.Logger, client Client, img,
 		return ImageMetadata{}, xerrors.Errorf("CVMs do not support NFS volumes")
 	}
 
-	_, err = ExecContainer(ctx, client, ExecConfig{
+	prober := execProber{ctx: ctx, client: client, containerID: inspect.ID}
+	initSys, initPath := detectInit(prober)
+
+	// Read the /etc/os-release file to get the ID of the OS.
+	// We only care about the ID field.
+	var osReleaseID string
+	out, err := ExecContainer(ctx, client, ExecConfig{
 		ContainerID: inspect.ID,
-		Cmd:         "stat",
-		Args:        []string{"/sbin/init"},
+		Cmd:         "cat",
+		Args:        []string{etcOsRelease},
 	})
-	initExists := err == nil
+	if err != nil {
+		log.Error(ctx, "read os-release", slog.Error(err))
+		log.Error(ctx, "falling back to linux for os-release ID")
+		osReleaseID = "linux"
+	} else {
+		osReleaseID = GetOSReleaseID(out)
+	}
 
-	out, err := ExecContainer(ctx, client, ExecConfig{
+	meta := ImageMetadata{
+		HasInit:     initSys.IsServiceManager(),
+		Init:        initSys,
+		InitPath:    initPath,
+		OsReleaseID: osReleaseID,
+		HasDockerd:  detectDockerd(prober),
+	}
+
+	// Failing to list the groups only costs the user its supplementary
+	// groups.
+	var groups []*xunix.Group
+	out, err = ExecContainer(ctx, client, ExecConfig{
+		ContainerID: inspect.ID,
+		Cmd:         "getent",
+		Args:        []string{"group"},
+	})
+	if err == nil {
+		groups, err = xunix.ParseGroup(bytes.NewReader(out))
+	}
+	if err != nil {
+		log.Error(ctx, "list groups", slog.Error(err))
+	}
+	meta.DockerGID = groupGID(groups, DockerGroup)
+	meta.GroupGIDs = groupGIDs(groups)
+
+	out, err = ExecContainer(ctx, client, ExecConfig{
 		ContainerID: inspect.ID,
 		Cmd:         "getent",
 		Args:        []string{"passwd", username},
 	})
+	var execErr *ExecError
+	// getent exits with 2 if the key wasn't found.
+	if xerrors.As(err, &execErr) && execErr.ExitCode == 2 {
+		return meta, xerrors.Errorf("no /etc/passwd entry for username %s: %w", username, ErrUserNotFound)
+	}
 	if err != nil {
 		return ImageMetadata{}, xerrors.Errorf("get /etc/passwd entry for %s: %w", username, err)
 	}
@@ -242,32 +489,44 @@ func GetImageMetadata(ctx context.Context, log slog.Logger, client Client, img,
 		return ImageMetadata{}, xerrors.Errorf("parse passwd entry for (%s): %w", out, err)
 	}
 	if len(users) == 0 {
-		return ImageMetadata{}, xerrors.Errorf("no users returned for username %s", username)
+		return meta, xerrors.Errorf("no users returned for username %s: %w", username, ErrUserNotFound)
 	}
 
-	// Read the /etc/os-release file to get the ID of the OS.
-	// We only care about the ID field.
-	var osReleaseID string
-	out, err = ExecContainer(ctx, client, ExecConfig{
-		ContainerID: inspect.ID,
-		Cmd:         "cat",
-		Args:        []string{etcOsRelease},
+	meta.UID = users[0].Uid
+	meta.GID = users[0].Gid
+	meta.HomeDir = users[0].HomeDir
+	meta.Groups = userGroups(groups, username, users[0].Gid)
+	return meta, nil
+}
+
+// execProber resolves paths by executing commands in a running container.
+type execProber struct {
+	ctx         context.Context
+	client      Client
+	containerID string
+}
+
+func (e execProber) Realpath(p string) (string, error) {
+	_, err := ExecContainer(e.ctx, e.client, ExecConfig{
+		ContainerID: e.containerID,
+		Cmd:         "stat",
+		Args:        []string{"-L", p},
 	})
 	if err != nil {
-		log.Error(ctx, "read os-release", slog.Error(err))
-		log.Error(ctx, "falling back to linux for os-release ID")
-		osReleaseID = "linux"
-	} else {
-		osReleaseID = GetOSReleaseID(out)
+		return "", xerrors.Errorf("stat %s: %w", p, err)
 	}
 
-	return ImageMetadata{
-		UID:         users[0].Uid,
-		GID:         users[0].Gid,
-		HomeDir:     users[0].HomeDir,
-		HasInit:     initExists,
-		OsReleaseID: osReleaseID,
-	}, nil
+	// readlink may not exist in the image, we already know the path exists
+	// so fall back to the unresolved path.
+	out, err := ExecContainer(e.ctx, e.client, ExecConfig{
+		ContainerID: e.containerID,
+		Cmd:         "readlink",
+		Args:        []string{"-f", p},
+	})
+	if resolved := strings.TrimSpace(string(out)); err == nil && path.IsAbs(resolved) {
+		return resolved, nil
+	}
+	return p, nil
 }
 
 // UsrLibDir returns the path to the /usr/lib directory for the given
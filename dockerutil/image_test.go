@@ -0,0 +1,335 @@
+package dockerutil_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/image"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/api/types/storage"
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/xerrors"
+
+	"cdr.dev/slog/v3/sloggers/slogtest"
+	"github.com/coder/envbox/dockerutil"
+	"github.com/coder/envbox/dockerutil/dockerfake"
+)
+
+func TestGetImageMetadata(t *testing.T) {
+	t.Parallel()
+
+	t.Run("ImageFS", func(t *testing.T) {
+		t.Parallel()
+
+		var (
+			ctx   = context.Background()
+			log   = slogtest.Make(t, nil)
+			lower = t.TempDir()
+			upper = t.TempDir()
+		)
+
+		// The lower layer mimics a merged-usr distro where /sbin is a
+		// relative symlink and /sbin/init is an absolute one.
+		writeFile(t, lower, "etc/passwd", "root:x:0:0:root:/root:/bin/bash\n")
+		writeFile(t, lower, "usr/lib/os-release", "NAME=\"Ubuntu\"\nID=ubuntu\n")
+		writeFile(t, lower, "usr/lib/systemd/systemd", "")
+		symlink(t, lower, "sbin", "usr/sbin")
+		symlink(t, lower, "usr/sbin/init", "/usr/lib/systemd/systemd")
+		symlink(t, lower, "etc/os-release", "../usr/lib/os-release")
+
+		// The upper layer adds a user, shadowing the lower /etc/passwd.
+		writeFile(t, upper, "etc/passwd", "root:x:0:0:root:/root:/bin/bash\n\ncoder:x:1000:1001:coder:/home/coder:/bin/bash\n")
+
+		client := imageFSClient(t, upper, lower)
+		meta, err := dockerutil.GetImageMetadata(ctx, log, client, "test-image", "coder")
+		require.NoError(t, err)
+		require.Equal(t, dockerutil.ImageMetadata{
+			UID:         "1000",
+			GID:         "1001",
+			HomeDir:     "/home/coder",
+			HasInit:     true,
+			Init:        dockerutil.InitSystemd,
+			InitPath:    "/sbin/init",
+			OsReleaseID: "ubuntu",
+		}, meta)
+	})
+
+	t.Run("ImageFSNoInit", func(t *testing.T) {
+		t.Parallel()
+
+		var (
+			ctx   = context.Background()
+			log   = slogtest.Make(t, nil)
+			upper = t.TempDir()
+		)
+
+		// Distroless-style images don't ship an os-release or an init.
+		writeFile(t, upper, "etc/passwd", "root:x:0:0:root:/root:/sbin/nologin\nnonroot:x:65532:65532:nonroot:/home/nonroot:/sbin/nologin\n")
+		// A dangling init symlink should not be treated as present.
+		symlink(t, upper, "sbin/init", "/lib/systemd/systemd")
+
+		client := imageFSClient(t, upper)
+		meta, err := dockerutil.GetImageMetadata(ctx, log, client, "test-image", "nonroot")
+		require.NoError(t, err)
+		require.Equal(t, dockerutil.ImageMetadata{
+			UID:         "65532",
+			GID:         "65532",
+			HomeDir:     "/home/nonroot",
+			HasInit:     false,
+			Init:        dockerutil.InitNone,
+			OsReleaseID: "linux",
+		}, meta)
+	})
+
+	t.Run("ImageFSGroups", func(t *testing.T) {
+		t.Parallel()
+
+		var (
+			ctx   = context.Background()
+			log   = slogtest.Make(t, nil)
+			upper = t.TempDir()
+		)
+
+		writeFile(t, upper, "etc/passwd", "coder:x:1000:1000::/home/coder:/bin/bash\n")
+		writeFile(t, upper, "etc/group", "coder:x:1000:coder\nsudo:x:27:admin,coder\ndocker:x:998:\nvideo:x:44:admin\n")
+		writeFile(t, upper, "usr/bin/dockerd", "")
+
+		client := imageFSClient(t, upper)
+		meta, err := dockerutil.GetImageMetadata(ctx, log, client, "test-image", "coder")
+		require.NoError(t, err)
+		// The primary group isn't a supplementary group.
+		require.Equal(t, []string{"27"}, meta.Groups)
+		require.Equal(t, map[string]string{"coder": "1000", "sudo": "27", "docker": "998", "video": "44"}, meta.GroupGIDs)
+		require.True(t, meta.HasDockerd)
+		require.Equal(t, "998", meta.DockerGID)
+	})
+
+	t.Run("ImageFSUserNotFound", func(t *testing.T) {
+		t.Parallel()
+
+		var (
+			ctx   = context.Background()
+			log   = slogtest.Make(t, nil)
+			upper = t.TempDir()
+		)
+
+		writeFile(t, upper, "etc/passwd", "root:x:0:0:root:/root:/bin/ash\n")
+		writeFile(t, upper, "etc/os-release", "ID=alpine\n")
+
+		// The image's metadata is returned without falling back to a
+		// container probe.
+		client := imageFSClient(t, upper)
+		meta, err := dockerutil.GetImageMetadata(ctx, log, client, "test-image", "coder")
+		require.True(t, xerrors.Is(err, dockerutil.ErrUserNotFound))
+		require.Equal(t, dockerutil.ImageMetadata{
+			Init:        dockerutil.InitNone,
+			OsReleaseID: "alpine",
+		}, meta)
+	})
+
+	t.Run("ImageFSWhiteout", func(t *testing.T) {
+		t.Parallel()
+
+		var (
+			ctx   = context.Background()
+			log   = slogtest.Make(t, nil)
+			lower = t.TempDir()
+			upper = t.TempDir()
+		)
+
+		writeFile(t, lower, "etc/passwd", "coder:x:1000:1000:coder:/home/coder:/bin/bash\n")
+		writeFile(t, lower, "sbin/init", "")
+		// Removing /sbin/init in the upper layer should hide it.
+		writeFile(t, upper, "sbin/.wh.init", "")
+
+		client := imageFSClient(t, upper, lower)
+		meta, err := dockerutil.GetImageMetadata(ctx, log, client, "test-image", "coder")
+		require.NoError(t, err)
+		require.False(t, meta.HasInit)
+	})
+
+	t.Run("ImageFSOpaque", func(t *testing.T) {
+		t.Parallel()
+
+		var (
+			ctx    = context.Background()
+			log    = slogtest.Make(t, nil)
+			lower  = t.TempDir()
+			middle = t.TempDir()
+			upper  = t.TempDir()
+		)
+
+		writeFile(t, lower, "etc/passwd", "coder:x:1000:1000:coder:/home/coder:/bin/bash\n")
+		writeFile(t, lower, "sbin/init", "")
+		writeFile(t, lower, "usr/bin/tini", "")
+		// Recreating /sbin should hide the files below it.
+		writeFile(t, middle, "sbin/.wh..wh..opq", "")
+		writeFile(t, middle, "sbin/other", "")
+		// An opaque /usr should hide everything below it, not just its
+		// direct children.
+		writeFile(t, upper, "usr/.wh..wh..opq", "")
+		writeFile(t, upper, "usr/bin/other", "")
+
+		client := imageFSClient(t, upper, middle, lower)
+		meta, err := dockerutil.GetImageMetadata(ctx, log, client, "test-image", "coder")
+		require.NoError(t, err)
+		require.Equal(t, "1000", meta.UID)
+		require.Equal(t, dockerutil.InitNone, meta.Init)
+	})
+
+	t.Run("InitDetection", func(t *testing.T) {
+		t.Parallel()
+
+		type testcase struct {
+			name         string
+			setup        func(t *testing.T, root string)
+			expectedInit dockerutil.InitSystem
+			expectedPath string
+		}
+
+		testcases := []testcase{
+			{
+				name: "Busybox",
+				setup: func(t *testing.T, root string) {
+					writeFile(t, root, "bin/busybox", "")
+					symlink(t, root, "sbin/init", "/bin/busybox")
+				},
+				expectedInit: dockerutil.InitBusybox,
+				expectedPath: "/sbin/init",
+			},
+			{
+				name: "OpenRC",
+				setup: func(t *testing.T, root string) {
+					writeFile(t, root, "sbin/openrc-init", "")
+				},
+				expectedInit: dockerutil.InitOpenRC,
+				expectedPath: "/sbin/openrc-init",
+			},
+			{
+				name: "S6Overlay",
+				setup: func(t *testing.T, root string) {
+					writeFile(t, root, "bin/busybox", "")
+					symlink(t, root, "sbin/init", "/bin/busybox")
+					writeFile(t, root, "init", "")
+					writeFile(t, root, "package/admin/s6-overlay/VERSION", "")
+				},
+				expectedInit: dockerutil.InitS6,
+				expectedPath: "/init",
+			},
+			{
+				name: "Tini",
+				setup: func(t *testing.T, root string) {
+					writeFile(t, root, "usr/bin/tini", "")
+				},
+				expectedInit: dockerutil.InitTini,
+				expectedPath: "/usr/bin/tini",
+			},
+			{
+				name: "Unknown",
+				setup: func(t *testing.T, root string) {
+					writeFile(t, root, "sbin/init", "")
+				},
+				expectedInit: dockerutil.InitUnknown,
+				expectedPath: "/sbin/init",
+			},
+			{
+				name: "BrokenSymlink",
+				setup: func(t *testing.T, root string) {
+					symlink(t, root, "sbin/init", "../lib/systemd/systemd")
+				},
+				expectedInit: dockerutil.InitNone,
+			},
+		}
+
+		for _, tc := range testcases {
+			tc := tc
+			t.Run(tc.name, func(t *testing.T) {
+				t.Parallel()
+
+				var (
+					ctx  = context.Background()
+					log  = slogtest.Make(t, nil)
+					root = t.TempDir()
+				)
+
+				writeFile(t, root, "etc/passwd", "root:x:0:0:root:/root:/bin/sh\n")
+				writeFile(t, root, "etc/os-release", "ID=alpine\n")
+				tc.setup(t, root)
+
+				meta, err := dockerutil.GetImageMetadata(ctx, log, imageFSClient(t, root), "test-image", "root")
+				require.NoError(t, err)
+				require.Equal(t, tc.expectedInit, meta.Init)
+				require.Equal(t, tc.expectedPath, meta.InitPath)
+				require.Equal(t, tc.expectedInit.IsServiceManager(), meta.HasInit)
+			})
+		}
+	})
+
+	t.Run("FallbackToExec", func(t *testing.T) {
+		t.Parallel()
+
+		var (
+			ctx     = context.Background()
+			log     = slogtest.Make(t, nil)
+			created bool
+		)
+
+		// The default mock reports no storage driver so we should fall
+		// back to probing a container.
+		client := dockerfake.MockClient{
+			ContainerCreateFn: func(_ context.Context, _ *container.Config, _ *container.HostConfig, _ *network.NetworkingConfig, _ *specs.Platform, _ string) (container.CreateResponse, error) {
+				created = true
+				return container.CreateResponse{}, xerrors.New("boom")
+			},
+		}
+		_, err := dockerutil.GetImageMetadata(ctx, log, client, "test-image", "root")
+		require.ErrorContains(t, err, "create container")
+		require.True(t, created)
+	})
+}
+
+func imageFSClient(t *testing.T, layers ...string) dockerfake.MockClient {
+	t.Helper()
+
+	return dockerfake.MockClient{
+		ImageInspectFn: func(_ context.Context, _ string) (image.InspectResponse, error) {
+			data := map[string]string{
+				"UpperDir": layers[0],
+			}
+			if len(layers) > 1 {
+				data["LowerDir"] = strings.Join(layers[1:], ":")
+			}
+			return image.InspectResponse{
+				GraphDriver: storage.DriverData{
+					Name: "overlay2",
+					Data: data,
+				},
+			}, nil
+		},
+		ContainerCreateFn: func(_ context.Context, _ *container.Config, _ *container.HostConfig, _ *network.NetworkingConfig, _ *specs.Platform, _ string) (container.CreateResponse, error) {
+			t.Fatal("unexpected container create")
+			return container.CreateResponse{}, nil
+		},
+	}
+}
+
+func writeFile(t *testing.T, root, name, content string) {
+	t.Helper()
+
+	p := filepath.Join(root, name)
+	require.NoError(t, os.MkdirAll(filepath.Dir(p), 0o755))
+	require.NoError(t, os.WriteFile(p, []byte(content), 0o644))
+}
+
+func symlink(t *testing.T, root, name, target string) {
+	t.Helper()
+
+	p := filepath.Join(root, name)
+	require.NoError(t, os.MkdirAll(filepath.Dir(p), 0o755))
+	require.NoError(t, os.Symlink(target, p))
+}
@@ -0,0 +1,248 @@
+package dockerutil
+
+import (
+	"context"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/spf13/afero"
+	"golang.org/x/xerrors"
+
+	"github.com/coder/envbox/xunix"
+)
+
+const (
+	overlayStorageDriver = "overlay2"
+	// whiteoutPrefix is used by aufs-style layers to mark a deleted file.
+	// overlay2 uses a 0/0 character device instead but we check for both
+	// to be safe.
+	whiteoutPrefix = ".wh."
+	// opaqueWhiteout is created in a directory by aufs-style layers to hide
+	// the contents of the directory in lower layers.
+	opaqueWhiteout = whiteoutPrefix + whiteoutPrefix + ".opq"
+	// maxSymlinkHops mirrors the kernel's limit before returning ELOOP.
+	maxSymlinkHops = 40
+)
+
+// opaqueXattrs mark a directory as opaque in overlay2 layers. The user
+// namespace variant is used by rootless overlayfs.
+var opaqueXattrs = []string{"trusted.overlay.opaque", "user.overlay.opaque"}
+
+// xattrFS is implemented by filesystems that can read extended attributes.
+type xattrFS interface {
+	Lgetxattr(path, attr string) ([]byte, error)
+}
+
+// imageFS provides read-only access to the merged view of an image's
+// layers without mounting them. Layers are ordered from top-most to
+// bottom-most.
+type imageFS struct {
+	fs     xunix.FS
+	layers []string
+}
+
+// newImageFS returns an imageFS for the provided image using the layer
+// directories reported by the storage driver. Only overlay2 is supported.
+func newImageFS(ctx context.Context, client Client, img string) (*imageFS, error) {
+	inspect, err := client.ImageInspect(ctx, img)
+	if err != nil {
+		return nil, xerrors.Errorf("inspect image: %w", err)
+	}
+
+	if inspect.GraphDriver.Name != overlayStorageDriver {
+		return nil, xerrors.Errorf("unsupported storage driver %q", inspect.GraphDriver.Name)
+	}
+
+	upper := inspect.GraphDriver.Data["UpperDir"]
+	if upper == "" {
+		return nil, xerrors.Errorf("storage driver did not report an upper dir")
+	}
+
+	layers := []string{upper}
+	if lower := inspect.GraphDriver.Data["LowerDir"]; lower != "" {
+		layers = append(layers, strings.Split(lower, ":")...)
+	}
+
+	return &imageFS{
+		fs:     xunix.GetFS(ctx),
+		layers: layers,
+	}, nil
+}
+
+// ReadFile reads the file at the provided path in the image, following
+// symlinks relative to the root of the image.
+func (i *imageFS) ReadFile(p string) ([]byte, error) {
+	_, hostPath, fi, err := i.resolve(p)
+	if err != nil {
+		return nil, err
+	}
+	if fi.IsDir() {
+		return nil, xerrors.Errorf("%s is a directory", p)
+	}
+
+	b, err := afero.ReadFile(i.fs, hostPath)
+	if err != nil {
+		return nil, xerrors.Errorf("read %s: %w", p, err)
+	}
+	return b, nil
+}
+
+// Exists returns whether the provided path exists in the image after
+// following symlinks.
+func (i *imageFS) Exists(p string) (bool, error) {
+	_, err := i.Realpath(p)
+	if err == nil {
+		return true, nil
+	}
+	if xerrors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	return false, err
+}
+
+// Realpath returns the path in the image that p resolves to after
+// following symlinks. It returns an error wrapping os.ErrNotExist if p does
+// not exist or is a dangling symlink.
+func (i *imageFS) Realpath(p string) (string, error) {
+	resolved, _, _, err := i.resolve(p)
+	return resolved, err
+}
+
+// resolve walks the provided path one component at a time, following
+// symlinks relative to the root of the image. It returns the resolved path
+// in the image along with the location of the top-most layer entry for it.
+func (i *imageFS) resolve(p string) (string, string, fs.FileInfo, error) {
+	var (
+		components = splitPath(p)
+		resolved   = "/"
+		hostPath   = ""
+		info       fs.FileInfo
+		hops       = 0
+	)
+
+	if len(components) == 0 {
+		hostPath, info, err := i.lstat(resolved)
+		return resolved, hostPath, info, err
+	}
+
+	for len(components) > 0 {
+		c := components[0]
+		components = components[1:]
+
+		if c == ".." {
+			resolved = path.Dir(resolved)
+			hostPath, info = "", nil
+			continue
+		}
+
+		cur := path.Join(resolved, c)
+		hp, fi, err := i.lstat(cur)
+		if err != nil {
+			return "", "", nil, err
+		}
+
+		if fi.Mode()&fs.ModeSymlink != 0 {
+			hops++
+			if hops > maxSymlinkHops {
+				return "", "", nil, xerrors.Errorf("resolve %s: too many levels of symbolic links", p)
+			}
+			target, err := i.fs.Readlink(hp)
+			if err != nil {
+				return "", "", nil, xerrors.Errorf("readlink %s: %w", cur, err)
+			}
+			if path.IsAbs(target) {
+				resolved = "/"
+			}
+			components = append(splitPath(target), components...)
+			hostPath, info = "", nil
+			continue
+		}
+
+		resolved, hostPath, info = cur, hp, fi
+	}
+
+	// A trailing '..' leaves us pointing at a directory we haven't stat'd.
+	if info == nil {
+		hostPath, info, err := i.lstat(resolved)
+		return resolved, hostPath, info, err
+	}
+	return resolved, hostPath, info, nil
+}
+
+// lstat returns the top-most layer entry for the provided path without
+// following a symlink in the final component. It assumes that the parent
+// directories of p have already been resolved. Layers below one that
+// deletes p or makes one of its parent directories opaque are skipped.
+func (i *imageFS) lstat(p string) (string, fs.FileInfo, error) {
+	dir, base := path.Split(p)
+	for _, layer := range i.layers {
+		hostPath := filepath.Join(layer, p)
+		fi, err := i.fs.LStat(hostPath)
+		if err == nil {
+			if isWhiteout(fi) {
+				break
+			}
+			return hostPath, fi, nil
+		}
+		if !xerrors.Is(err, os.ErrNotExist) {
+			return "", nil, xerrors.Errorf("lstat %s: %w", hostPath, err)
+		}
+
+		_, err = i.fs.LStat(filepath.Join(layer, dir, whiteoutPrefix+base))
+		if err == nil {
+			break
+		}
+		if i.hasOpaqueParent(layer, p) {
+			break
+		}
+	}
+
+	return "", nil, &fs.PathError{Op: "lstat", Path: p, Err: os.ErrNotExist}
+}
+
+// hasOpaqueParent returns whether one of the parent directories of p is
+// opaque in layer, hiding p in the layers below it.
+func (i *imageFS) hasOpaqueParent(layer, p string) bool {
+	xfs, _ := i.fs.(xattrFS)
+	for dir := path.Dir(p); dir != "/"; dir = path.Dir(dir) {
+		hostDir := filepath.Join(layer, dir)
+		if _, err := i.fs.LStat(filepath.Join(hostDir, opaqueWhiteout)); err == nil {
+			return true
+		}
+		if xfs == nil {
+			continue
+		}
+		for _, attr := range opaqueXattrs {
+			v, err := xfs.Lgetxattr(hostDir, attr)
+			if err == nil && string(v) == "y" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// isWhiteout returns whether the file marks a deletion of a file in a
+// lower layer.
+func isWhiteout(fi fs.FileInfo) bool {
+	if fi.Mode()&fs.ModeCharDevice == 0 {
+		return false
+	}
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	return !ok || st.Rdev == 0
+}
+
+func splitPath(p string) []string {
+	var components []string
+	for _, c := range strings.Split(p, "/") {
+		if c == "" || c == "." {
+			continue
+		}
+		components = append(components, c)
+	}
+	return components
+}
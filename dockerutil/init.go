@@ -0,0 +1,175 @@
+package dockerutil
+
+import (
+	"path"
+	"strings"
+
+	"golang.org/x/xerrors"
+)
+
+// InitSystem is the init process booted as PID 1 of the inner container.
+type InitSystem string
+
+const (
+	// InitAuto selects the init system detected in the image. It is only
+	// valid as an override.
+	InitAuto    InitSystem = "auto"
+	InitNone    InitSystem = "none"
+	InitSystemd InitSystem = "systemd"
+	InitOpenRC  InitSystem = "openrc"
+	InitS6      InitSystem = "s6"
+	InitTini    InitSystem = "tini"
+	InitBusybox InitSystem = "busybox"
+	// InitUnknown is an /sbin/init that could not be identified. It is
+	// booted as-is.
+	InitUnknown InitSystem = "unknown"
+)
+
+var initOverrides = []InitSystem{
+	InitAuto,
+	InitNone,
+	InitSystemd,
+	InitOpenRC,
+	InitS6,
+	InitTini,
+	InitBusybox,
+}
+
+// ParseInitSystem parses an init system override. An empty string is
+// treated as InitAuto.
+func ParseInitSystem(s string) (InitSystem, error) {
+	if s == "" {
+		return InitAuto, nil
+	}
+	for _, i := range initOverrides {
+		if string(i) == s {
+			return i, nil
+		}
+	}
+	return "", xerrors.Errorf("unknown init system %q, must be one of %v", s, initOverrides)
+}
+
+// DefaultPath is the path an init is expected at when it is selected
+// explicitly rather than detected.
+func (i InitSystem) DefaultPath() string {
+	switch i {
+	case InitOpenRC:
+		return "/sbin/openrc-init"
+	case InitS6:
+		return "/init"
+	case InitTini:
+		// Rely on the container's $PATH.
+		return "tini"
+	case InitNone, InitAuto:
+		return ""
+	default:
+		return "/sbin/init"
+	}
+}
+
+// Entrypoint returns the entrypoint that boots the init located at p. It
+// returns nil for InitNone.
+func (i InitSystem) Entrypoint(p string) []string {
+	if p == "" {
+		p = i.DefaultPath()
+	}
+	switch i {
+	case InitNone, InitAuto, "":
+		return nil
+	case InitTini:
+		// tini only reaps zombies and forwards signals, it needs a child
+		// to supervise.
+		return []string{p, "--", "sleep", "infinity"}
+	default:
+		return []string{p}
+	}
+}
+
+// StopSignal returns the signal that cleanly shuts down the init system.
+func (i InitSystem) StopSignal() string {
+	switch i {
+	case InitSystemd:
+		// systemd re-executes itself on SIGTERM.
+		return "SIGRTMIN+3"
+	case InitBusybox, InitOpenRC:
+		// busybox init reboots on SIGTERM, SIGUSR2 powers off. openrc-init
+		// uses the same convention.
+		return "SIGUSR2"
+	default:
+		return "SIGTERM"
+	}
+}
+
+// IsServiceManager returns whether the init supervises services (as opposed
+// to only reaping zombies).
+func (i InitSystem) IsServiceManager() bool {
+	switch i {
+	case InitSystemd, InitOpenRC, InitS6, InitBusybox, InitUnknown:
+		return true
+	default:
+		return false
+	}
+}
+
+// initProber resolves paths inside an image.
+type initProber interface {
+	// Realpath returns the path p resolves to after following symlinks.
+	// An error is returned if p does not exist.
+	Realpath(p string) (string, error)
+}
+
+var (
+	s6OverlayPaths = []string{
+		"/package/admin/s6-overlay",
+		"/etc/s6-overlay",
+		"/command/s6-svscan",
+	}
+	tiniPaths = []string{
+		"/sbin/tini",
+		"/usr/bin/tini",
+		"/usr/local/bin/tini",
+		"/tini",
+		"/usr/bin/tini-static",
+	}
+)
+
+// detectInit determines the init system of an image and the path to boot
+// it from.
+func detectInit(p initProber) (InitSystem, string) {
+	// s6-overlay installs itself as /init rather than /sbin/init.
+	if _, err := p.Realpath("/init"); err == nil {
+		for _, s6 := range s6OverlayPaths {
+			if _, err := p.Realpath(s6); err == nil {
+				return InitS6, "/init"
+			}
+		}
+	}
+
+	// A dangling /sbin/init is treated as if it doesn't exist.
+	if resolved, err := p.Realpath("/sbin/init"); err == nil {
+		base := path.Base(resolved)
+		switch {
+		case strings.Contains(resolved, "systemd"):
+			return InitSystemd, "/sbin/init"
+		case base == "busybox":
+			return InitBusybox, "/sbin/init"
+		case base == "openrc-init":
+			return InitOpenRC, "/sbin/init"
+		case strings.HasPrefix(base, "tini"):
+			return InitTini, "/sbin/init"
+		}
+		return InitUnknown, "/sbin/init"
+	}
+
+	if _, err := p.Realpath("/sbin/openrc-init"); err == nil {
+		return InitOpenRC, "/sbin/openrc-init"
+	}
+
+	for _, tini := range tiniPaths {
+		if _, err := p.Realpath(tini); err == nil {
+			return InitTini, tini
+		}
+	}
+
+	return InitNone, ""
+}
@@ -0,0 +1,136 @@
+package dockerutil
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+
+	"github.com/spf13/afero"
+	"golang.org/x/xerrors"
+
+	"cdr.dev/slog/v3"
+
+	"github.com/coder/envbox/xunix"
+)
+
+// ImageMetadataStateFile is where the result of probing the inner image is
+// persisted between starts.
+const ImageMetadataStateFile = "/var/lib/coder/image-metadata.json"
+
+// imageMetadataStateVersion must be bumped whenever the contents of
+// ImageMetadata or how it is detected changes so that stale entries are
+// discarded.
+const imageMetadataStateVersion = 3
+
+// imageMetadataState is the on-disk format of the image metadata state
+// file. Only entries for a single image are stored, a new image ID
+// invalidates every entry.
+type imageMetadataState struct {
+	Version int                      `json:"version"`
+	ImageID string                   `json:"image_id"`
+	Users   map[string]ImageMetadata `json:"users"`
+}
+
+// GetCachedImageMetadata behaves like GetImageMetadata but persists the
+// result to stateFile keyed by the image's ID and the username. Subsequent
+// calls for the same image and username return the persisted result without
+// probing the image. Failing to read or write the state file is logged but
+// is not fatal.
+func GetCachedImageMetadata(ctx context.Context, log slog.Logger, client Client, stateFile, img, username string) (ImageMetadata, error) {
+	inspect, err := client.ImageInspect(ctx, img)
+	if err != nil {
+		return ImageMetadata{}, xerrors.Errorf("inspect image: %w", err)
+	}
+
+	imageID := inspect.ID
+	if imageID == "" {
+		log.Debug(ctx, "image has no ID, not caching image metadata", slog.F("image", img))
+		return GetImageMetadata(ctx, log, client, img, username)
+	}
+
+	fs := xunix.GetFS(ctx)
+	state, err := readImageMetadataState(fs, stateFile)
+	if err != nil {
+		log.Warn(ctx, "read image metadata state", slog.F("path", stateFile), slog.Error(err))
+	}
+
+	if state.Version == imageMetadataStateVersion && state.ImageID == imageID {
+		if meta, ok := state.Users[username]; ok {
+			log.Debug(ctx, "using cached image metadata",
+				slog.F("image_id", imageID),
+				slog.F("username", username),
+			)
+			return meta, nil
+		}
+	} else {
+		state = imageMetadataState{
+			Version: imageMetadataStateVersion,
+			ImageID: imageID,
+		}
+	}
+
+	meta, err := GetImageMetadata(ctx, log, client, img, username)
+	if err != nil {
+		// A missing user isn't cached since it may be created in the
+		// container.
+		return meta, err
+	}
+
+	if state.Users == nil {
+		state.Users = make(map[string]ImageMetadata)
+	}
+	state.Users[username] = meta
+
+	err = writeImageMetadataState(fs, stateFile, state)
+	if err != nil {
+		log.Warn(ctx, "write image metadata state", slog.F("path", stateFile), slog.Error(err))
+	}
+
+	return meta, nil
+}
+
+func readImageMetadataState(fs xunix.FS, path string) (imageMetadataState, error) {
+	b, err := afero.ReadFile(fs, path)
+	if err != nil {
+		if xerrors.Is(err, os.ErrNotExist) {
+			return imageMetadataState{}, nil
+		}
+		return imageMetadataState{}, xerrors.Errorf("read file: %w", err)
+	}
+
+	var state imageMetadataState
+	err = json.Unmarshal(b, &state)
+	if err != nil {
+		return imageMetadataState{}, xerrors.Errorf("unmarshal: %w", err)
+	}
+
+	return state, nil
+}
+
+func writeImageMetadataState(fs xunix.FS, path string, state imageMetadataState) error {
+	b, err := json.Marshal(state)
+	if err != nil {
+		return xerrors.Errorf("marshal: %w", err)
+	}
+
+	err = fs.MkdirAll(filepath.Dir(path), 0o755)
+	if err != nil {
+		return xerrors.Errorf("mkdir: %w", err)
+	}
+
+	// Write to a temporary file first so that a crash doesn't leave a
+	// truncated state file behind.
+	tmp := path + ".tmp"
+	err = afero.WriteFile(fs, tmp, b, 0o644)
+	if err != nil {
+		return xerrors.Errorf("write file: %w", err)
+	}
+
+	err = fs.Rename(tmp, path)
+	if err != nil {
+		return xerrors.Errorf("rename: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,80 @@
+package dockerutil_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/docker/docker/api/types/image"
+	"github.com/docker/docker/api/types/storage"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+
+	"cdr.dev/slog/v3/sloggers/slogtest"
+	"github.com/coder/envbox/dockerutil"
+	"github.com/coder/envbox/dockerutil/dockerfake"
+	"github.com/coder/envbox/xunix"
+	"github.com/coder/envbox/xunix/xunixfake"
+)
+
+func TestGetCachedImageMetadata(t *testing.T) {
+	t.Parallel()
+
+	const stateFile = "/var/lib/coder/image-metadata.json"
+
+	var (
+		fs  = xunixfake.NewMemFS()
+		ctx = xunix.WithFS(context.Background(), fs)
+		log = slogtest.Make(t, nil)
+
+		imageID  = "sha256:aaaa"
+		inspects int
+	)
+
+	writePasswd := func(content string) {
+		t.Helper()
+		require.NoError(t, afero.WriteFile(fs, "/layer/etc/passwd", []byte(content), 0o644))
+	}
+
+	client := dockerfake.MockClient{
+		ImageInspectFn: func(_ context.Context, _ string) (image.InspectResponse, error) {
+			inspects++
+			return image.InspectResponse{
+				ID: imageID,
+				GraphDriver: storage.DriverData{
+					Name: "overlay2",
+					Data: map[string]string{"UpperDir": "/layer"},
+				},
+			}, nil
+		},
+	}
+
+	writePasswd("coder:x:1000:1000:coder:/home/coder:/bin/bash\n")
+	meta, err := dockerutil.GetCachedImageMetadata(ctx, log, client, stateFile, "test-image", "coder")
+	require.NoError(t, err)
+	require.Equal(t, "1000", meta.UID)
+
+	exists, err := afero.Exists(fs, stateFile)
+	require.NoError(t, err)
+	require.True(t, exists)
+
+	// Changing the image contents without changing its ID should return the
+	// cached result without probing the image again.
+	writePasswd("coder:x:2000:2000:coder:/home/coder:/bin/bash\n")
+	inspects = 0
+	meta, err = dockerutil.GetCachedImageMetadata(ctx, log, client, stateFile, "test-image", "coder")
+	require.NoError(t, err)
+	require.Equal(t, "1000", meta.UID)
+	require.Equal(t, 1, inspects)
+
+	// A different username is cached separately.
+	writePasswd("root:x:0:0:root:/root:/bin/bash\ncoder:x:2000:2000:coder:/home/coder:/bin/bash\n")
+	meta, err = dockerutil.GetCachedImageMetadata(ctx, log, client, stateFile, "test-image", "root")
+	require.NoError(t, err)
+	require.Equal(t, "0", meta.UID)
+
+	// A new image ID invalidates the cache.
+	imageID = "sha256:bbbb"
+	meta, err = dockerutil.GetCachedImageMetadata(ctx, log, client, stateFile, "test-image", "coder")
+	require.NoError(t, err)
+	require.Equal(t, "2000", meta.UID)
+}
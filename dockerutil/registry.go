@@ -4,13 +4,30 @@ import (
 	"context"
 	"io"
 	"path/filepath"
+	"strings"
 
+	"github.com/cpuguy83/dockercfg"
 	"github.com/spf13/afero"
 	"golang.org/x/xerrors"
 
 	"github.com/coder/envbox/xunix"
 )
 
+// RegistryHost returns the host of a registry given as a key of a docker
+// config file's auths (e.g. https://index.docker.io/v1/ or ghcr.io) or as
+// the registry of an image reference. Docker Hub is always 'docker.io'.
+func RegistryHost(registry string) string {
+	host := registry
+	if _, rest, ok := strings.Cut(host, "://"); ok {
+		host = rest
+	}
+	host, _, _ = strings.Cut(host, "/")
+	if dockercfg.ResolveRegistryHost(host) == dockercfg.ResolveRegistryHost("docker.io") {
+		return "docker.io"
+	}
+	return host
+}
+
 // WriteCertsForRegistry writes the certificates found in the provided directory
 // to the correct subdirectory that the Docker daemon uses when pulling images
 // from the specified private registry.
@@ -98,3 +98,20 @@ func TestWriteCertsForRegistry(t *testing.T) {
 		assert.True(t, os.IsNotExist(err), "New certificate file should not have been copied")
 	})
 }
+
+func TestRegistryHost(t *testing.T) {
+	t.Parallel()
+
+	for registry, expected := range map[string]string{
+		"https://index.docker.io/v1/": "docker.io",
+		"index.docker.io":             "docker.io",
+		"registry-1.docker.io":        "docker.io",
+		"docker.io":                   "docker.io",
+		"ghcr.io":                     "ghcr.io",
+		"https://us.gcr.io":           "us.gcr.io",
+		"registry.example.com:5000":   "registry.example.com:5000",
+		"http://localhost:5000/v2/":   "localhost:5000",
+	} {
+		require.Equal(t, expected, dockerutil.RegistryHost(registry), registry)
+	}
+}
@@ -0,0 +1,157 @@
+package dockerutil
+
+import (
+	"context"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+	"golang.org/x/xerrors"
+
+	"cdr.dev/slog/v3"
+
+	"github.com/coder/envbox/xunix"
+)
+
+type ResizeConfig struct {
+	Log         slog.Logger
+	Client      Client
+	ContainerID string
+	// Interval is how often the outer cgroup is polled.
+	Interval time.Duration
+	// UpdateCPUs and UpdateMemory dictate whether the container's CPU and
+	// memory limits follow those of the outer container. They should be
+	// false when the limits were explicitly configured. The CPU quota
+	// visible inside the inner container is always updated.
+	UpdateCPUs   bool
+	UpdateMemory bool
+	// MemorySwap is the configured swap limit of the container, it is
+	// adjusted so that it is never lower than the memory limit.
+	MemorySwap int64
+}
+
+// WatchResize polls the CPU quota and memory limit of the outer container
+// and applies any changes to the inner container until ctx is canceled.
+// This allows in-place pod resizes to take effect without restarting the
+// workspace. cgroup interface files don't generate inotify events when
+// their limits change so they are polled instead.
+func WatchResize(ctx context.Context, conf ResizeConfig) {
+	var (
+		log    = conf.Log
+		ticker = time.NewTicker(conf.Interval)
+		// The cgroup version doesn't change so don't log the fallback
+		// on every poll.
+		quiet      = slog.Make()
+		lastCPU, _ = xunix.ReadCPUQuota(ctx, quiet)
+		lastMem, _ = xunix.ReadMemoryLimit(ctx, quiet)
+	)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		cpu, err := xunix.ReadCPUQuota(ctx, quiet)
+		if err != nil {
+			log.Debug(ctx, "read outer cpu quota", slog.Error(err))
+		} else if cpu != lastCPU {
+			err = resizeCPU(ctx, conf, cpu)
+			if err != nil {
+				log.Error(ctx, "apply outer cpu quota to inner container", slog.Error(err))
+			} else {
+				log.Info(ctx, "applied outer cpu quota to inner container",
+					slog.F("old_quota", lastCPU.Quota),
+					slog.F("old_period", lastCPU.Period),
+					slog.F("quota", cpu.Quota),
+					slog.F("period", cpu.Period),
+				)
+				lastCPU = cpu
+			}
+		}
+
+		if !conf.UpdateMemory {
+			// The inner container has a fixed memory limit.
+			continue
+		}
+
+		mem, err := xunix.ReadMemoryLimit(ctx, quiet)
+		if err != nil {
+			log.Debug(ctx, "read outer memory limit", slog.Error(err))
+		} else if mem != lastMem {
+			limit, err := resizeMemory(ctx, conf, mem)
+			if err != nil {
+				log.Error(ctx, "apply outer memory limit to inner container", slog.Error(err))
+			} else {
+				log.Info(ctx, "applied outer memory limit to inner container",
+					slog.F("old_outer_limit", lastMem.Limit),
+					slog.F("outer_limit", mem.Limit),
+					slog.F("limit", limit),
+				)
+				lastMem = mem
+			}
+		}
+	}
+}
+
+func resizeCPU(ctx context.Context, conf ResizeConfig, quota xunix.CPUQuota) error {
+	if conf.UpdateCPUs {
+		// A quota of 0 removes the limit.
+		cpuQuota := int64(quota.Quota)
+		if cpuQuota < 0 {
+			cpuQuota = 0
+		}
+		_, err := conf.Client.ContainerUpdate(ctx, conf.ContainerID, container.UpdateConfig{
+			Resources: container.Resources{
+				CPUPeriod: int64(quota.Period),
+				CPUQuota:  cpuQuota,
+			},
+		})
+		if err != nil {
+			return xerrors.Errorf("update container: %w", err)
+		}
+	}
+
+	err := SetContainerQuota(ctx, conf.ContainerID, quota)
+	if err != nil {
+		return xerrors.Errorf("set container quota: %w", err)
+	}
+	return nil
+}
+
+// resizeMemory applies the outer memory limit to the inner container and
+// returns the limit of the inner container.
+func resizeMemory(ctx context.Context, conf ResizeConfig, outer xunix.MemoryLimit) (int64, error) {
+	limit := InnerMemoryLimit(outer.Limit)
+	if limit > 0 {
+		// The daemon rejects a memory limit above the current swap limit
+		// so both are updated together.
+		swap := conf.MemorySwap
+		switch {
+		case swap == 0:
+			// Mirror the default applied at creation.
+			swap = 2 * limit
+		case swap > 0 && swap < limit:
+			swap = limit
+		}
+
+		// Docker can't remove a memory limit once set so only bounded
+		// limits are applied.
+		_, err := conf.Client.ContainerUpdate(ctx, conf.ContainerID, container.UpdateConfig{
+			Resources: container.Resources{
+				Memory:     limit,
+				MemorySwap: swap,
+			},
+		})
+		if err != nil {
+			return 0, xerrors.Errorf("update container: %w", err)
+		}
+	}
+
+	err := SetContainerMemoryLimit(ctx, conf.ContainerID, xunix.MemoryLimit{Limit: limit, CGroup: outer.CGroup})
+	if err != nil {
+		return 0, xerrors.Errorf("set container memory limit: %w", err)
+	}
+	return limit, nil
+}
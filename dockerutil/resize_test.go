@@ -0,0 +1,95 @@
+package dockerutil_test
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+
+	"cdr.dev/slog/v3/sloggers/slogtest"
+
+	"github.com/coder/envbox/dockerutil"
+	"github.com/coder/envbox/dockerutil/dockerfake"
+	"github.com/coder/envbox/xunix"
+	"github.com/coder/envbox/xunix/xunixfake"
+)
+
+func TestWatchResize(t *testing.T) {
+	t.Parallel()
+
+	const gib = int64(1 << 30)
+
+	var (
+		tmpfs       = xunixfake.NewMemFS()
+		ctx, cancel = context.WithCancel(xunix.WithFS(context.Background(), tmpfs))
+		mu          sync.Mutex
+		updates     []container.Resources
+	)
+	t.Cleanup(cancel)
+
+	writeFile := func(path, content string) {
+		t.Helper()
+		require.NoError(t, afero.WriteFile(tmpfs, path, []byte(content), 0o644))
+	}
+
+	writeFile("/proc/self/cgroup", "0::/\n")
+	writeFile("/sys/fs/cgroup/cpu.max", "200000 100000\n")
+	writeFile("/sys/fs/cgroup/memory.max", "4294967296\n")
+
+	client := dockerfake.MockClient{
+		ContainerUpdateFn: func(_ context.Context, containerID string, conf container.UpdateConfig) (container.ContainerUpdateOKBody, error) {
+			require.Equal(t, "dummy", containerID)
+			mu.Lock()
+			defer mu.Unlock()
+			updates = append(updates, conf.Resources)
+			return container.ContainerUpdateOKBody{}, nil
+		},
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		dockerutil.WatchResize(ctx, dockerutil.ResizeConfig{
+			Log:          slogtest.Make(t, nil),
+			Client:       client,
+			ContainerID:  "dummy",
+			Interval:     time.Millisecond * 10,
+			UpdateCPUs:   true,
+			UpdateMemory: true,
+		})
+	}()
+
+	// Give the watcher a chance to read the initial limits.
+	time.Sleep(time.Millisecond * 50)
+	mu.Lock()
+	require.Empty(t, updates, "unchanged limits should not be applied")
+	mu.Unlock()
+
+	writeFile("/sys/fs/cgroup/cpu.max", "400000 100000\n")
+	writeFile("/sys/fs/cgroup/memory.max", "8589934592\n")
+
+	require.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(updates) == 2
+	}, time.Second*5, time.Millisecond*10)
+	cancel()
+	<-done
+
+	require.Equal(t, []container.Resources{
+		{CPUPeriod: 100000, CPUQuota: 400000},
+		{Memory: 8*gib - 8*gib/10, MemorySwap: 2 * (8*gib - 8*gib/10)},
+	}, updates)
+
+	cpuMax, err := afero.ReadFile(tmpfs, "/sys/fs/cgroup/docker/dummy/init.scope/cpu.max")
+	require.NoError(t, err)
+	require.Equal(t, "400000 100000\n", string(cpuMax))
+
+	memMax, err := afero.ReadFile(tmpfs, "/sys/fs/cgroup/docker/dummy/init.scope/memory.max")
+	require.NoError(t, err)
+	require.Equal(t, "7730941133", string(memMax))
+}
@@ -0,0 +1,63 @@
+package dockerutil
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"strconv"
+
+	"golang.org/x/xerrors"
+)
+
+// writeSecretScript writes stdin to a file atomically, so that a secret is
+// never readable with the wrong owner or mode or partially written.
+//
+// Arguments: <dir> <name> <uid> <gid> <mode>
+const writeSecretScript = `set -eu
+dir=$1 name=$2 uid=$3 gid=$4 mode=$5
+umask 077
+mkdir -p "$dir"
+tmp="${dir}/.${name}.tmp"
+cat >"$tmp"
+chown "${uid}:${gid}" "$tmp"
+chmod "$mode" "$tmp"
+mv -f "$tmp" "${dir}/${name}"
+`
+
+// Secret is a file written into a container without passing through its
+// config.
+type Secret struct {
+	Name  string
+	Value []byte
+	// UID and GID are relative to the container's user namespace.
+	UID  int
+	GID  int
+	Mode os.FileMode
+}
+
+// WriteSecrets writes secrets into dir in a running container. They are
+// passed over the exec's stdin so they never appear in the container's
+// config or a command line. dir should be a tmpfs so that they aren't
+// persisted.
+func WriteSecrets(ctx context.Context, client Client, containerID, dir string, secrets []Secret) error {
+	for _, s := range secrets {
+		out, err := ExecContainer(ctx, client, ExecConfig{
+			ContainerID: containerID,
+			User:        "root",
+			Cmd:         "/bin/sh",
+			Args: []string{
+				"-c", writeSecretScript, "sh",
+				dir,
+				s.Name,
+				strconv.Itoa(s.UID),
+				strconv.Itoa(s.GID),
+				strconv.FormatUint(uint64(s.Mode.Perm()), 8),
+			},
+			Stdin: bytes.NewReader(s.Value),
+		})
+		if err != nil {
+			return xerrors.Errorf("write secret %q (%s): %w", s.Name, out, err)
+		}
+	}
+	return nil
+}
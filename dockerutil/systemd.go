@@ -0,0 +1,155 @@
+package dockerutil
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"text/template"
+	"time"
+
+	"golang.org/x/xerrors"
+
+	"github.com/coder/retry"
+)
+
+const (
+	// AgentUnitName is the name of the systemd unit that runs the Coder
+	// agent inside the inner container.
+	AgentUnitName = "coder-agent.service"
+
+	agentUnitPath      = "/etc/systemd/system/" + AgentUnitName
+	agentEnvFilePath   = "/etc/coder/agent.env"
+	agentBootstrapPath = "/etc/coder/bootstrap.sh"
+)
+
+var agentUnitTemplate = template.Must(template.New("unit").Parse(`[Unit]
+Description=Coder Agent
+After=network-online.target
+Wants=network-online.target
+
+[Service]
+Type=simple
+User={{ .UID }}
+Group={{ .GID }}
+{{- if .Groups }}
+SupplementaryGroups={{ .Groups }}
+{{- end }}
+WorkingDirectory=-{{ .HomeDir }}
+EnvironmentFile={{ .EnvFile }}
+ExecStart=/bin/sh {{ .Script }}
+Restart=always
+RestartSec=5
+TimeoutStopSec=90
+
+[Install]
+WantedBy=multi-user.target
+`))
+
+type SystemdBootstrapConfig struct {
+	ContainerID string
+	// UID and GID are the user the agent runs as.
+	UID string
+	GID string
+	// Groups are the agent's supplementary groups, names or GIDs.
+	Groups  []string
+	HomeDir string
+	Script  string
+	// Env is written to the unit's environment file since services do not
+	// inherit the environment of the container.
+	Env []string
+}
+
+// BootstrapSystemdUnit writes the bootstrap script into the container and
+// runs it as a systemd service so that the agent is supervised and stopped
+// in order when the container shuts down. The container's PID 1 must be
+// systemd.
+func BootstrapSystemdUnit(ctx context.Context, client Client, conf SystemdBootstrapConfig) error {
+	var unit bytes.Buffer
+	err := agentUnitTemplate.Execute(&unit, map[string]string{
+		"UID":     conf.UID,
+		"GID":     conf.GID,
+		"Groups":  strings.Join(conf.Groups, " "),
+		"HomeDir": conf.HomeDir,
+		"EnvFile": agentEnvFilePath,
+		"Script":  agentBootstrapPath,
+	})
+	if err != nil {
+		return xerrors.Errorf("render unit: %w", err)
+	}
+
+	err = CopyFilesToContainer(ctx, client, conf.ContainerID, []ContainerFile{
+		{
+			Path:    agentUnitPath,
+			Content: unit.Bytes(),
+			Mode:    0o644,
+		},
+		{
+			// The environment contains the agent token so it is only
+			// readable by root, systemd reads it before dropping
+			// privileges.
+			Path:    agentEnvFilePath,
+			Content: []byte(systemdEnvFile(conf.Env)),
+			Mode:    0o600,
+		},
+		{
+			Path:    agentBootstrapPath,
+			Content: []byte(conf.Script),
+			Mode:    0o755,
+		},
+	})
+	if err != nil {
+		return xerrors.Errorf("copy unit files: %w", err)
+	}
+
+	// systemd may still be booting so retry until it accepts our requests.
+	for _, args := range [][]string{
+		{"daemon-reload"},
+		{"enable", "--now", AgentUnitName},
+	} {
+		err = retrySystemctl(ctx, client, conf.ContainerID, args...)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = retrySystemctl(ctx, client, conf.ContainerID, "is-active", "--quiet", AgentUnitName)
+	if err != nil {
+		return xerrors.Errorf("%s is not active: %w", AgentUnitName, err)
+	}
+
+	return nil
+}
+
+func retrySystemctl(ctx context.Context, client Client, containerID string, args ...string) error {
+	var (
+		out []byte
+		err error
+	)
+	for r, n := retry.New(time.Second, time.Second*2), 0; r.Wait(ctx) && n < 10; n++ {
+		out, err = ExecContainer(ctx, client, ExecConfig{
+			ContainerID: containerID,
+			User:        "root",
+			Cmd:         "systemctl",
+			Args:        args,
+		})
+		if err == nil {
+			return nil
+		}
+	}
+	return xerrors.Errorf("systemctl %s (%s): %w", strings.Join(args, " "), out, err)
+}
+
+// systemdEnvFile renders envs in the format expected by EnvironmentFile=.
+func systemdEnvFile(envs []string) string {
+	var sb strings.Builder
+	for _, env := range envs {
+		key, val, ok := strings.Cut(env, "=")
+		if !ok || key == "" {
+			continue
+		}
+		val = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(val)
+		_, _ = fmt.Fprintf(&sb, "%s=\"%s\"\n", key, val)
+	}
+	return sb.String()
+}
@@ -0,0 +1,95 @@
+package dockerutil_test
+
+import (
+	"archive/tar"
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+
+	dockertypes "github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/common"
+	"github.com/docker/docker/api/types/container"
+	"github.com/stretchr/testify/require"
+
+	"github.com/coder/envbox/dockerutil"
+	"github.com/coder/envbox/dockerutil/dockerfake"
+)
+
+func TestBootstrapSystemdUnit(t *testing.T) {
+	t.Parallel()
+
+	type file struct {
+		content string
+		mode    int64
+	}
+
+	var (
+		ctx   = context.Background()
+		mu    sync.Mutex
+		cmds  [][]string
+		files = map[string]file{}
+	)
+
+	client := dockerfake.MockClient{
+		CopyToContainerFn: func(_ context.Context, _, path string, content io.Reader, _ container.CopyToContainerOptions) error {
+			require.Equal(t, "/", path)
+			tr := tar.NewReader(content)
+			for {
+				hdr, err := tr.Next()
+				if err == io.EOF {
+					return nil
+				}
+				require.NoError(t, err)
+				b, err := io.ReadAll(tr)
+				require.NoError(t, err)
+				files["/"+hdr.Name] = file{content: string(b), mode: hdr.Mode}
+			}
+		},
+		ContainerExecCreateFn: func(_ context.Context, _ string, config container.ExecOptions) (common.IDResponse, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			cmds = append(cmds, config.Cmd)
+			return common.IDResponse{}, nil
+		},
+		ContainerExecAttachFn: func(_ context.Context, _ string, _ container.ExecAttachOptions) (dockertypes.HijackedResponse, error) {
+			return dockertypes.HijackedResponse{
+				Reader: bufio.NewReader(strings.NewReader("")),
+				Conn:   &net.IPConn{},
+			}, nil
+		},
+	}
+
+	err := dockerutil.BootstrapSystemdUnit(ctx, client, dockerutil.SystemdBootstrapConfig{
+		ContainerID: "abc",
+		UID:         "1000",
+		GID:         "1000",
+		Groups:      []string{"27", "docker"},
+		HomeDir:     "/home/coder",
+		Script:      "echo hello",
+		Env:         []string{"CODER_AGENT_TOKEN=secret", `QUOTED=a "b" \c`},
+	})
+	require.NoError(t, err)
+
+	unit := files["/etc/systemd/system/"+dockerutil.AgentUnitName]
+	require.Contains(t, unit.content, "User=1000\n")
+	require.Contains(t, unit.content, "Group=1000\nSupplementaryGroups=27 docker\n")
+	require.Contains(t, unit.content, "WorkingDirectory=-/home/coder\n")
+	require.Contains(t, unit.content, "EnvironmentFile=/etc/coder/agent.env\n")
+	require.Contains(t, unit.content, "ExecStart=/bin/sh /etc/coder/bootstrap.sh\n")
+
+	env := files["/etc/coder/agent.env"]
+	require.Equal(t, int64(0o600), env.mode)
+	require.Equal(t, "CODER_AGENT_TOKEN=\"secret\"\nQUOTED=\"a \\\"b\\\" \\\\c\"\n", env.content)
+
+	require.Equal(t, "echo hello", files["/etc/coder/bootstrap.sh"].content)
+
+	require.Equal(t, [][]string{
+		{"systemctl", "daemon-reload"},
+		{"systemctl", "enable", "--now", dockerutil.AgentUnitName},
+		{"systemctl", "is-active", "--quiet", dockerutil.AgentUnitName},
+	}, cmds)
+}
@@ -0,0 +1,191 @@
+package dockerutil
+
+import (
+	"context"
+	"regexp"
+	"strconv"
+
+	"golang.org/x/xerrors"
+)
+
+// usernameRe matches the usernames accepted by useradd and busybox's
+// adduser with their default settings.
+var usernameRe = regexp.MustCompile(`^[a-z_][a-z0-9_-]{0,31}$`)
+
+// createUserScript creates a user and its primary group if the user doesn't
+// exist. It prefers shadow-utils (Debian, RHEL), then busybox (Alpine) and
+// falls back to editing /etc/passwd and /etc/group directly. An existing
+// group with the requested GID is reused but the UID must be free, a second
+// user with the same UID would be the one its processes resolve to.
+//
+// Arguments: <name> <uid> <gid> <home> <shell> <sudo>
+const createUserScript = `set -eu
+name=$1 uid=$2 gid=$3 home=$4 shell=$5 sudo=$6
+
+if grep -q "^${name}:" /etc/passwd; then
+	echo "User ${name} already exists"
+	exit 0
+fi
+
+if command -v getent >/dev/null 2>&1; then
+	owner=$(getent passwd "$uid" | cut -d: -f1 || true)
+else
+	owner=$(awk -F: -v uid="$uid" '$3 == uid { print $1; exit }' /etc/passwd)
+fi
+if [ -n "$owner" ]; then
+	echo "UID ${uid} is already used by ${owner}, choose another UID for ${name}" >&2
+	exit 1
+fi
+
+if [ -z "$shell" ]; then
+	shell=/bin/sh
+	if [ -x /bin/bash ]; then
+		shell=/bin/bash
+	fi
+fi
+
+group=$(grep -E "^[^:]*:[^:]*:${gid}:" /etc/group | head -n 1 | cut -d: -f1 || true)
+if [ -z "$group" ]; then
+	group=$name
+	if command -v groupadd >/dev/null 2>&1; then
+		groupadd --gid "$gid" "$group"
+	elif command -v addgroup >/dev/null 2>&1; then
+		addgroup -g "$gid" "$group"
+	else
+		echo "${group}:x:${gid}:" >>/etc/group
+	fi
+fi
+
+if command -v useradd >/dev/null 2>&1; then
+	useradd --uid "$uid" --gid "$gid" --home-dir "$home" --no-create-home --shell "$shell" "$name"
+elif command -v adduser >/dev/null 2>&1; then
+	adduser -D -H -u "$uid" -G "$group" -h "$home" -s "$shell" "$name"
+else
+	echo "${name}:x:${uid}:${gid}::${home}:${shell}" >>/etc/passwd
+	if [ -f /etc/shadow ]; then
+		echo "${name}:!:::::::" >>/etc/shadow
+	fi
+fi
+
+if [ ! -d "$home" ]; then
+	mkdir -p "$home"
+	chown "${uid}:${gid}" "$home"
+fi
+
+if [ "$sudo" = true ]; then
+	if [ ! -f /etc/sudoers ]; then
+		echo "sudo is not installed, not configuring it for ${name}" >&2
+		exit 0
+	fi
+	if ! grep -qE "^[@#]includedir /etc/sudoers.d" /etc/sudoers; then
+		echo "@includedir /etc/sudoers.d" >>/etc/sudoers
+	fi
+	mkdir -p /etc/sudoers.d
+	echo "${name} ALL=(ALL) NOPASSWD:ALL" >"/etc/sudoers.d/${name}"
+	chmod 0440 "/etc/sudoers.d/${name}"
+fi
+echo "Created user ${name}"
+`
+
+// addGroupMemberScript creates a group if it doesn't exist and adds a user
+// to its members in /etc/group, which the daemon reads to resolve the
+// supplementary groups of execs. A Docker socket that was created before the
+// group existed is handed to the group.
+//
+// Arguments: <group> <user>
+const addGroupMemberScript = `set -eu
+group=$1 user=$2
+
+if ! grep -q "^${group}:" /etc/group; then
+	if command -v groupadd >/dev/null 2>&1; then
+		groupadd --system "$group"
+	elif command -v addgroup >/dev/null 2>&1; then
+		addgroup -S "$group"
+	else
+		gid=$(awk -F: 'BEGIN { gid = 999 } { used[$3] = 1 } END { while (gid in used) gid--; print gid }' /etc/group)
+		echo "${group}:x:${gid}:" >>/etc/group
+	fi
+	echo "Created group ${group}"
+fi
+
+# Rewrite /etc/group in place to preserve its owner and mode.
+awk -F: -v OFS=: -v group="$group" -v user="$user" '
+$1 == group {
+	n = split($4, members, ",")
+	for (i = 1; i <= n; i++) if (members[i] == user) { print; next }
+	$4 = ($4 == "" ? user : $4 "," user)
+}
+{ print }' /etc/group >/etc/group.envbox
+cat /etc/group.envbox >/etc/group
+rm -f /etc/group.envbox
+
+if [ "$group" = docker ] && [ -S /var/run/docker.sock ]; then
+	chgrp docker /var/run/docker.sock
+fi
+echo "Added ${user} to group ${group}"
+`
+
+type CreateUserConfig struct {
+	ContainerID string
+	Username    string
+	UID         int
+	GID         int
+	HomeDir     string
+	// Shell defaults to /bin/bash if it exists and /bin/sh otherwise.
+	Shell string
+	// Sudo configures passwordless sudo for the user if sudo is installed.
+	Sudo bool
+}
+
+// ValidateUsername ensures name can be created by CreateUser.
+func ValidateUsername(name string) error {
+	if !usernameRe.MatchString(name) {
+		return xerrors.Errorf("invalid username %q, must match %s", name, usernameRe)
+	}
+	return nil
+}
+
+// CreateUser creates a user and its primary group in a running container.
+// It is a no-op if the user already exists and fails if another user has
+// the UID. It works with the tools found
+// in Debian, RHEL and Alpine based images.
+func CreateUser(ctx context.Context, client Client, conf CreateUserConfig) ([]byte, error) {
+	err := ValidateUsername(conf.Username)
+	if err != nil {
+		return nil, err
+	}
+
+	out, err := ExecContainer(ctx, client, ExecConfig{
+		ContainerID: conf.ContainerID,
+		User:        "root",
+		Cmd:         "/bin/sh",
+		Args: []string{
+			"-c", createUserScript, "sh",
+			conf.Username,
+			strconv.Itoa(conf.UID),
+			strconv.Itoa(conf.GID),
+			conf.HomeDir,
+			conf.Shell,
+			strconv.FormatBool(conf.Sudo),
+		},
+	})
+	if err != nil {
+		return out, xerrors.Errorf("create user %q: %w", conf.Username, err)
+	}
+	return out, nil
+}
+
+// AddGroupMember adds username to the group, creating the group if it
+// doesn't exist. It is a no-op if the user is already a member.
+func AddGroupMember(ctx context.Context, client Client, containerID, group, username string) ([]byte, error) {
+	out, err := ExecContainer(ctx, client, ExecConfig{
+		ContainerID: containerID,
+		User:        "root",
+		Cmd:         "/bin/sh",
+		Args:        []string{"-c", addGroupMemberScript, "sh", group, username},
+	})
+	if err != nil {
+		return out, xerrors.Errorf("add %q to group %q: %w", username, group, err)
+	}
+	return out, nil
+}
@@ -0,0 +1,504 @@
+// Package cgroup locates and accesses the cgroups of the current process.
+// It supports cgroupv1, cgroupv2 and hybrid layouts as well as hierarchies
+// that are rooted at a cgroup namespace (e.g. after 'unshare --cgroup' and a
+// remount of /sys/fs/cgroup). All access goes through an afero.Fs so that
+// layouts can be tested against fixtures.
+package cgroup
+
+import (
+	"bytes"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/afero"
+	"golang.org/x/xerrors"
+)
+
+// Root is where cgroup filesystems are conventionally mounted.
+const Root = "/sys/fs/cgroup"
+
+// Unlimited is returned for limits that are not set.
+const Unlimited int64 = -1
+
+// v1Unlimited is the smallest value cgroupv1 reports for an unlimited
+// memory limit. The exact value is PAGE_COUNTER_MAX rounded to the page size
+// which varies by architecture.
+const v1Unlimited = int64(1) << 62
+
+type Version int
+
+func (v Version) String() string {
+	return [...]string{"cgroupv1", "cgroupv2"}[v]
+}
+
+const (
+	V1 Version = iota
+	V2
+)
+
+// Mode is the layout of the cgroup hierarchies.
+type Mode int
+
+func (m Mode) String() string {
+	return [...]string{"legacy", "hybrid", "unified"}[m]
+}
+
+const (
+	// ModeLegacy has only cgroupv1 hierarchies.
+	ModeLegacy Mode = iota
+	// ModeHybrid has cgroupv1 hierarchies for every controller and an
+	// additional controller-less cgroupv2 hierarchy.
+	ModeHybrid
+	// ModeUnified has only the cgroupv2 hierarchy.
+	ModeUnified
+)
+
+// CGroups are the cgroups of a process.
+type CGroups struct {
+	fs          afero.Fs
+	Mode        Mode
+	Hierarchies []Hierarchy
+	Mounts      []Mount
+}
+
+// Load reads the cgroups of the current process from /proc/self/cgroup and
+// the cgroup mounts from /proc/self/mountinfo. When either is unavailable
+// the conventional layout under Root is assumed.
+func Load(fs afero.Fs) (*CGroups, error) {
+	c := &CGroups{fs: fs}
+
+	raw, err := afero.ReadFile(fs, "/proc/self/cgroup")
+	if err == nil {
+		c.Hierarchies, err = ParseProcCGroup(raw)
+		if err != nil {
+			return nil, xerrors.Errorf("parse /proc/self/cgroup: %w", err)
+		}
+	} else if !xerrors.Is(err, os.ErrNotExist) {
+		return nil, xerrors.Errorf("read /proc/self/cgroup: %w", err)
+	}
+
+	raw, err = afero.ReadFile(fs, "/proc/self/mountinfo")
+	if err == nil {
+		c.Mounts, err = ParseMountInfo(raw)
+		if err != nil {
+			return nil, xerrors.Errorf("parse /proc/self/mountinfo: %w", err)
+		}
+	} else if !xerrors.Is(err, os.ErrNotExist) {
+		return nil, xerrors.Errorf("read /proc/self/mountinfo: %w", err)
+	}
+
+	c.Mode = c.detectMode()
+	if len(c.Mounts) == 0 {
+		c.Mounts = c.defaultMounts()
+	}
+
+	return c, nil
+}
+
+func (c *CGroups) detectMode() Mode {
+	var v1, v2 bool
+	if len(c.Hierarchies) > 0 {
+		for _, h := range c.Hierarchies {
+			if h.Version() == V2 {
+				v2 = true
+			} else if !isNamed(h.Controllers) {
+				v1 = true
+			}
+		}
+	} else if len(c.Mounts) > 0 {
+		for _, m := range c.Mounts {
+			if m.Version == V2 {
+				v2 = true
+			} else if !isNamed(m.Controllers) {
+				v1 = true
+			}
+		}
+	} else if _, err := c.fs.Stat(path.Join(Root, "cgroup.controllers")); err == nil {
+		v2 = true
+	}
+
+	switch {
+	case v1 && v2:
+		return ModeHybrid
+	case v2:
+		return ModeUnified
+	default:
+		return ModeLegacy
+	}
+}
+
+// defaultMounts returns the conventional mounts for the mode.
+func (c *CGroups) defaultMounts() []Mount {
+	if c.Mode == ModeUnified {
+		return []Mount{{Mountpoint: Root, Root: "/", Version: V2}}
+	}
+
+	var mounts []Mount
+	if c.Mode == ModeHybrid {
+		mounts = append(mounts, Mount{Mountpoint: path.Join(Root, "unified"), Root: "/", Version: V2})
+	}
+
+	controllers := make([][]string, 0, len(c.Hierarchies))
+	for _, h := range c.Hierarchies {
+		if h.Version() == V1 {
+			controllers = append(controllers, h.Controllers)
+		}
+	}
+	if len(controllers) == 0 {
+		controllers = [][]string{
+			{"cpu", "cpuacct"}, {"cpuset"}, {"memory"}, {"pids"}, {"blkio"},
+			{"devices"}, {"freezer"}, {"hugetlb"}, {"net_cls", "net_prio"}, {"perf_event"},
+		}
+	}
+	for _, cs := range controllers {
+		name := strings.Join(cs, ",")
+		if isNamed(cs) {
+			name = strings.TrimPrefix(cs[0], "name=")
+		}
+		mounts = append(mounts, Mount{
+			Mountpoint:  path.Join(Root, name),
+			Root:        "/",
+			Version:     V1,
+			Controllers: cs,
+		})
+	}
+	return mounts
+}
+
+// Version returns the version of the hierarchy that manages controller.
+func (c *CGroups) Version(controller string) Version {
+	switch c.Mode {
+	case ModeUnified:
+		return V2
+	case ModeHybrid:
+		// The cgroupv2 hierarchy of a hybrid layout has no controllers
+		// and is only used for process tracking.
+		if controller == "" {
+			return V2
+		}
+		return V1
+	default:
+		return V1
+	}
+}
+
+// MountPath returns the mountpoint of the hierarchy that manages controller
+// for the given version. Children of the process's cgroup namespace (e.g.
+// the cgroups of containers created by a nested dockerd) are found
+// relative to it.
+func (c *CGroups) MountPath(v Version, controller string) string {
+	if m, ok := c.mount(v, controller); ok {
+		return m.Mountpoint
+	}
+
+	// Fall back to the conventional locations.
+	if v == V2 {
+		return Root
+	}
+	if controller == "cpu" || controller == "cpuacct" {
+		return path.Join(Root, "cpu,cpuacct")
+	}
+	return path.Join(Root, controller)
+}
+
+// Available reports whether a hierarchy managing controller is mounted.
+func (c *CGroups) Available(controller string) bool {
+	_, ok := c.mount(c.Version(controller), controller)
+	return ok
+}
+
+func (c *CGroups) mount(v Version, controller string) (Mount, bool) {
+	for _, m := range c.Mounts {
+		if m.Version != v {
+			continue
+		}
+		if v == V2 {
+			return m, true
+		}
+		for _, ctrl := range m.Controllers {
+			if ctrl == controller {
+				return m, true
+			}
+		}
+	}
+	return Mount{}, false
+}
+
+func (c *CGroups) hierarchy(v Version, controller string) (Hierarchy, bool) {
+	for _, h := range c.Hierarchies {
+		if h.Version() != v {
+			continue
+		}
+		if v == V2 {
+			return h, true
+		}
+		for _, ctrl := range h.Controllers {
+			if ctrl == controller {
+				return h, true
+			}
+		}
+	}
+	return Hierarchy{}, false
+}
+
+// Paths returns the directories of the process's cgroup for controller and
+// its ancestors up to the root of the mount, most specific first.
+func (c *CGroups) Paths(controller string) ([]string, error) {
+	v := c.Version(controller)
+	m, ok := c.mount(v, controller)
+	if !ok {
+		return nil, xerrors.Errorf("no %s hierarchy for controller %q", v, controller)
+	}
+
+	var rel string
+	if h, ok := c.hierarchy(v, controller); ok {
+		// The process's cgroup is only reachable through the mount if it
+		// is a descendant of the mount's root. Otherwise (e.g. the
+		// hierarchy was remounted from another cgroup namespace) the
+		// mount's root is the best approximation.
+		if r, ok := relativeTo(h.Path, m.Root); ok {
+			rel = r
+		}
+	}
+
+	paths := []string{path.Join(m.Mountpoint, rel)}
+	for rel != "" && rel != "/" && rel != "." {
+		rel = path.Dir(rel)
+		paths = append(paths, path.Join(m.Mountpoint, rel))
+	}
+	return paths, nil
+}
+
+// relativeTo returns p relative to root if it is a descendant.
+func relativeTo(p, root string) (string, bool) {
+	p, root = path.Clean(p), path.Clean(root)
+	if root == "/" {
+		return p, true
+	}
+	if p == root {
+		return "/", true
+	}
+	if rest, ok := strings.CutPrefix(p, root+"/"); ok {
+		return "/" + rest, true
+	}
+	return "", false
+}
+
+// ReadFile reads name from the most specific cgroup of the process for
+// controller that has it.
+func (c *CGroups) ReadFile(controller, name string) ([]byte, error) {
+	paths, err := c.Paths(controller)
+	if err != nil {
+		return nil, err
+	}
+
+	var tried []string
+	for _, p := range paths {
+		p = path.Join(p, name)
+		raw, err := afero.ReadFile(c.fs, p)
+		if err == nil {
+			return raw, nil
+		}
+		if !xerrors.Is(err, os.ErrNotExist) {
+			return nil, xerrors.Errorf("read %s: %w", p, err)
+		}
+		tried = append(tried, p)
+	}
+	return nil, xerrors.Errorf("read %s (tried %s): %w", name, strings.Join(tried, ", "), os.ErrNotExist)
+}
+
+// ReadLimit returns the most restrictive value of name across the process's
+// cgroup and its ancestors, or Unlimited if it is not limited.
+func (c *CGroups) ReadLimit(controller, name string) (int64, error) {
+	paths, err := c.Paths(controller)
+	if err != nil {
+		return 0, err
+	}
+
+	var (
+		limit = Unlimited
+		found bool
+	)
+	for _, p := range paths {
+		raw, err := afero.ReadFile(c.fs, path.Join(p, name))
+		if err != nil {
+			if xerrors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			return 0, xerrors.Errorf("read %s: %w", path.Join(p, name), err)
+		}
+		found = true
+
+		v, err := parseValue(string(raw))
+		if err != nil {
+			return 0, xerrors.Errorf("parse %s: %w", path.Join(p, name), err)
+		}
+		if c.Version(controller) == V1 && v >= v1Unlimited {
+			v = Unlimited
+		}
+		if v != Unlimited && (limit == Unlimited || v < limit) {
+			limit = v
+		}
+	}
+	if !found {
+		return 0, xerrors.Errorf("read %s for %s: %w", name, controller, os.ErrNotExist)
+	}
+	return limit, nil
+}
+
+// ReadStats reads a flat keyed file (e.g. memory.stat or cpu.stat) from the
+// process's cgroup.
+func (c *CGroups) ReadStats(controller, name string) (map[string]int64, error) {
+	raw, err := c.ReadFile(controller, name)
+	if err != nil {
+		return nil, err
+	}
+	stats, err := parseFlatKeyed(raw)
+	if err != nil {
+		return nil, xerrors.Errorf("parse %s: %w", name, err)
+	}
+	return stats, nil
+}
+
+// CPUQuota is a CFS quota. Quota is Unlimited if the CPU is not limited.
+type CPUQuota struct {
+	Quota  int64
+	Period int64
+}
+
+// CPUQuota returns the most restrictive CPU quota across the process's
+// cgroup and its ancestors.
+func (c *CGroups) CPUQuota() (CPUQuota, Version, error) {
+	paths, err := c.Paths("cpu")
+	if err != nil {
+		return CPUQuota{}, 0, err
+	}
+
+	var (
+		v     = c.Version("cpu")
+		quota *CPUQuota
+	)
+	for _, p := range paths {
+		q, err := c.readCPUQuota(v, p)
+		if err != nil {
+			if xerrors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			return CPUQuota{}, 0, err
+		}
+		if quota == nil || isMoreRestrictive(q, *quota) {
+			quota = &q
+		}
+	}
+	if quota == nil {
+		return CPUQuota{}, 0, xerrors.Errorf("read cpu quota from %s: %w", strings.Join(paths, ", "), os.ErrNotExist)
+	}
+	return *quota, v, nil
+}
+
+func (c *CGroups) readCPUQuota(v Version, dir string) (CPUQuota, error) {
+	if v == V2 {
+		raw, err := afero.ReadFile(c.fs, path.Join(dir, "cpu.max"))
+		if err != nil {
+			return CPUQuota{}, err
+		}
+		fields := strings.Fields(string(raw))
+		if len(fields) != 2 {
+			return CPUQuota{}, xerrors.Errorf("expected cpu.max to have exactly two entries, got: %s", string(raw))
+		}
+		quota, err := parseValue(fields[0])
+		if err != nil {
+			return CPUQuota{}, xerrors.Errorf("quota %s not an int: %w", fields[0], err)
+		}
+		period, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return CPUQuota{}, xerrors.Errorf("period %s not an int: %w", fields[1], err)
+		}
+		return CPUQuota{Quota: quota, Period: period}, nil
+	}
+
+	periodRaw, err := afero.ReadFile(c.fs, path.Join(dir, "cpu.cfs_period_us"))
+	if err != nil {
+		return CPUQuota{}, err
+	}
+	quotaRaw, err := afero.ReadFile(c.fs, path.Join(dir, "cpu.cfs_quota_us"))
+	if err != nil {
+		return CPUQuota{}, err
+	}
+
+	periodStr := string(bytes.TrimSpace(periodRaw))
+	period, err := strconv.ParseInt(periodStr, 10, 64)
+	if err != nil {
+		return CPUQuota{}, xerrors.Errorf("period %s not an int: %w", periodStr, err)
+	}
+	quotaStr := string(bytes.TrimSpace(quotaRaw))
+	quota, err := strconv.ParseInt(quotaStr, 10, 64)
+	if err != nil {
+		return CPUQuota{}, xerrors.Errorf("quota %s not an int: %w", quotaStr, err)
+	}
+	return CPUQuota{Quota: quota, Period: period}, nil
+}
+
+// isMoreRestrictive reports whether a allows less CPU time than b.
+func isMoreRestrictive(a, b CPUQuota) bool {
+	if a.Quota < 0 || a.Period <= 0 {
+		return false
+	}
+	if b.Quota < 0 || b.Period <= 0 {
+		return true
+	}
+	return a.Quota*b.Period < b.Quota*a.Period
+}
+
+// MemoryLimit returns the most restrictive memory limit across the
+// process's cgroup and its ancestors. For cgroupv2 memory.high is also
+// considered since exceeding it results in heavy throttling.
+func (c *CGroups) MemoryLimit() (int64, Version, error) {
+	v := c.Version("memory")
+	if v == V1 {
+		limit, err := c.ReadLimit("memory", "memory.limit_in_bytes")
+		return limit, v, err
+	}
+
+	limit, err := c.ReadLimit("memory", "memory.max")
+	if err != nil {
+		return 0, v, err
+	}
+	high, err := c.ReadLimit("memory", "memory.high")
+	if err != nil && !xerrors.Is(err, os.ErrNotExist) {
+		return 0, v, err
+	}
+	if err == nil && high != Unlimited && (limit == Unlimited || high < limit) {
+		limit = high
+	}
+	return limit, v, nil
+}
+
+// WriteFile writes name in the cgroup at rel relative to the mount of the
+// hierarchy that manages controller.
+func (c *CGroups) WriteFile(v Version, controller, rel, name string, data []byte) error {
+	p := path.Join(c.MountPath(v, controller), rel, name)
+	err := afero.WriteFile(c.fs, p, data, 0o644)
+	if err != nil {
+		return xerrors.Errorf("write %s: %w", p, err)
+	}
+	return nil
+}
+
+// Controllers returns the cgroupv2 controllers available in dir.
+func (c *CGroups) Controllers(dir string) ([]string, error) {
+	raw, err := afero.ReadFile(c.fs, path.Join(dir, "cgroup.controllers"))
+	if err != nil {
+		return nil, xerrors.Errorf("read cgroup.controllers: %w", err)
+	}
+	controllers := strings.Fields(string(raw))
+	sort.Strings(controllers)
+	return controllers, nil
+}
+
+func isNamed(controllers []string) bool {
+	return len(controllers) == 1 && strings.HasPrefix(controllers[0], "name=")
+}
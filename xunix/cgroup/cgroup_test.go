@@ -0,0 +1,366 @@
+package cgroup_test
+
+import (
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+
+	"github.com/coder/envbox/xunix/cgroup"
+)
+
+const (
+	// legacyProc and legacyMountInfo are what a process in a docker
+	// container with private cgroup namespaces on a cgroupv1 host sees.
+	legacyProc = `12:pids:/docker/abc
+11:cpu,cpuacct:/docker/abc
+10:memory:/docker/abc
+9:cpuset:/docker/abc
+1:name=systemd:/docker/abc
+`
+	legacyMountInfo = `30 29 0:26 / /sys/fs/cgroup ro,nosuid,nodev,noexec - tmpfs tmpfs ro,mode=755
+31 30 0:27 /docker/abc /sys/fs/cgroup/systemd ro,nosuid,nodev,noexec,relatime master:11 - cgroup cgroup rw,xattr,name=systemd
+32 30 0:28 /docker/abc /sys/fs/cgroup/cpu,cpuacct ro,nosuid,nodev,noexec,relatime master:12 - cgroup cgroup rw,cpu,cpuacct
+33 30 0:29 /docker/abc /sys/fs/cgroup/memory ro,nosuid,nodev,noexec,relatime master:13 - cgroup cgroup rw,memory
+34 30 0:30 /docker/abc /sys/fs/cgroup/pids ro,nosuid,nodev,noexec,relatime master:14 - cgroup cgroup rw,pids
+35 30 0:31 /docker/abc /sys/fs/cgroup/cpuset ro,nosuid,nodev,noexec,relatime master:15 - cgroup cgroup rw,cpuset
+`
+
+	// unifiedProc and unifiedMountInfo are what a process in a kubernetes
+	// pod sharing the host's cgroup namespace on a cgroupv2 host sees.
+	unifiedProc      = "0::/kubepods/burstable/pod1/ctr\n"
+	unifiedMountInfo = `30 29 0:26 / /sys/fs/cgroup rw,nosuid,nodev,noexec,relatime - cgroup2 cgroup2 rw,nsdelegate,memory_recursiveprot
+`
+
+	// hybridProc and hybridMountInfo are what a process in a systemd session
+	// on a host in hybrid mode sees.
+	hybridProc = `12:memory:/user.slice
+4:cpu,cpuacct:/user.slice
+1:name=systemd:/user.slice/session-1.scope
+0::/user.slice/session-1.scope
+`
+	hybridMountInfo = `24 18 0:22 / /sys/fs/cgroup ro,nosuid,nodev,noexec shared:9 - tmpfs tmpfs ro,mode=755
+25 24 0:23 / /sys/fs/cgroup/unified rw,nosuid,nodev,noexec,relatime shared:10 - cgroup2 cgroup2 rw,nsdelegate
+26 24 0:24 / /sys/fs/cgroup/systemd rw,nosuid,nodev,noexec,relatime shared:11 - cgroup cgroup rw,xattr,name=systemd
+27 24 0:25 / /sys/fs/cgroup/cpu,cpuacct rw,nosuid,nodev,noexec,relatime shared:12 - cgroup cgroup rw,cpu,cpuacct
+28 24 0:26 / /sys/fs/cgroup/memory rw,nosuid,nodev,noexec,relatime shared:13 - cgroup cgroup rw,memory
+`
+
+	// nestedProc and nestedMountInfo are what a process sees after
+	// 'unshare --cgroup', a remount of /sys/fs/cgroup and moving itself
+	// into the /init child cgroup.
+	nestedProc      = "0::/init\n"
+	nestedMountInfo = `40 39 0:35 / /sys/fs/cgroup rw,nosuid,nodev,noexec,relatime - cgroup2 cgroup2 rw
+`
+)
+
+func TestLoad(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		Name string
+		FS   map[string]string
+
+		Mode          cgroup.Mode
+		MemoryVersion cgroup.Version
+		CPUPaths      []string
+		MemoryLimit   int64
+		CPUQuota      cgroup.CPUQuota
+		Error         string
+	}{
+		{
+			Name: "Legacy",
+			FS: map[string]string{
+				"/proc/self/cgroup":                            legacyProc,
+				"/proc/self/mountinfo":                         legacyMountInfo,
+				"/sys/fs/cgroup/cpu,cpuacct/cpu.cfs_quota_us":  "150000\n",
+				"/sys/fs/cgroup/cpu,cpuacct/cpu.cfs_period_us": "100000\n",
+				"/sys/fs/cgroup/memory/memory.limit_in_bytes":  "4294967296\n",
+			},
+			Mode:          cgroup.ModeLegacy,
+			MemoryVersion: cgroup.V1,
+			CPUPaths:      []string{"/sys/fs/cgroup/cpu,cpuacct"},
+			MemoryLimit:   4 << 30,
+			CPUQuota:      cgroup.CPUQuota{Quota: 150000, Period: 100000},
+		},
+		{
+			Name: "LegacyUnlimited",
+			FS: map[string]string{
+				"/proc/self/cgroup":                            legacyProc,
+				"/proc/self/mountinfo":                         legacyMountInfo,
+				"/sys/fs/cgroup/cpu,cpuacct/cpu.cfs_quota_us":  "-1\n",
+				"/sys/fs/cgroup/cpu,cpuacct/cpu.cfs_period_us": "100000\n",
+				"/sys/fs/cgroup/memory/memory.limit_in_bytes":  "9223372036854771712\n",
+			},
+			Mode:          cgroup.ModeLegacy,
+			MemoryVersion: cgroup.V1,
+			CPUPaths:      []string{"/sys/fs/cgroup/cpu,cpuacct"},
+			MemoryLimit:   cgroup.Unlimited,
+			CPUQuota:      cgroup.CPUQuota{Quota: -1, Period: 100000},
+		},
+		{
+			// Without /proc the conventional docker layout is assumed.
+			Name: "LegacyNoProc",
+			FS: map[string]string{
+				"/sys/fs/cgroup/cpu,cpuacct/cpu.cfs_quota_us":  "50000\n",
+				"/sys/fs/cgroup/cpu,cpuacct/cpu.cfs_period_us": "100000\n",
+				"/sys/fs/cgroup/memory/memory.limit_in_bytes":  "1073741824\n",
+			},
+			Mode:          cgroup.ModeLegacy,
+			MemoryVersion: cgroup.V1,
+			CPUPaths:      []string{"/sys/fs/cgroup/cpu,cpuacct"},
+			MemoryLimit:   1 << 30,
+			CPUQuota:      cgroup.CPUQuota{Quota: 50000, Period: 100000},
+		},
+		{
+			// The most restrictive limit of the pod and the container
+			// applies.
+			Name: "Unified",
+			FS: map[string]string{
+				"/proc/self/cgroup":                                       unifiedProc,
+				"/proc/self/mountinfo":                                    unifiedMountInfo,
+				"/sys/fs/cgroup/cgroup.controllers":                       "cpuset cpu io memory pids\n",
+				"/sys/fs/cgroup/kubepods/burstable/pod1/cpu.max":          "200000 100000\n",
+				"/sys/fs/cgroup/kubepods/burstable/pod1/memory.max":       "4294967296\n",
+				"/sys/fs/cgroup/kubepods/burstable/pod1/ctr/cpu.max":      "300000 100000\n",
+				"/sys/fs/cgroup/kubepods/burstable/pod1/ctr/memory.max":   "8589934592\n",
+				"/sys/fs/cgroup/kubepods/burstable/pod1/ctr/memory.high":  "max\n",
+				"/sys/fs/cgroup/kubepods/burstable/pod1/ctr/memory.stat":  "anon 1024\nfile 2048\n",
+				"/sys/fs/cgroup/kubepods/burstable/pod1/ctr/cgroup.procs": "1\n",
+			},
+			Mode:          cgroup.ModeUnified,
+			MemoryVersion: cgroup.V2,
+			CPUPaths: []string{
+				"/sys/fs/cgroup/kubepods/burstable/pod1/ctr",
+				"/sys/fs/cgroup/kubepods/burstable/pod1",
+				"/sys/fs/cgroup/kubepods/burstable",
+				"/sys/fs/cgroup/kubepods",
+				"/sys/fs/cgroup",
+			},
+			MemoryLimit: 4 << 30,
+			CPUQuota:    cgroup.CPUQuota{Quota: 200000, Period: 100000},
+		},
+		{
+			Name: "UnifiedMemoryHigh",
+			FS: map[string]string{
+				"/proc/self/cgroup":    unifiedProc,
+				"/proc/self/mountinfo": unifiedMountInfo,
+				"/sys/fs/cgroup/kubepods/burstable/pod1/ctr/cpu.max":     "max 100000\n",
+				"/sys/fs/cgroup/kubepods/burstable/pod1/ctr/memory.max":  "max\n",
+				"/sys/fs/cgroup/kubepods/burstable/pod1/ctr/memory.high": "2147483648\n",
+			},
+			Mode:          cgroup.ModeUnified,
+			MemoryVersion: cgroup.V2,
+			CPUPaths: []string{
+				"/sys/fs/cgroup/kubepods/burstable/pod1/ctr",
+				"/sys/fs/cgroup/kubepods/burstable/pod1",
+				"/sys/fs/cgroup/kubepods/burstable",
+				"/sys/fs/cgroup/kubepods",
+				"/sys/fs/cgroup",
+			},
+			MemoryLimit: 2 << 30,
+			CPUQuota:    cgroup.CPUQuota{Quota: -1, Period: 100000},
+		},
+		{
+			// Controllers are managed by the cgroupv1 hierarchies, the
+			// cgroupv2 hierarchy is only used for process tracking.
+			Name: "Hybrid",
+			FS: map[string]string{
+				"/proc/self/cgroup":    hybridProc,
+				"/proc/self/mountinfo": hybridMountInfo,
+				"/sys/fs/cgroup/cpu,cpuacct/user.slice/cpu.cfs_quota_us":  "200000\n",
+				"/sys/fs/cgroup/cpu,cpuacct/user.slice/cpu.cfs_period_us": "100000\n",
+				"/sys/fs/cgroup/memory/user.slice/memory.limit_in_bytes":  "2147483648\n",
+				"/sys/fs/cgroup/memory/memory.limit_in_bytes":             "9223372036854771712\n",
+			},
+			Mode:          cgroup.ModeHybrid,
+			MemoryVersion: cgroup.V1,
+			CPUPaths: []string{
+				"/sys/fs/cgroup/cpu,cpuacct/user.slice",
+				"/sys/fs/cgroup/cpu,cpuacct",
+			},
+			MemoryLimit: 2 << 30,
+			CPUQuota:    cgroup.CPUQuota{Quota: 200000, Period: 100000},
+		},
+		{
+			// The mount root is the cgroup namespace root which carries the
+			// limits of the outer container.
+			Name: "Nested",
+			FS: map[string]string{
+				"/proc/self/cgroup":                  nestedProc,
+				"/proc/self/mountinfo":               nestedMountInfo,
+				"/sys/fs/cgroup/cgroup.controllers":  "cpu memory pids\n",
+				"/sys/fs/cgroup/cpu.max":             "150000 100000\n",
+				"/sys/fs/cgroup/memory.max":          "1073741824\n",
+				"/sys/fs/cgroup/init/cpu.max":        "max 100000\n",
+				"/sys/fs/cgroup/init/memory.max":     "max\n",
+				"/sys/fs/cgroup/init/cgroup.procs":   "1\n",
+				"/sys/fs/cgroup/init/memory.current": "4096\n",
+			},
+			Mode:          cgroup.ModeUnified,
+			MemoryVersion: cgroup.V2,
+			CPUPaths:      []string{"/sys/fs/cgroup/init", "/sys/fs/cgroup"},
+			MemoryLimit:   1 << 30,
+			CPUQuota:      cgroup.CPUQuota{Quota: 150000, Period: 100000},
+		},
+		{
+			// The process's cgroup is not below the root of the mount
+			// (e.g. /sys/fs/cgroup was mounted from another cgroup
+			// namespace) so only the mount root can be used.
+			Name: "MountOutsideNamespace",
+			FS: map[string]string{
+				"/proc/self/cgroup":         "0::/kubepods/pod2/ctr\n",
+				"/proc/self/mountinfo":      "40 39 0:35 /kubepods/pod1/ctr /sys/fs/cgroup rw - cgroup2 cgroup2 rw\n",
+				"/sys/fs/cgroup/cpu.max":    "100000 100000\n",
+				"/sys/fs/cgroup/memory.max": "536870912\n",
+			},
+			Mode:          cgroup.ModeUnified,
+			MemoryVersion: cgroup.V2,
+			CPUPaths:      []string{"/sys/fs/cgroup"},
+			MemoryLimit:   512 << 20,
+			CPUQuota:      cgroup.CPUQuota{Quota: 100000, Period: 100000},
+		},
+		{
+			Name: "InvalidProc",
+			FS: map[string]string{
+				"/proc/self/cgroup": "invalid\n",
+			},
+			Error: "parse /proc/self/cgroup",
+		},
+	} {
+		tc := tc
+		t.Run(tc.Name, func(t *testing.T) {
+			t.Parallel()
+
+			fs := afero.NewMemMapFs()
+			for path, content := range tc.FS {
+				require.NoError(t, afero.WriteFile(fs, path, []byte(content), 0o644))
+			}
+
+			cg, err := cgroup.Load(fs)
+			if tc.Error != "" {
+				require.ErrorContains(t, err, tc.Error)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.Mode, cg.Mode)
+			require.Equal(t, tc.MemoryVersion, cg.Version("memory"))
+
+			paths, err := cg.Paths("cpu")
+			require.NoError(t, err)
+			require.Equal(t, tc.CPUPaths, paths)
+
+			limit, v, err := cg.MemoryLimit()
+			require.NoError(t, err)
+			require.Equal(t, tc.MemoryVersion, v)
+			require.Equal(t, tc.MemoryLimit, limit)
+
+			quota, _, err := cg.CPUQuota()
+			require.NoError(t, err)
+			require.Equal(t, tc.CPUQuota, quota)
+		})
+	}
+}
+
+func TestCGroups(t *testing.T) {
+	t.Parallel()
+
+	t.Run("ReadFile", func(t *testing.T) {
+		t.Parallel()
+
+		fs := afero.NewMemMapFs()
+		writeFiles(t, fs, map[string]string{
+			"/proc/self/cgroup":    nestedProc,
+			"/proc/self/mountinfo": nestedMountInfo,
+			// Only the root has cpuset.cpus.effective.
+			"/sys/fs/cgroup/cpuset.cpus.effective": "0-3\n",
+			"/sys/fs/cgroup/init/pids.max":         "max\n",
+		})
+
+		cg, err := cgroup.Load(fs)
+		require.NoError(t, err)
+
+		raw, err := cg.ReadFile("cpuset", "cpuset.cpus.effective")
+		require.NoError(t, err)
+		require.Equal(t, "0-3\n", string(raw))
+
+		_, err = cg.ReadFile("io", "io.weight")
+		require.ErrorContains(t, err, "file does not exist")
+
+		limit, err := cg.ReadLimit("pids", "pids.max")
+		require.NoError(t, err)
+		require.Equal(t, cgroup.Unlimited, limit)
+	})
+
+	t.Run("ReadStats", func(t *testing.T) {
+		t.Parallel()
+
+		fs := afero.NewMemMapFs()
+		writeFiles(t, fs, map[string]string{
+			"/proc/self/cgroup":    unifiedProc,
+			"/proc/self/mountinfo": unifiedMountInfo,
+			"/sys/fs/cgroup/kubepods/burstable/pod1/ctr/memory.stat": "anon 1024\nfile 2048\n",
+			"/sys/fs/cgroup/kubepods/burstable/pod1/ctr/cpu.stat":    "usage_usec invalid\n",
+		})
+
+		cg, err := cgroup.Load(fs)
+		require.NoError(t, err)
+
+		stats, err := cg.ReadStats("memory", "memory.stat")
+		require.NoError(t, err)
+		require.Equal(t, map[string]int64{"anon": 1024, "file": 2048}, stats)
+
+		_, err = cg.ReadStats("cpu", "cpu.stat")
+		require.ErrorContains(t, err, "parse cpu.stat")
+	})
+
+	t.Run("WriteFile", func(t *testing.T) {
+		t.Parallel()
+
+		fs := afero.NewMemMapFs()
+		writeFiles(t, fs, map[string]string{
+			"/proc/self/cgroup":    hybridProc,
+			"/proc/self/mountinfo": hybridMountInfo,
+		})
+
+		cg, err := cgroup.Load(fs)
+		require.NoError(t, err)
+		require.Equal(t, "/sys/fs/cgroup/unified", cg.MountPath(cgroup.V2, ""))
+		require.Equal(t, "/sys/fs/cgroup/memory", cg.MountPath(cgroup.V1, "memory"))
+		// Controllers without a mount fall back to the conventional path.
+		require.Equal(t, "/sys/fs/cgroup/pids", cg.MountPath(cgroup.V1, "pids"))
+		require.False(t, cg.Available("pids"))
+
+		err = cg.WriteFile(cgroup.V1, "cpu", "docker/abc", "cpu.cfs_quota_us", []byte("50000"))
+		require.NoError(t, err)
+
+		raw, err := afero.ReadFile(fs, "/sys/fs/cgroup/cpu,cpuacct/docker/abc/cpu.cfs_quota_us")
+		require.NoError(t, err)
+		require.Equal(t, "50000", string(raw))
+	})
+
+	t.Run("Controllers", func(t *testing.T) {
+		t.Parallel()
+
+		fs := afero.NewMemMapFs()
+		writeFiles(t, fs, map[string]string{
+			"/sys/fs/cgroup/cgroup.controllers": "pids memory cpu\n",
+		})
+
+		cg, err := cgroup.Load(fs)
+		require.NoError(t, err)
+		require.Equal(t, cgroup.ModeUnified, cg.Mode)
+
+		controllers, err := cg.Controllers(cgroup.Root)
+		require.NoError(t, err)
+		require.Equal(t, []string{"cpu", "memory", "pids"}, controllers)
+	})
+}
+
+func writeFiles(t *testing.T, fs afero.Fs, files map[string]string) {
+	t.Helper()
+
+	for path, content := range files {
+		require.NoError(t, afero.WriteFile(fs, path, []byte(content), 0o644))
+	}
+}
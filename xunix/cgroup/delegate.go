@@ -0,0 +1,183 @@
+package cgroup
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/spf13/afero"
+	"golang.org/x/xerrors"
+
+	"github.com/coder/retry"
+)
+
+// DelegateStep is a step of Delegate.
+type DelegateStep string
+
+const (
+	StepDetect  DelegateStep = "detect"
+	StepUnmount DelegateStep = "unmount"
+	StepMount   DelegateStep = "mount"
+	StepMkdir   DelegateStep = "mkdir"
+	StepMove    DelegateStep = "move"
+	StepEnable  DelegateStep = "enable"
+)
+
+// DelegateError is returned when a step of Delegate fails.
+type DelegateError struct {
+	Step DelegateStep
+	Path string
+	// Attempts is the number of attempts made to enable the controllers.
+	Attempts int
+	Err      error
+}
+
+func (e *DelegateError) Error() string {
+	msg := fmt.Sprintf("%s %s", e.Step, e.Path)
+	if e.Attempts > 0 {
+		msg += fmt.Sprintf(" (after %d attempts)", e.Attempts)
+	}
+	return fmt.Sprintf("%s: %v", msg, e.Err)
+}
+
+func (e *DelegateError) Unwrap() error {
+	return e.Err
+}
+
+// Mounter mounts and unmounts filesystems. It is satisfied by
+// k8s.io/mount-utils.Interface.
+type Mounter interface {
+	Mount(source, target, fstype string, options []string) error
+	Unmount(target string) error
+}
+
+// InitGroup is the cgroup processes in the root cgroup are moved into so
+// that controllers can be enabled for its children.
+const InitGroup = "init"
+
+type DelegateOptions struct {
+	FS      afero.Fs
+	Mounter Mounter
+	// Controllers are the controllers to enable for children of the root
+	// cgroup. All available controllers are enabled if empty.
+	Controllers []string
+	// MaxAttempts bounds the number of attempts to enable the controllers.
+	// New processes (e.g. from 'docker exec') may appear in the root
+	// cgroup between moving processes and enabling controllers which
+	// fails the write with EBUSY. Attempts back off from 10ms to 100ms.
+	MaxAttempts int
+}
+
+// Delegate makes the cgroupv2 hierarchy of a freshly unshared cgroup
+// namespace usable by a nested container runtime. It mirrors moby's
+// hack/dind:
+//
+//  1. Remount /sys/fs/cgroup so it is rooted at the new namespace.
+//  2. Move all processes from the root cgroup into /init since controllers
+//     can't be enabled for a cgroup that has processes.
+//  3. Enable the controllers in cgroup.subtree_control.
+//
+// It is a no-op on cgroupv1 hosts. The enabled controllers are returned.
+//
+// See: https://github.com/moby/moby/blob/8d9e3502aba39127e4d12196dae16d306f76993d/hack/dind#L61-L79
+func Delegate(ctx context.Context, opts DelegateOptions) ([]string, error) {
+	controllersPath := path.Join(Root, "cgroup.controllers")
+	_, err := opts.FS.Stat(controllersPath)
+	if err != nil {
+		if xerrors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, &DelegateError{Step: StepDetect, Path: controllersPath, Err: err}
+	}
+
+	err = opts.Mounter.Unmount(Root)
+	if err != nil {
+		return nil, &DelegateError{Step: StepUnmount, Path: Root, Err: err}
+	}
+
+	err = opts.Mounter.Mount("cgroup", Root, "cgroup2", nil)
+	if err != nil {
+		return nil, &DelegateError{Step: StepMount, Path: Root, Err: err}
+	}
+
+	initPath := path.Join(Root, InitGroup)
+	err = opts.FS.MkdirAll(initPath, 0o755)
+	if err != nil {
+		return nil, &DelegateError{Step: StepMkdir, Path: initPath, Err: err}
+	}
+
+	raw, err := afero.ReadFile(opts.FS, controllersPath)
+	if err != nil {
+		return nil, &DelegateError{Step: StepDetect, Path: controllersPath, Err: err}
+	}
+	controllers, err := selectControllers(strings.Fields(string(raw)), opts.Controllers)
+	if err != nil {
+		return nil, &DelegateError{Step: StepEnable, Path: controllersPath, Err: err}
+	}
+
+	var (
+		subtreeControl = path.Join(Root, "cgroup.subtree_control")
+		content        = enableControllers(controllers)
+		attempts       = max(opts.MaxAttempts, 1)
+	)
+	for r, i := retry.New(10*time.Millisecond, 100*time.Millisecond), 1; r.Wait(ctx); i++ {
+		err = moveProcs(opts.FS, Root, initPath)
+		if err != nil {
+			return nil, &DelegateError{Step: StepMove, Path: path.Join(Root, "cgroup.procs"), Err: err}
+		}
+
+		err = afero.WriteFile(opts.FS, subtreeControl, []byte(content), 0o644)
+		if err == nil {
+			return controllers, nil
+		}
+		if i >= attempts {
+			return nil, &DelegateError{Step: StepEnable, Path: subtreeControl, Attempts: i, Err: err}
+		}
+	}
+	return nil, &DelegateError{Step: StepEnable, Path: subtreeControl, Err: ctx.Err()}
+}
+
+// selectControllers returns the requested controllers or all available
+// controllers if none are requested.
+func selectControllers(available, requested []string) ([]string, error) {
+	if len(requested) == 0 {
+		return available, nil
+	}
+
+	have := make(map[string]bool, len(available))
+	for _, c := range available {
+		have[c] = true
+	}
+	for _, c := range requested {
+		if !have[c] {
+			return nil, xerrors.Errorf("controller %q is not available (available: %s)", c, strings.Join(available, " "))
+		}
+	}
+	return requested, nil
+}
+
+func enableControllers(controllers []string) string {
+	enable := make([]string, 0, len(controllers))
+	for _, c := range controllers {
+		enable = append(enable, "+"+c)
+	}
+	return strings.Join(enable, " ")
+}
+
+// moveProcs moves the processes of the cgroup at from into the cgroup at
+// to. Processes that exit while being moved are ignored.
+func moveProcs(fs afero.Fs, from, to string) error {
+	raw, err := afero.ReadFile(fs, path.Join(from, "cgroup.procs"))
+	if err != nil {
+		return err
+	}
+
+	procs := path.Join(to, "cgroup.procs")
+	for _, pid := range strings.Fields(string(raw)) {
+		_ = afero.WriteFile(fs, procs, []byte(pid), 0o644)
+	}
+	return nil
+}
@@ -0,0 +1,224 @@
+package cgroup_test
+
+import (
+	"context"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/xerrors"
+	mount "k8s.io/mount-utils"
+
+	"github.com/coder/envbox/xunix/cgroup"
+	"github.com/coder/envbox/xunix/xunixfake"
+)
+
+func TestDelegate(t *testing.T) {
+	t.Parallel()
+
+	t.Run("OK", func(t *testing.T) {
+		t.Parallel()
+
+		var (
+			fs      = xunixfake.NewMemFS()
+			mounter = &mount.FakeMounter{
+				MountPoints: []mount.MountPoint{{Device: "cgroup", Path: cgroup.Root, Type: "cgroup2"}},
+			}
+		)
+		writeFiles(t, fs, map[string]string{
+			"/sys/fs/cgroup/cgroup.controllers": "cpuset cpu io memory pids\n",
+			"/sys/fs/cgroup/cgroup.procs":       "1\n25\n",
+		})
+
+		controllers, err := cgroup.Delegate(context.Background(), cgroup.DelegateOptions{
+			FS:          fs,
+			Mounter:     mounter,
+			MaxAttempts: 3,
+		})
+		require.NoError(t, err)
+		require.Equal(t, []string{"cpuset", "cpu", "io", "memory", "pids"}, controllers)
+
+		require.Equal(t, []mount.FakeAction{
+			{Action: mount.FakeActionUnmount, Target: cgroup.Root},
+			{Action: mount.FakeActionMount, Target: cgroup.Root, Source: "cgroup", FSType: "cgroup2"},
+		}, mounter.GetLog())
+
+		raw, err := afero.ReadFile(fs, "/sys/fs/cgroup/cgroup.subtree_control")
+		require.NoError(t, err)
+		require.Equal(t, "+cpuset +cpu +io +memory +pids", string(raw))
+
+		// The fake filesystem only retains the last pid written.
+		raw, err = afero.ReadFile(fs, "/sys/fs/cgroup/init/cgroup.procs")
+		require.NoError(t, err)
+		require.Equal(t, "25", string(raw))
+	})
+
+	t.Run("SelectedControllers", func(t *testing.T) {
+		t.Parallel()
+
+		fs := xunixfake.NewMemFS()
+		writeFiles(t, fs, map[string]string{
+			"/sys/fs/cgroup/cgroup.controllers": "cpuset cpu io memory pids\n",
+			"/sys/fs/cgroup/cgroup.procs":       "1\n",
+		})
+
+		controllers, err := cgroup.Delegate(context.Background(), cgroup.DelegateOptions{
+			FS:          fs,
+			Mounter:     &mount.FakeMounter{},
+			Controllers: []string{"cpu", "memory"},
+		})
+		require.NoError(t, err)
+		require.Equal(t, []string{"cpu", "memory"}, controllers)
+
+		raw, err := afero.ReadFile(fs, "/sys/fs/cgroup/cgroup.subtree_control")
+		require.NoError(t, err)
+		require.Equal(t, "+cpu +memory", string(raw))
+	})
+
+	t.Run("CGroupV1", func(t *testing.T) {
+		t.Parallel()
+
+		mounter := &mount.FakeMounter{}
+		controllers, err := cgroup.Delegate(context.Background(), cgroup.DelegateOptions{
+			FS:      xunixfake.NewMemFS(),
+			Mounter: mounter,
+		})
+		require.NoError(t, err)
+		require.Empty(t, controllers)
+		require.Empty(t, mounter.GetLog())
+	})
+
+	t.Run("Canceled", func(t *testing.T) {
+		t.Parallel()
+
+		var fs afero.Fs = xunixfake.NewMemFS()
+		writeFiles(t, fs, map[string]string{
+			"/sys/fs/cgroup/cgroup.controllers": "cpu memory\n",
+			"/sys/fs/cgroup/cgroup.procs":       "1\n",
+		})
+		fs = &busyFS{Fs: fs, path: "/sys/fs/cgroup/cgroup.subtree_control"}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		// Retrying stops once the context is canceled regardless of the
+		// remaining attempts.
+		_, err := cgroup.Delegate(ctx, cgroup.DelegateOptions{
+			FS:          fs,
+			Mounter:     &mount.FakeMounter{},
+			MaxAttempts: 100,
+		})
+		require.ErrorIs(t, err, context.Canceled)
+
+		var derr *cgroup.DelegateError
+		require.True(t, xerrors.As(err, &derr))
+		require.Equal(t, cgroup.StepEnable, derr.Step)
+	})
+
+	for _, tc := range []struct {
+		Name        string
+		FS          map[string]string
+		FailWrite   string
+		Mounter     cgroup.Mounter
+		Controllers []string
+		Step        cgroup.DelegateStep
+		Attempts    int
+		Error       string
+	}{
+		{
+			Name:    "UnmountFails",
+			Mounter: &errMounter{unmount: xerrors.New("device busy")},
+			Step:    cgroup.StepUnmount,
+			Error:   "unmount /sys/fs/cgroup: device busy",
+		},
+		{
+			Name:    "MountFails",
+			Mounter: &errMounter{mount: xerrors.New("permission denied")},
+			Step:    cgroup.StepMount,
+			Error:   "mount /sys/fs/cgroup: permission denied",
+		},
+		{
+			Name:        "UnavailableController",
+			Controllers: []string{"cpu", "hugetlb"},
+			Step:        cgroup.StepEnable,
+			Error:       `controller "hugetlb" is not available`,
+		},
+		{
+			Name: "MissingProcs",
+			FS: map[string]string{
+				"/sys/fs/cgroup/cgroup.controllers": "cpu memory\n",
+			},
+			Step:  cgroup.StepMove,
+			Error: "move /sys/fs/cgroup/cgroup.procs",
+		},
+		{
+			Name:      "EnableFails",
+			FailWrite: "/sys/fs/cgroup/cgroup.subtree_control",
+			Step:      cgroup.StepEnable,
+			// MaxAttempts is 3.
+			Attempts: 3,
+			Error:    "enable /sys/fs/cgroup/cgroup.subtree_control (after 3 attempts): open /sys/fs/cgroup/cgroup.subtree_control: device or resource busy",
+		},
+	} {
+		tc := tc
+		t.Run(tc.Name, func(t *testing.T) {
+			t.Parallel()
+
+			var fs afero.Fs = xunixfake.NewMemFS()
+			if tc.FS == nil {
+				tc.FS = map[string]string{
+					"/sys/fs/cgroup/cgroup.controllers": "cpu memory\n",
+					"/sys/fs/cgroup/cgroup.procs":       "1\n",
+				}
+			}
+			writeFiles(t, fs, tc.FS)
+			if tc.FailWrite != "" {
+				fs = &busyFS{Fs: fs, path: tc.FailWrite}
+			}
+			if tc.Mounter == nil {
+				tc.Mounter = &mount.FakeMounter{}
+			}
+
+			_, err := cgroup.Delegate(context.Background(), cgroup.DelegateOptions{
+				FS:          fs,
+				Mounter:     tc.Mounter,
+				Controllers: tc.Controllers,
+				MaxAttempts: 3,
+			})
+			require.ErrorContains(t, err, tc.Error)
+
+			var derr *cgroup.DelegateError
+			require.True(t, xerrors.As(err, &derr))
+			require.Equal(t, tc.Step, derr.Step)
+			require.Equal(t, tc.Attempts, derr.Attempts)
+		})
+	}
+}
+
+// busyFS fails every write to path with EBUSY.
+type busyFS struct {
+	afero.Fs
+	path string
+}
+
+func (f *busyFS) OpenFile(name string, flag int, perm os.FileMode) (afero.File, error) {
+	if name == f.path && flag&(os.O_WRONLY|os.O_RDWR) != 0 {
+		return nil, &os.PathError{Op: "open", Path: name, Err: syscall.EBUSY}
+	}
+	return f.Fs.OpenFile(name, flag, perm)
+}
+
+type errMounter struct {
+	mount   error
+	unmount error
+}
+
+func (m *errMounter) Mount(string, string, string, []string) error {
+	return m.mount
+}
+
+func (m *errMounter) Unmount(string) error {
+	return m.unmount
+}
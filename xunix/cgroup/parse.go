@@ -0,0 +1,198 @@
+package cgroup
+
+import (
+	"bufio"
+	"bytes"
+	"strconv"
+	"strings"
+
+	"golang.org/x/xerrors"
+)
+
+// Hierarchy is an entry of /proc/<pid>/cgroup.
+type Hierarchy struct {
+	ID int
+	// Controllers are the controllers bound to a cgroupv1 hierarchy. Named
+	// hierarchies include their name (e.g. name=systemd). It is empty for
+	// the cgroupv2 hierarchy.
+	Controllers []string
+	// Path is the cgroup of the process relative to the root of the
+	// reader's cgroup namespace.
+	Path string
+}
+
+func (h Hierarchy) Version() Version {
+	if h.ID == 0 && len(h.Controllers) == 0 {
+		return V2
+	}
+	return V1
+}
+
+// ParseProcCGroup parses the contents of /proc/<pid>/cgroup.
+func ParseProcCGroup(raw []byte) ([]Hierarchy, error) {
+	var hierarchies []Hierarchy
+	scanner := bufio.NewScanner(bytes.NewReader(raw))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		// The path may contain colons.
+		fields := strings.SplitN(line, ":", 3)
+		if len(fields) != 3 {
+			return nil, xerrors.Errorf("expected 3 fields in %q", line)
+		}
+
+		id, err := strconv.Atoi(fields[0])
+		if err != nil {
+			return nil, xerrors.Errorf("hierarchy id %q not an int", fields[0])
+		}
+
+		var controllers []string
+		if fields[1] != "" {
+			controllers = strings.Split(fields[1], ",")
+		}
+
+		hierarchies = append(hierarchies, Hierarchy{
+			ID:          id,
+			Controllers: controllers,
+			Path:        fields[2],
+		})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, xerrors.Errorf("scan: %w", err)
+	}
+	return hierarchies, nil
+}
+
+// Mount is a mounted cgroup filesystem.
+type Mount struct {
+	Mountpoint string
+	// Root is the cgroup the mount is rooted at relative to the root of the
+	// reader's cgroup namespace.
+	Root    string
+	Version Version
+	// Controllers are the controllers of a cgroupv1 mount.
+	Controllers []string
+}
+
+// v1Controllers are the known cgroupv1 controllers. They are used to tell
+// controllers apart from other options of a cgroupv1 mount.
+var v1Controllers = map[string]bool{
+	"blkio":      true,
+	"cpu":        true,
+	"cpuacct":    true,
+	"cpuset":     true,
+	"devices":    true,
+	"freezer":    true,
+	"hugetlb":    true,
+	"memory":     true,
+	"misc":       true,
+	"net_cls":    true,
+	"net_prio":   true,
+	"perf_event": true,
+	"pids":       true,
+	"rdma":       true,
+}
+
+// ParseMountInfo parses the cgroup mounts from the contents of
+// /proc/<pid>/mountinfo.
+// See: https://man7.org/linux/man-pages/man5/proc_pid_mountinfo.5.html
+func ParseMountInfo(raw []byte) ([]Mount, error) {
+	var mounts []Mount
+	scanner := bufio.NewScanner(bytes.NewReader(raw))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		pre, post, ok := strings.Cut(line, " - ")
+		if !ok {
+			return nil, xerrors.Errorf("missing separator in %q", line)
+		}
+		preFields, postFields := strings.Fields(pre), strings.Fields(post)
+		if len(preFields) < 5 || len(postFields) < 3 {
+			return nil, xerrors.Errorf("unexpected mountinfo line %q", line)
+		}
+
+		mount := Mount{
+			Root:       unescapeMountInfo(preFields[3]),
+			Mountpoint: unescapeMountInfo(preFields[4]),
+		}
+		switch postFields[0] {
+		case "cgroup2":
+			mount.Version = V2
+		case "cgroup":
+			mount.Version = V1
+			for _, opt := range strings.Split(postFields[2], ",") {
+				if v1Controllers[opt] || strings.HasPrefix(opt, "name=") {
+					mount.Controllers = append(mount.Controllers, opt)
+				}
+			}
+		default:
+			continue
+		}
+		mounts = append(mounts, mount)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, xerrors.Errorf("scan: %w", err)
+	}
+	return mounts, nil
+}
+
+// unescapeMountInfo reverses the octal escaping of whitespace and
+// backslashes in mountinfo paths.
+func unescapeMountInfo(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) {
+			if v, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				sb.WriteByte(byte(v))
+				i += 3
+				continue
+			}
+		}
+		sb.WriteByte(s[i])
+	}
+	return sb.String()
+}
+
+// parseFlatKeyed parses a flat keyed file (e.g. memory.stat) where each
+// line is '<key> <value>'.
+func parseFlatKeyed(raw []byte) (map[string]int64, error) {
+	stats := make(map[string]int64)
+	for _, line := range strings.Split(string(raw), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 2 {
+			return nil, xerrors.Errorf("unexpected line %q", line)
+		}
+		v, err := parseValue(fields[1])
+		if err != nil {
+			return nil, xerrors.Errorf("parse %s: %w", fields[0], err)
+		}
+		stats[fields[0]] = v
+	}
+	return stats, nil
+}
+
+// parseValue parses a single cgroup value where 'max' indicates no limit.
+func parseValue(s string) (int64, error) {
+	s = strings.TrimSpace(s)
+	if s == "max" {
+		return Unlimited, nil
+	}
+	v, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, xerrors.Errorf("%q not an int: %w", s, err)
+	}
+	return v, nil
+}
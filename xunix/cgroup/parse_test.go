@@ -0,0 +1,114 @@
+package cgroup_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/coder/envbox/xunix/cgroup"
+)
+
+func TestParseProcCGroup(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		Name     string
+		Raw      string
+		Expected []cgroup.Hierarchy
+		Error    string
+	}{
+		{
+			Name: "Hybrid",
+			Raw:  hybridProc,
+			Expected: []cgroup.Hierarchy{
+				{ID: 12, Controllers: []string{"memory"}, Path: "/user.slice"},
+				{ID: 4, Controllers: []string{"cpu", "cpuacct"}, Path: "/user.slice"},
+				{ID: 1, Controllers: []string{"name=systemd"}, Path: "/user.slice/session-1.scope"},
+				{ID: 0, Path: "/user.slice/session-1.scope"},
+			},
+		},
+		{
+			Name:     "PathWithColon",
+			Raw:      "0::/system.slice/docker-abc.scope:foo\n",
+			Expected: []cgroup.Hierarchy{{ID: 0, Path: "/system.slice/docker-abc.scope:foo"}},
+		},
+		{
+			Name:  "MissingFields",
+			Raw:   "0:/foo\n",
+			Error: "expected 3 fields",
+		},
+		{
+			Name:  "InvalidID",
+			Raw:   "x::/foo\n",
+			Error: "not an int",
+		},
+	} {
+		tc := tc
+		t.Run(tc.Name, func(t *testing.T) {
+			t.Parallel()
+
+			hierarchies, err := cgroup.ParseProcCGroup([]byte(tc.Raw))
+			if tc.Error != "" {
+				require.ErrorContains(t, err, tc.Error)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.Expected, hierarchies)
+		})
+	}
+}
+
+func TestParseMountInfo(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		Name     string
+		Raw      string
+		Expected []cgroup.Mount
+		Error    string
+	}{
+		{
+			Name: "Hybrid",
+			Raw:  hybridMountInfo + "29 18 0:27 / /proc rw - proc proc rw\n",
+			Expected: []cgroup.Mount{
+				{Mountpoint: "/sys/fs/cgroup/unified", Root: "/", Version: cgroup.V2},
+				{Mountpoint: "/sys/fs/cgroup/systemd", Root: "/", Version: cgroup.V1, Controllers: []string{"name=systemd"}},
+				{Mountpoint: "/sys/fs/cgroup/cpu,cpuacct", Root: "/", Version: cgroup.V1, Controllers: []string{"cpu", "cpuacct"}},
+				{Mountpoint: "/sys/fs/cgroup/memory", Root: "/", Version: cgroup.V1, Controllers: []string{"memory"}},
+			},
+		},
+		{
+			// Optional fields vary in number.
+			Name: "OptionalFields",
+			Raw:  "30 29 0:26 /docker/abc /sys/fs/cgroup/pids ro master:14 shared:3 - cgroup cgroup rw,pids\n",
+			Expected: []cgroup.Mount{
+				{Mountpoint: "/sys/fs/cgroup/pids", Root: "/docker/abc", Version: cgroup.V1, Controllers: []string{"pids"}},
+			},
+		},
+		{
+			Name: "Escaped",
+			Raw:  `30 29 0:26 /my\040cgroup /mnt/cgroup\040root rw - cgroup2 cgroup2 rw` + "\n",
+			Expected: []cgroup.Mount{
+				{Mountpoint: "/mnt/cgroup root", Root: "/my cgroup", Version: cgroup.V2},
+			},
+		},
+		{
+			Name:  "MissingSeparator",
+			Raw:   "30 29 0:26 / /sys/fs/cgroup rw cgroup2 cgroup2 rw\n",
+			Error: "missing separator",
+		},
+	} {
+		tc := tc
+		t.Run(tc.Name, func(t *testing.T) {
+			t.Parallel()
+
+			mounts, err := cgroup.ParseMountInfo([]byte(tc.Raw))
+			if tc.Error != "" {
+				require.ErrorContains(t, err, tc.Error)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.Expected, mounts)
+		})
+	}
+}
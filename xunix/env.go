@@ -1,9 +1,16 @@
 package xunix
 
 import (
+	"bufio"
 	"context"
 	"fmt"
+	"io"
 	"os"
+	"path"
+	"regexp"
+	"strings"
+
+	"golang.org/x/xerrors"
 )
 
 type environKey struct{}
@@ -40,3 +47,243 @@ func MustLookupEnv(e string) string {
 	}
 	return env
 }
+
+// envNameRe matches the names renames and literals may assign to.
+var envNameRe = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+type envRuleKind int
+
+const (
+	envRulePass envRuleKind = iota
+	envRuleExclude
+	envRuleRename
+	envRuleLiteral
+	envRuleFile
+)
+
+type envRule struct {
+	kind envRuleKind
+	// pattern is the name or pattern of outer variables for envRulePass,
+	// envRuleExclude and envRuleRename, and the path for envRuleFile.
+	pattern string
+	// name and value are what envRuleRename and envRuleLiteral assign.
+	name  string
+	value string
+}
+
+// EnvSpec selects the variables passed from one environment to another.
+type EnvSpec struct {
+	rules []envRule
+}
+
+// ParseEnvSpec parses a list of environment passthrough entries. Each entry
+// is one of:
+//
+//	NAME          pass NAME through
+//	PATTERN       pass every variable matching PATTERN, e.g. KUBERNETES_*
+//	!PATTERN      don't pass variables matching PATTERN through
+//	OUTER=INNER   pass OUTER through renamed to INNER
+//	NAME:=VALUE   set NAME to the literal VALUE
+//	@PATH         load the variables in the env file at PATH
+//
+// Patterns use the syntax of path.Match. Exclusions only apply to variables
+// passed through by name or pattern, regardless of where they appear.
+func ParseEnvSpec(entries []string) (EnvSpec, error) {
+	var spec EnvSpec
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		rule, err := parseEnvRule(entry)
+		if err != nil {
+			return EnvSpec{}, xerrors.Errorf("invalid entry %q: %w", entry, err)
+		}
+		spec.rules = append(spec.rules, rule)
+	}
+	return spec, nil
+}
+
+func parseEnvRule(entry string) (envRule, error) {
+	switch {
+	case strings.HasPrefix(entry, "@"):
+		fpath := strings.TrimPrefix(entry, "@")
+		if !path.IsAbs(fpath) {
+			return envRule{}, xerrors.New("env file path must be absolute")
+		}
+		return envRule{kind: envRuleFile, pattern: fpath}, nil
+	case strings.HasPrefix(entry, "!"):
+		pattern := strings.TrimPrefix(entry, "!")
+		err := validateEnvPattern(pattern)
+		if err != nil {
+			return envRule{}, err
+		}
+		return envRule{kind: envRuleExclude, pattern: pattern}, nil
+	}
+
+	if name, value, ok := strings.Cut(entry, ":="); ok {
+		if !envNameRe.MatchString(name) {
+			return envRule{}, xerrors.Errorf("invalid name %q", name)
+		}
+		return envRule{kind: envRuleLiteral, name: name, value: value}, nil
+	}
+	if outer, inner, ok := strings.Cut(entry, "="); ok {
+		for _, name := range []string{outer, inner} {
+			if !envNameRe.MatchString(name) {
+				return envRule{}, xerrors.Errorf("invalid name %q, use NAME:=VALUE to set a literal value", name)
+			}
+		}
+		return envRule{kind: envRuleRename, pattern: outer, name: inner}, nil
+	}
+
+	err := validateEnvPattern(entry)
+	if err != nil {
+		return envRule{}, err
+	}
+	return envRule{kind: envRulePass, pattern: entry}, nil
+}
+
+func validateEnvPattern(pattern string) error {
+	if pattern == "" {
+		return xerrors.New("empty pattern")
+	}
+	_, err := path.Match(pattern, "")
+	if err != nil {
+		return xerrors.Errorf("invalid pattern %q: %w", pattern, err)
+	}
+	return nil
+}
+
+func matchEnv(pattern, name string) bool {
+	ok, _ := path.Match(pattern, name)
+	return ok
+}
+
+// Resolve returns the variables selected by the spec from the environment
+// returned by Environ(ctx). Env files are read from GetFS(ctx). Entries are
+// applied in order and a later entry overrides an earlier one that set the
+// same name, keeping the position of the first.
+func (s EnvSpec) Resolve(ctx context.Context) ([]Env, error) {
+	var (
+		outer    = parseEnviron(Environ(ctx))
+		envs     []Env
+		index    = map[string]int{}
+		excludes []string
+	)
+	set := func(name, value string) {
+		if i, ok := index[name]; ok {
+			envs[i].Value = value
+			return
+		}
+		index[name] = len(envs)
+		envs = append(envs, Env{Name: name, Value: value})
+	}
+	for _, r := range s.rules {
+		if r.kind == envRuleExclude {
+			excludes = append(excludes, r.pattern)
+		}
+	}
+	excluded := func(name string) bool {
+		for _, pattern := range excludes {
+			if matchEnv(pattern, name) {
+				return true
+			}
+		}
+		return false
+	}
+
+	for _, r := range s.rules {
+		switch r.kind {
+		case envRulePass:
+			for _, e := range outer {
+				if matchEnv(r.pattern, e.Name) && !excluded(e.Name) {
+					set(e.Name, e.Value)
+				}
+			}
+		case envRuleRename:
+			for _, e := range outer {
+				if e.Name == r.pattern {
+					set(r.name, e.Value)
+				}
+			}
+		case envRuleLiteral:
+			set(r.name, r.value)
+		case envRuleFile:
+			f, err := GetFS(ctx).Open(r.pattern)
+			if err != nil {
+				return nil, xerrors.Errorf("open env file: %w", err)
+			}
+			fenvs, err := ParseEnvFile(f)
+			_ = f.Close()
+			if err != nil {
+				return nil, xerrors.Errorf("parse env file %q: %w", r.pattern, err)
+			}
+			for _, e := range fenvs {
+				set(e.Name, e.Value)
+			}
+		}
+	}
+	return envs, nil
+}
+
+// parseEnviron splits the entries of an environment like os.Environ's into
+// names and values. Entries without a name are skipped. Names may repeat,
+// the last one wins.
+func parseEnviron(environ []string) []Env {
+	var (
+		envs  = make([]Env, 0, len(environ))
+		index = map[string]int{}
+	)
+	for _, kv := range environ {
+		name, value, ok := strings.Cut(kv, "=")
+		if !ok || name == "" {
+			continue
+		}
+		if i, ok := index[name]; ok {
+			envs[i].Value = value
+			continue
+		}
+		index[name] = len(envs)
+		envs = append(envs, Env{Name: name, Value: value})
+	}
+	return envs
+}
+
+// ParseEnvFile parses a file of NAME=VALUE lines like those read by
+// 'docker run --env-file'. Blank lines and lines starting with '#' are
+// skipped, an 'export ' prefix is allowed and values may be enclosed in
+// single or double quotes.
+func ParseEnvFile(r io.Reader) ([]Env, error) {
+	var (
+		scanner = bufio.NewScanner(r)
+		envs    = make([]Env, 0)
+		n       = 0
+	)
+
+	for scanner.Scan() {
+		n++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimPrefix(line, "export ")
+
+		name, value, ok := strings.Cut(line, "=")
+		name = strings.TrimSpace(name)
+		if !ok || !envNameRe.MatchString(name) {
+			return nil, xerrors.Errorf("line %d: expected NAME=VALUE", n)
+		}
+		value = strings.TrimSpace(value)
+		if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+			value = value[1 : len(value)-1]
+		}
+		envs = append(envs, Env{Name: name, Value: value})
+	}
+
+	err := scanner.Err()
+	if err != nil {
+		return nil, xerrors.Errorf("read env file: %w", err)
+	}
+	return envs, nil
+}
@@ -1,12 +1,17 @@
 package xunix_test
 
 import (
+	"context"
 	"os"
+	"path"
+	"strings"
 	"testing"
 
+	"github.com/spf13/afero"
 	"github.com/stretchr/testify/require"
 
 	"github.com/coder/envbox/xunix"
+	"github.com/coder/envbox/xunix/xunixfake"
 )
 
 func TestMustLookupEnv(t *testing.T) {
@@ -37,3 +42,159 @@ func TestMustLookupEnv(t *testing.T) {
 		_ = xunix.MustLookupEnv("ASDasdf")
 	})
 }
+
+func TestEnvSpec(t *testing.T) {
+	t.Parallel()
+
+	environ := []string{
+		"FOO=bar",
+		"URL=postgres://db?sslmode=disable&a=b",
+		"KUBERNETES_SERVICE_HOST=10.0.0.1",
+		"KUBERNETES_SECRET=hunter2",
+		"SECRET_TOKEN=abc",
+		"EMPTY=",
+		"=ignored",
+		"malformed",
+	}
+
+	for _, tc := range []struct {
+		name     string
+		spec     []string
+		envFile  string
+		expected []xunix.Env
+		error    string
+	}{
+		{
+			name: "Names",
+			spec: []string{"FOO", "URL", "EMPTY", "MISSING"},
+			expected: []xunix.Env{
+				{Name: "FOO", Value: "bar"},
+				{Name: "URL", Value: "postgres://db?sslmode=disable&a=b"},
+				{Name: "EMPTY", Value: ""},
+			},
+		},
+		{
+			name: "Exclusions",
+			spec: []string{"!*_SECRET", "KUBERNETES_*", "*_TOKEN", "!SECRET_*"},
+			expected: []xunix.Env{
+				{Name: "KUBERNETES_SERVICE_HOST", Value: "10.0.0.1"},
+			},
+		},
+		{
+			name: "RenameAndLiteral",
+			spec: []string{"FOO=BAR", "GREETING:=hello=world", "!FOO", "SECRET_TOKEN=TOKEN"},
+			expected: []xunix.Env{
+				{Name: "BAR", Value: "bar"},
+				{Name: "GREETING", Value: "hello=world"},
+				{Name: "TOKEN", Value: "abc"},
+			},
+		},
+		{
+			name:    "Precedence",
+			spec:    []string{"@/etc/inner.env", "FOO", "BAZ:=literal", "FOO:=override"},
+			envFile: "# A comment.\nexport BAZ=\"from file\"\nQUX='single'\nFOO=file\n",
+			expected: []xunix.Env{
+				{Name: "BAZ", Value: "literal"},
+				{Name: "QUX", Value: "single"},
+				{Name: "FOO", Value: "override"},
+			},
+		},
+		{
+			name:  "InvalidRename",
+			spec:  []string{"FOO=not a name"},
+			error: "use NAME:=VALUE",
+		},
+		{
+			name:  "InvalidPattern",
+			spec:  []string{"!FOO["},
+			error: "invalid pattern",
+		},
+		{
+			name:  "RelativeEnvFile",
+			spec:  []string{"@inner.env"},
+			error: "must be absolute",
+		},
+		{
+			name:  "MissingEnvFile",
+			spec:  []string{"@/etc/inner.env"},
+			error: "open env file",
+		},
+		{
+			name:    "MalformedEnvFile",
+			spec:    []string{"@/etc/inner.env"},
+			envFile: "FOO=bar\nnot an assignment\n",
+			error:   "line 2",
+		},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			fs := xunixfake.NewMemFS()
+			if tc.envFile != "" {
+				require.NoError(t, afero.WriteFile(fs, "/etc/inner.env", []byte(tc.envFile), 0o600))
+			}
+			ctx := xunix.WithFS(context.Background(), fs)
+			ctx = xunix.WithEnvironFn(ctx, func() []string { return environ })
+
+			spec, err := xunix.ParseEnvSpec(tc.spec)
+			if err == nil {
+				var envs []xunix.Env
+				envs, err = spec.Resolve(ctx)
+				if tc.error == "" {
+					require.NoError(t, err)
+					require.Equal(t, tc.expected, envs)
+					return
+				}
+			}
+			require.ErrorContains(t, err, tc.error)
+		})
+	}
+}
+
+func FuzzEnvSpec(f *testing.F) {
+	f.Add("FOO", "bar", "FOO")
+	f.Add("URL", "a=b=c", "U*")
+	f.Add("KUBERNETES_PORT", "tcp://10.0.0.1:443", "!KUBERNETES_*")
+	f.Add("A", "", "A=B")
+	f.Add("NAME", "x", "NAME:=y,z")
+
+	f.Fuzz(func(t *testing.T, name, value, entry string) {
+		if name == "" || strings.ContainsAny(name, "=\x00") {
+			t.Skip()
+		}
+		environ := []string{"OTHER=other", name + "=" + value}
+		ctx := xunix.WithFS(context.Background(), xunixfake.NewMemFS())
+		ctx = xunix.WithEnvironFn(ctx, func() []string { return environ })
+
+		// Passing a variable by name must preserve its value exactly.
+		if name == strings.TrimSpace(name) && !strings.ContainsAny(name, "*?[\\!@:") {
+			spec, err := xunix.ParseEnvSpec([]string{name})
+			require.NoError(t, err)
+			envs, err := spec.Resolve(ctx)
+			require.NoError(t, err)
+			require.Equal(t, []xunix.Env{{Name: name, Value: value}}, envs)
+		}
+
+		spec, err := xunix.ParseEnvSpec([]string{"*", entry})
+		if err != nil {
+			return
+		}
+		envs, err := spec.Resolve(ctx)
+		if err != nil {
+			// Only env files may fail to resolve.
+			require.True(t, strings.HasPrefix(strings.TrimSpace(entry), "@"), err)
+			return
+		}
+
+		seen := map[string]bool{}
+		for _, e := range envs {
+			require.False(t, seen[e.Name], "duplicate name %q", e.Name)
+			seen[e.Name] = true
+			if pattern, ok := strings.CutPrefix(strings.TrimSpace(entry), "!"); ok {
+				matched, _ := path.Match(pattern, e.Name)
+				require.False(t, matched, "%q is excluded by %q", e.Name, entry)
+			}
+		}
+	})
+}
@@ -4,9 +4,11 @@ import (
 	"context"
 	"io/fs"
 	"os"
+	"syscall"
 
 	"github.com/spf13/afero"
 	"golang.org/x/sys/unix"
+	"golang.org/x/xerrors"
 )
 
 type FS interface {
@@ -14,6 +16,8 @@ type FS interface {
 	Mknod(path string, mode uint32, dev int) error
 	LStat(path string) (fs.FileInfo, error)
 	Readlink(path string) (string, error)
+	// Lchown is like Chown but doesn't follow symbolic links.
+	Lchown(path string, uid, gid int) error
 }
 
 type fsKey struct{}
@@ -47,3 +51,48 @@ func (*osFS) LStat(path string) (fs.FileInfo, error) {
 func (*osFS) Readlink(path string) (string, error) {
 	return os.Readlink(path)
 }
+
+func (*osFS) Lchown(path string, uid, gid int) error {
+	return os.Lchown(path, uid, gid)
+}
+
+// Lgetxattr returns the value of the extended attribute attr of path
+// without following symbolic links.
+func (*osFS) Lgetxattr(path, attr string) ([]byte, error) {
+	for {
+		size, err := unix.Lgetxattr(path, attr, nil)
+		if err != nil {
+			return nil, &os.PathError{Op: "lgetxattr", Path: path, Err: err}
+		}
+		buf := make([]byte, size)
+		n, err := unix.Lgetxattr(path, attr, buf)
+		if xerrors.Is(err, unix.ERANGE) {
+			// The attribute grew in between calls.
+			continue
+		}
+		if err != nil {
+			return nil, &os.PathError{Op: "lgetxattr", Path: path, Err: err}
+		}
+		return buf[:n], nil
+	}
+}
+
+// Lsetxattr sets the extended attribute attr of path without following
+// symbolic links.
+func (*osFS) Lsetxattr(path, attr string, data []byte) error {
+	err := unix.Lsetxattr(path, attr, data, 0)
+	if err != nil {
+		return &os.PathError{Op: "lsetxattr", Path: path, Err: err}
+	}
+	return nil
+}
+
+// FileOwner returns the UID and GID of the owner of the file described by
+// fi. It returns false if fi doesn't carry ownership.
+func FileOwner(fi fs.FileInfo) (int, int, bool) {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok || st == nil {
+		return 0, 0, false
+	}
+	return int(st.Uid), int(st.Gid), true
+}
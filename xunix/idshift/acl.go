@@ -0,0 +1,65 @@
+package idshift
+
+import (
+	"encoding/binary"
+
+	"golang.org/x/xerrors"
+)
+
+// XattrFS is implemented by filesystems that support extended attributes.
+// The IDs in POSIX ACLs are only remapped on such filesystems.
+type XattrFS interface {
+	Lgetxattr(path, attr string) ([]byte, error)
+	Lsetxattr(path, attr string, data []byte) error
+}
+
+// aclXattrs are the extended attributes POSIX ACLs are stored in.
+var aclXattrs = []string{
+	"system.posix_acl_access",
+	"system.posix_acl_default",
+}
+
+// See include/uapi/linux/posix_acl_xattr.h.
+const (
+	aclXattrVersion   = 2
+	aclXattrHeaderLen = 4
+	aclXattrEntryLen  = 8
+
+	aclUser  = 0x02
+	aclGroup = 0x08
+)
+
+// remapACL returns the ACL xattr value with the IDs of named user and
+// group entries mapped by m. It returns false if no entry changed.
+func remapACL(data []byte, m Map) ([]byte, bool, error) {
+	if len(data) < aclXattrHeaderLen || (len(data)-aclXattrHeaderLen)%aclXattrEntryLen != 0 {
+		return nil, false, xerrors.Errorf("malformed ACL of %d bytes", len(data))
+	}
+	if v := binary.LittleEndian.Uint32(data); v != aclXattrVersion {
+		return nil, false, xerrors.Errorf("unsupported ACL version %d", v)
+	}
+
+	out := append([]byte(nil), data...)
+	changed := false
+	for off := aclXattrHeaderLen; off < len(out); off += aclXattrEntryLen {
+		var (
+			tag = binary.LittleEndian.Uint16(out[off:])
+			id  = int(binary.LittleEndian.Uint32(out[off+4:]))
+			to  int
+		)
+		switch tag {
+		case aclUser:
+			to = m.uid(id)
+		case aclGroup:
+			to = m.gid(id)
+		default:
+			continue
+		}
+		if to != id {
+			//nolint:gosec // IDs are validated to fit in a uint32.
+			binary.LittleEndian.PutUint32(out[off+4:], uint32(to))
+			changed = true
+		}
+	}
+	return out, changed, nil
+}
@@ -0,0 +1,279 @@
+// Package idshift rewrites the ownership of directory trees, e.g. when the
+// IDs a volume is shifted to for a user namespace change.
+package idshift
+
+import (
+	"context"
+	"io/fs"
+	"math"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/spf13/afero"
+	"golang.org/x/xerrors"
+
+	"github.com/coder/envbox/xunix"
+)
+
+// Range maps the Size IDs beginning at From to the IDs beginning at To.
+type Range struct {
+	From int `json:"from"`
+	To   int `json:"to"`
+	Size int `json:"size"`
+}
+
+func (r Range) contains(id int) bool {
+	return id >= r.From && id < r.From+r.Size
+}
+
+func overlap(aStart, aSize, bStart, bSize int) bool {
+	return aStart < bStart+bSize && bStart < aStart+aSize
+}
+
+// Map maps the owners of files. IDs that aren't in a range are left
+// untouched.
+type Map struct {
+	UIDs []Range `json:"uids"`
+	GIDs []Range `json:"gids"`
+}
+
+// Validate ensures that every ID is mapped by at most one range and that
+// no mapped ID is mapped again. The latter makes Shift idempotent but
+// rules out shifting a range by less than its size in one go, e.g. from
+// offset 100000 to 131072 with 65536 IDs.
+func (m Map) Validate() error {
+	for _, ids := range []struct {
+		kind   string
+		ranges []Range
+	}{{"uid", m.UIDs}, {"gid", m.GIDs}} {
+		kind, ranges := ids.kind, ids.ranges
+		for i, a := range ranges {
+			if a.From < 0 || a.To < 0 || a.Size <= 0 {
+				return xerrors.Errorf("invalid %s range %d:%d:%d", kind, a.From, a.To, a.Size)
+			}
+			if a.From+a.Size > math.MaxUint32 || a.To+a.Size > math.MaxUint32 {
+				return xerrors.Errorf("%s range %d:%d:%d exceeds the maximum ID", kind, a.From, a.To, a.Size)
+			}
+			for j, b := range ranges {
+				if i != j && overlap(a.From, a.Size, b.From, b.Size) {
+					return xerrors.Errorf("%s ranges %d:%d:%d and %d:%d:%d overlap", kind, a.From, a.To, a.Size, b.From, b.To, b.Size)
+				}
+				// Shift can't tell whether a file owned by an ID in b was
+				// already shifted by a, so resuming or repeating a run
+				// would shift it twice.
+				if overlap(a.To, a.Size, b.From, b.Size) {
+					return xerrors.Errorf("%s range %d:%d:%d maps to IDs that are mapped again by %d:%d:%d, which would shift files twice if the run is resumed or repeated: shift through an intermediate range that overlaps neither in two runs instead",
+						kind, a.From, a.To, a.Size, b.From, b.To, b.Size)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func (m Map) uid(id int) int {
+	return mapID(m.UIDs, id)
+}
+
+func (m Map) gid(id int) int {
+	return mapID(m.GIDs, id)
+}
+
+func mapID(ranges []Range, id int) int {
+	for _, r := range ranges {
+		if r.contains(id) {
+			return r.To + id - r.From
+		}
+	}
+	return id
+}
+
+// Progress is the progress of Shift.
+type Progress struct {
+	// Visited is the number of files walked, including skipped files.
+	Visited int `json:"visited"`
+	// Changed is the number of files whose owner or ACLs were changed.
+	Changed int `json:"changed"`
+}
+
+// Change is a change to the owner of a file.
+type Change struct {
+	Path   string
+	UID    int
+	GID    int
+	NewUID int
+	NewGID int
+	// ACL is set if the IDs in the file's ACLs changed.
+	ACL bool
+}
+
+type Options struct {
+	FS   xunix.FS
+	Root string
+	Map  Map
+	// DryRun reports changes without making them.
+	DryRun bool
+	// Skip is the number of files to skip, i.e. the Visited of an
+	// interrupted run. Files are walked in lexical order so an unmodified
+	// tree is walked the same way every time.
+	Skip int
+	// OnChange is called for every changed file.
+	OnChange func(Change)
+	// OnProgress is called every ProgressInterval visited files.
+	OnProgress       func(Progress)
+	ProgressInterval int
+}
+
+// Shift changes the owner of every file below Root, including Root, that
+// is owned by an ID in Map. The IDs of named users and groups in POSIX ACLs
+// are mapped as well if the filesystem supports extended attributes. It
+// doesn't cross into other filesystems. Symbolic links themselves are
+// chowned but not followed and setuid and setgid bits, which the kernel
+// clears on chown, are restored.
+//
+// Shift is idempotent for a valid Map so an interrupted run can be resumed
+// by running it again, optionally skipping the files already visited. It
+// stops when ctx is done, returning the progress made so far and the
+// context's error.
+func Shift(ctx context.Context, opts Options) (Progress, error) {
+	var p Progress
+
+	err := opts.Map.Validate()
+	if err != nil {
+		return p, xerrors.Errorf("invalid map: %w", err)
+	}
+
+	root, err := opts.FS.LStat(opts.Root)
+	if err != nil {
+		return p, xerrors.Errorf("stat root: %w", err)
+	}
+	rootDev, hasDev := device(root)
+	xfs, _ := opts.FS.(XattrFS)
+
+	err = afero.Walk(opts.FS, opts.Root, func(fpath string, _ os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		fi, err := opts.FS.LStat(fpath)
+		if err != nil {
+			return xerrors.Errorf("stat %q: %w", fpath, err)
+		}
+		if dev, ok := device(fi); hasDev && ok && dev != rootDev {
+			if fi.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		p.Visited++
+		if p.Visited <= opts.Skip {
+			return nil
+		}
+		err = shiftFile(opts, xfs, fpath, fi, &p)
+		if err != nil {
+			return err
+		}
+		if opts.OnProgress != nil && opts.ProgressInterval > 0 && p.Visited%opts.ProgressInterval == 0 {
+			opts.OnProgress(p)
+		}
+		return nil
+	})
+	return p, err
+}
+
+// shiftFile shifts a single file, counting it in p if it changed.
+func shiftFile(opts Options, xfs XattrFS, fpath string, fi fs.FileInfo, p *Progress) error {
+	uid, gid, ok := xunix.FileOwner(fi)
+	if !ok {
+		return nil
+	}
+	change := Change{
+		Path:   fpath,
+		UID:    uid,
+		GID:    gid,
+		NewUID: opts.Map.uid(uid),
+		NewGID: opts.Map.gid(gid),
+	}
+
+	var acls map[string][]byte
+	if xfs != nil && fi.Mode()&fs.ModeSymlink == 0 {
+		var err error
+		acls, err = remapACLs(xfs, fpath, opts.Map)
+		if err != nil {
+			return err
+		}
+		change.ACL = len(acls) > 0
+	}
+
+	if change.NewUID == uid && change.NewGID == gid && !change.ACL {
+		return nil
+	}
+	p.Changed++
+	if opts.OnChange != nil {
+		opts.OnChange(change)
+	}
+	if opts.DryRun {
+		return nil
+	}
+
+	if change.NewUID != uid || change.NewGID != gid {
+		err := opts.FS.Lchown(fpath, change.NewUID, change.NewGID)
+		if err != nil {
+			return xerrors.Errorf("chown %q: %w", fpath, err)
+		}
+		if fi.Mode()&(fs.ModeSetuid|fs.ModeSetgid) != 0 {
+			err = opts.FS.Chmod(fpath, fi.Mode())
+			if err != nil {
+				return xerrors.Errorf("restore mode of %q: %w", fpath, err)
+			}
+		}
+	}
+	for attr, data := range acls {
+		err := xfs.Lsetxattr(fpath, attr, data)
+		if err != nil {
+			return xerrors.Errorf("set %s of %q: %w", attr, fpath, err)
+		}
+	}
+	return nil
+}
+
+// remapACLs returns the ACL xattrs of fpath that change under m.
+func remapACLs(xfs XattrFS, fpath string, m Map) (map[string][]byte, error) {
+	var acls map[string][]byte
+	for _, attr := range aclXattrs {
+		data, err := xfs.Lgetxattr(fpath, attr)
+		if xerrors.Is(err, syscall.ENODATA) || xerrors.Is(err, syscall.ENOTSUP) {
+			continue
+		}
+		if err != nil {
+			return nil, xerrors.Errorf("get %s of %q: %w", attr, fpath, err)
+		}
+
+		data, changed, err := remapACL(data, m)
+		if err != nil {
+			return nil, xerrors.Errorf("remap %s of %q: %w", attr, fpath, err)
+		}
+		if !changed {
+			continue
+		}
+		if acls == nil {
+			acls = map[string][]byte{}
+		}
+		acls[attr] = data
+	}
+	return acls, nil
+}
+
+func device(fi fs.FileInfo) (uint64, bool) {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok || st == nil {
+		return 0, false
+	}
+	//nolint:unconvert // Dev is uint32 on some platforms.
+	return uint64(st.Dev), true
+}
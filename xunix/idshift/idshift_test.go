@@ -0,0 +1,220 @@
+package idshift_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/xerrors"
+
+	"github.com/coder/envbox/xunix/idshift"
+	"github.com/coder/envbox/xunix/xunixfake"
+)
+
+func TestShift(t *testing.T) {
+	t.Parallel()
+
+	t.Run("OK", func(t *testing.T) {
+		t.Parallel()
+
+		fs := newFS(t, map[string]xunixfake.FileOwner{
+			"/home/coder/.bashrc":    {UID: 101000, GID: 101000},
+			"/home/coder/src/a.go":   {UID: 101000, GID: 100000},
+			"/home/coder/root-owned": {UID: 100000, GID: 100000},
+		})
+		require.NoError(t, fs.Chown("/home/coder", 101000, 101000))
+
+		var updates []idshift.Progress
+		progress, err := idshift.Shift(context.Background(), idshift.Options{
+			FS:   fs,
+			Root: "/home/coder",
+			Map: idshift.Map{
+				UIDs: []idshift.Range{{From: 101000, To: 101001, Size: 1}},
+				GIDs: []idshift.Range{{From: 101000, To: 101001, Size: 1}},
+			},
+			OnProgress:       func(p idshift.Progress) { updates = append(updates, p) },
+			ProgressInterval: 2,
+		})
+		require.NoError(t, err)
+		// /home/coder, .bashrc, root-owned, src and src/a.go.
+		require.Equal(t, idshift.Progress{Visited: 5, Changed: 3}, progress)
+		require.Len(t, updates, 2)
+
+		for fpath, want := range map[string]xunixfake.FileOwner{
+			"/home/coder":            {UID: 101001, GID: 101001},
+			"/home/coder/.bashrc":    {UID: 101001, GID: 101001},
+			"/home/coder/src/a.go":   {UID: 101001, GID: 100000},
+			"/home/coder/root-owned": {UID: 100000, GID: 100000},
+		} {
+			owner, _ := fs.GetFileOwner(fpath)
+			require.Equal(t, want, owner, fpath)
+		}
+	})
+
+	t.Run("Canceled", func(t *testing.T) {
+		t.Parallel()
+
+		fs := newFS(t, map[string]xunixfake.FileOwner{
+			"/data/a": {UID: 1, GID: 1},
+		})
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		progress, err := idshift.Shift(ctx, idshift.Options{
+			FS:   fs,
+			Root: "/data",
+			Map:  idshift.Map{UIDs: []idshift.Range{{From: 1, To: 2, Size: 1}}},
+		})
+		require.True(t, xerrors.Is(err, context.Canceled))
+		require.Zero(t, progress)
+
+		// Resuming completes the shift.
+		progress, err = idshift.Shift(context.Background(), idshift.Options{
+			FS:   fs,
+			Root: "/data",
+			Map:  idshift.Map{UIDs: []idshift.Range{{From: 1, To: 2, Size: 1}}},
+		})
+		require.NoError(t, err)
+		require.Equal(t, 1, progress.Changed)
+		owner, _ := fs.GetFileOwner("/data/a")
+		require.Equal(t, xunixfake.FileOwner{UID: 2, GID: 1}, owner)
+	})
+
+	t.Run("Offset", func(t *testing.T) {
+		t.Parallel()
+
+		fs := newFS(t, map[string]xunixfake.FileOwner{
+			"/vol/root":    {UID: 100000, GID: 100000},
+			"/vol/user":    {UID: 101000, GID: 101000},
+			"/vol/nobody":  {UID: 65534, GID: 65534},
+			"/vol/setgid":  {UID: 101000, GID: 101000},
+			"/vol/dry-run": {UID: 101000, GID: 101000},
+		})
+		// An ACL granting user 1000 and group 1001 of the inner container
+		// access.
+		acl := []byte{
+			2, 0, 0, 0,
+			0x01, 0, 6, 0, 0xff, 0xff, 0xff, 0xff,
+			0x02, 0, 6, 0, 0x88, 0x8a, 0x01, 0, // 101000
+			0x08, 0, 4, 0, 0x89, 0x8a, 0x01, 0, // 101001
+		}
+		require.NoError(t, fs.Lsetxattr("/vol/user", "system.posix_acl_access", acl))
+
+		offsets := idshift.Map{
+			UIDs: []idshift.Range{{From: 100000, To: 200000, Size: 65536}},
+			GIDs: []idshift.Range{{From: 100000, To: 200000, Size: 65536}},
+		}
+
+		var changes []idshift.Change
+		progress, err := idshift.Shift(context.Background(), idshift.Options{
+			FS:       fs,
+			Root:     "/vol/dry-run",
+			Map:      offsets,
+			DryRun:   true,
+			OnChange: func(c idshift.Change) { changes = append(changes, c) },
+		})
+		require.NoError(t, err)
+		require.Equal(t, idshift.Progress{Visited: 1, Changed: 1}, progress)
+		require.Equal(t, []idshift.Change{{Path: "/vol/dry-run", UID: 101000, GID: 101000, NewUID: 201000, NewGID: 201000}}, changes)
+		owner, _ := fs.GetFileOwner("/vol/dry-run")
+		require.Equal(t, xunixfake.FileOwner{UID: 101000, GID: 101000}, owner)
+
+		// Skip /vol and /vol/dry-run as if they were shifted by an
+		// interrupted run.
+		progress, err = idshift.Shift(context.Background(), idshift.Options{
+			FS:   fs,
+			Root: "/vol",
+			Map:  offsets,
+			Skip: 2,
+		})
+		require.NoError(t, err)
+		require.Equal(t, idshift.Progress{Visited: 6, Changed: 3}, progress)
+
+		for fpath, want := range map[string]xunixfake.FileOwner{
+			"/vol/root":    {UID: 200000, GID: 200000},
+			"/vol/user":    {UID: 201000, GID: 201000},
+			"/vol/nobody":  {UID: 65534, GID: 65534},
+			"/vol/setgid":  {UID: 201000, GID: 201000},
+			"/vol/dry-run": {UID: 101000, GID: 101000},
+		} {
+			owner, _ := fs.GetFileOwner(fpath)
+			require.Equal(t, want, owner, fpath)
+		}
+
+		got, err := fs.Lgetxattr("/vol/user", "system.posix_acl_access")
+		require.NoError(t, err)
+		require.Equal(t, []byte{
+			2, 0, 0, 0,
+			0x01, 0, 6, 0, 0xff, 0xff, 0xff, 0xff,
+			0x02, 0, 6, 0, 0x28, 0x11, 0x03, 0, // 201000
+			0x08, 0, 4, 0, 0x29, 0x11, 0x03, 0, // 201001
+		}, got)
+	})
+}
+
+func TestMapValidate(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		name  string
+		m     idshift.Map
+		error string
+	}{
+		{
+			name: "OK",
+			m: idshift.Map{
+				UIDs: []idshift.Range{{From: 100000, To: 200000, Size: 65536}, {From: 0, To: 300000, Size: 1}},
+			},
+		},
+		{
+			name:  "InvalidSize",
+			m:     idshift.Map{UIDs: []idshift.Range{{From: 1, To: 2}}},
+			error: "invalid uid range 1:2:0",
+		},
+		{
+			name: "Overlap",
+			m: idshift.Map{
+				GIDs: []idshift.Range{{From: 100000, To: 300000, Size: 65536}, {From: 165535, To: 400000, Size: 1}},
+			},
+			error: "gid ranges 100000:300000:65536 and 165535:400000:1 overlap",
+		},
+		{
+			// Shifting by less than the size of the range isn't idempotent.
+			name:  "MappedAgain",
+			m:     idshift.Map{UIDs: []idshift.Range{{From: 100000, To: 110000, Size: 65536}}},
+			error: "uid range 100000:110000:65536 maps to IDs that are mapped again by 100000:110000:65536",
+		},
+		{
+			name: "MappedAgainByOther",
+			m: idshift.Map{
+				UIDs: []idshift.Range{{From: 1000, To: 2000, Size: 1}, {From: 2000, To: 3000, Size: 1}},
+			},
+			error: "uid range 1000:2000:1 maps to IDs that are mapped again by 2000:3000:1",
+		},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			err := tc.m.Validate()
+			if tc.error == "" {
+				require.NoError(t, err)
+				return
+			}
+			require.ErrorContains(t, err, tc.error)
+		})
+	}
+}
+
+// newFS creates the files and chowns them to their owners.
+func newFS(t *testing.T, files map[string]xunixfake.FileOwner) *xunixfake.MemFS {
+	t.Helper()
+
+	fs := xunixfake.NewMemFS()
+	for fpath, owner := range files {
+		require.NoError(t, afero.WriteFile(fs, fpath, []byte("hi"), 0o644))
+		require.NoError(t, fs.Chown(fpath, owner.UID, owner.GID))
+	}
+	return fs
+}
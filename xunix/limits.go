@@ -0,0 +1,263 @@
+package xunix
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"golang.org/x/xerrors"
+
+	"cdr.dev/slog/v3"
+
+	"github.com/coder/envbox/xunix/cgroup"
+)
+
+// CGroupLimits are the limits imposed on the cgroup envbox is running in.
+// The inner container can never be given more than these.
+type CGroupLimits struct {
+	CGroup CGroup
+	// PidsMax is the maximum number of tasks, -1 if unlimited.
+	PidsMax int64
+	// MemoryMax is the memory limit in bytes, -1 if unlimited.
+	MemoryMax int64
+	// CPUSet is the list of usable CPUs (e.g. "0-3,6"). It is empty if the
+	// cpuset controller is unavailable.
+	CPUSet string
+	// IOWeight is true if the io (cgroupv2) or blkio (cgroupv1) controller
+	// supports proportional weights.
+	IOWeight bool
+}
+
+// ReadCGroupLimits reads the limits of the cgroup envbox is running in.
+// Controllers that aren't available are reported as unlimited. Limits set
+// on ancestors of the cgroup are taken into account.
+//
+// Relevant paths for cgroupv2:
+// - /proc/self/cgroup
+// - /sys/fs/cgroup/<self>/{cgroup.controllers,pids.max,memory.max,cpuset.cpus.effective}
+//
+// Relevant paths for cgroupv1:
+// - /sys/fs/cgroup/pids/<self>/pids.max
+// - /sys/fs/cgroup/memory/<self>/memory.limit_in_bytes
+// - /sys/fs/cgroup/cpuset/<self>/cpuset.effective_cpus
+// - /sys/fs/cgroup/blkio/<self>/blkio.weight
+func ReadCGroupLimits(ctx context.Context) (CGroupLimits, error) {
+	cg, err := cgroup.Load(GetFS(ctx))
+	if err != nil {
+		return CGroupLimits{}, xerrors.Errorf("load cgroups: %w", err)
+	}
+
+	limits := CGroupLimits{
+		CGroup:    cg.Version("memory"),
+		PidsMax:   -1,
+		MemoryMax: -1,
+	}
+
+	limits.PidsMax, err = readLimit(cg, "pids", "pids.max")
+	if err != nil {
+		return CGroupLimits{}, err
+	}
+
+	memoryFile := "memory.limit_in_bytes"
+	if cg.Version("memory") == CGroupV2 {
+		memoryFile = "memory.max"
+	}
+	limits.MemoryMax, err = readLimit(cg, "memory", memoryFile)
+	if err != nil {
+		return CGroupLimits{}, err
+	}
+
+	cpusetFile := "cpuset.effective_cpus"
+	if cg.Version("cpuset") == CGroupV2 {
+		cpusetFile = "cpuset.cpus.effective"
+	}
+	raw, err := cg.ReadFile("cpuset", cpusetFile)
+	if err == nil {
+		limits.CPUSet = string(bytes.TrimSpace(raw))
+	}
+
+	if cg.Version("blkio") == CGroupV2 {
+		raw, err = cg.ReadFile("io", "cgroup.controllers")
+		if err == nil {
+			for _, c := range strings.Fields(string(raw)) {
+				if c == "io" {
+					limits.IOWeight = true
+				}
+			}
+		}
+	} else {
+		for _, name := range []string{"blkio.weight", "blkio.bfq.weight"} {
+			if _, err := cg.ReadFile("blkio", name); err == nil {
+				limits.IOWeight = true
+				break
+			}
+		}
+	}
+
+	return limits, nil
+}
+
+// readLimit reads a limit that is reported as unlimited if the controller
+// isn't available.
+func readLimit(cg *cgroup.CGroups, controller, name string) (int64, error) {
+	limit, err := cg.ReadLimit(controller, name)
+	if err != nil {
+		if xerrors.Is(err, os.ErrNotExist) || !cg.Available(controller) {
+			return -1, nil
+		}
+		return 0, xerrors.Errorf("read %s: %w", name, err)
+	}
+	return limit, nil
+}
+
+// MemoryLimit is the memory limit of a cgroup.
+type MemoryLimit struct {
+	// Limit is the limit in bytes, -1 if unlimited.
+	Limit  int64
+	CGroup CGroup
+}
+
+// ReadMemoryLimit attempts to read the memory limit from the current
+// container context. The most restrictive limit of the cgroup and its
+// ancestors is returned. For cgroupv2 the lower of memory.max and
+// memory.high is used since exceeding memory.high results in heavy
+// throttling.
+//
+// Relevant paths for cgroupv2:
+// - /proc/self/cgroup
+// - /sys/fs/cgroup/<self>/memory.max
+// - /sys/fs/cgroup/<self>/memory.high
+//
+// Relevant paths for cgroupv1:
+// - /sys/fs/cgroup/memory/<self>/memory.limit_in_bytes
+func ReadMemoryLimit(ctx context.Context, log slog.Logger) (MemoryLimit, error) {
+	cg, err := cgroup.Load(GetFS(ctx))
+	if err != nil {
+		return MemoryLimit{}, xerrors.Errorf("load cgroups: %w", err)
+	}
+	log.Debug(ctx, "reading memory limit", slog.F("cgroup_mode", cg.Mode.String()))
+
+	limit, v, err := cg.MemoryLimit()
+	if err != nil {
+		return MemoryLimit{}, xerrors.Errorf("read memory limit: %w", err)
+	}
+
+	return MemoryLimit{Limit: limit, CGroup: v}, nil
+}
+
+// ParseCPUSet parses a cpuset list (e.g. "0-3,6") into a sorted list of
+// CPUs.
+func ParseCPUSet(s string) ([]int, error) {
+	set := make(map[int]struct{})
+	for _, part := range strings.Split(strings.TrimSpace(s), ",") {
+		if part == "" {
+			continue
+		}
+		lo, hi, isRange := strings.Cut(part, "-")
+		start, err := strconv.Atoi(lo)
+		if err != nil {
+			return nil, xerrors.Errorf("invalid cpu %q", lo)
+		}
+		end := start
+		if isRange {
+			end, err = strconv.Atoi(hi)
+			if err != nil {
+				return nil, xerrors.Errorf("invalid cpu %q", hi)
+			}
+		}
+		if start < 0 || end < start {
+			return nil, xerrors.Errorf("invalid cpu range %q", part)
+		}
+		for i := start; i <= end; i++ {
+			set[i] = struct{}{}
+		}
+	}
+
+	cpus := make([]int, 0, len(set))
+	for cpu := range set {
+		cpus = append(cpus, cpu)
+	}
+	sort.Ints(cpus)
+	return cpus, nil
+}
+
+// RLimit is a resource limit. A value of -1 means unlimited.
+type RLimit struct {
+	Soft int64
+	Hard int64
+}
+
+// rlimitNames maps the descriptions in /proc/<pid>/limits to the names used
+// by 'docker run --ulimit'.
+var rlimitNames = map[string]string{
+	"Max cpu time":          "cpu",
+	"Max file size":         "fsize",
+	"Max data size":         "data",
+	"Max stack size":        "stack",
+	"Max core file size":    "core",
+	"Max resident set":      "rss",
+	"Max processes":         "nproc",
+	"Max open files":        "nofile",
+	"Max locked memory":     "memlock",
+	"Max address space":     "as",
+	"Max file locks":        "locks",
+	"Max pending signals":   "sigpending",
+	"Max msgqueue size":     "msgqueue",
+	"Max nice priority":     "nice",
+	"Max realtime priority": "rtprio",
+	"Max realtime timeout":  "rttime",
+}
+
+// ReadRLimits reads the resource limits of the current process from
+// /proc/self/limits keyed by their ulimit name (e.g. 'nofile').
+func ReadRLimits(ctx context.Context) (map[string]RLimit, error) {
+	fs := GetFS(ctx)
+	f, err := fs.Open("/proc/self/limits")
+	if err != nil {
+		return nil, xerrors.Errorf("open /proc/self/limits: %w", err)
+	}
+	defer f.Close()
+
+	limits := make(map[string]RLimit)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		// Columns are aligned and descriptions contain spaces so the
+		// description is matched by prefix.
+		for desc, name := range rlimitNames {
+			rest, ok := strings.CutPrefix(line, desc+" ")
+			if !ok {
+				continue
+			}
+			fields := strings.Fields(rest)
+			if len(fields) < 2 {
+				return nil, xerrors.Errorf("unexpected line %q", line)
+			}
+			soft, err := parseRLimit(fields[0])
+			if err != nil {
+				return nil, xerrors.Errorf("parse %s soft limit: %w", name, err)
+			}
+			hard, err := parseRLimit(fields[1])
+			if err != nil {
+				return nil, xerrors.Errorf("parse %s hard limit: %w", name, err)
+			}
+			limits[name] = RLimit{Soft: soft, Hard: hard}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, xerrors.Errorf("scan /proc/self/limits: %w", err)
+	}
+
+	return limits, nil
+}
+
+func parseRLimit(s string) (int64, error) {
+	if s == "unlimited" {
+		return -1, nil
+	}
+	return strconv.ParseInt(s, 10, 64)
+}
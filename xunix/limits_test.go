@@ -0,0 +1,234 @@
+package xunix_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+
+	"cdr.dev/slog/v3/sloggers/slogtest"
+
+	"github.com/coder/envbox/xunix"
+	"github.com/coder/envbox/xunix/xunixfake"
+)
+
+const (
+	pidsMaxPathCGroupV1     = "/sys/fs/cgroup/pids/pids.max"
+	memoryLimitPathCGroupV1 = "/sys/fs/cgroup/memory/memory.limit_in_bytes"
+	cpuSetPathCGroupV1      = "/sys/fs/cgroup/cpuset/cpuset.effective_cpus"
+	blkioWeightPathCGroupV1 = "/sys/fs/cgroup/blkio/blkio.weight"
+)
+
+func TestReadCGroupLimits(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		Name     string
+		FS       map[string]string
+		Expected xunix.CGroupLimits
+		Error    string
+	}{
+		{
+			Name: "CGroupV1",
+			FS: map[string]string{
+				pidsMaxPathCGroupV1:     "2048\n",
+				memoryLimitPathCGroupV1: "4294967296\n",
+				cpuSetPathCGroupV1:      "0-3\n",
+				blkioWeightPathCGroupV1: "100\n",
+			},
+			Expected: xunix.CGroupLimits{
+				CGroup:    xunix.CGroupV1,
+				PidsMax:   2048,
+				MemoryMax: 4294967296,
+				CPUSet:    "0-3",
+				IOWeight:  true,
+			},
+		},
+		{
+			Name: "CGroupV1_Unlimited",
+			FS: map[string]string{
+				pidsMaxPathCGroupV1:     "max\n",
+				memoryLimitPathCGroupV1: "9223372036854771712\n",
+			},
+			Expected: xunix.CGroupLimits{
+				CGroup:    xunix.CGroupV1,
+				PidsMax:   -1,
+				MemoryMax: -1,
+			},
+		},
+		{
+			Name: "CGroupV2",
+			FS: map[string]string{
+				"/proc/self/cgroup":                                           "0::/kubepods/pod/container\n",
+				"/sys/fs/cgroup/cgroup.controllers":                           "cpuset cpu io memory pids\n",
+				"/sys/fs/cgroup/kubepods/pod/container/cgroup.controllers":    "cpuset cpu memory pids\n",
+				"/sys/fs/cgroup/kubepods/pod/container/pids.max":              "1024\n",
+				"/sys/fs/cgroup/kubepods/pod/container/memory.max":            "max\n",
+				"/sys/fs/cgroup/kubepods/pod/container/cpuset.cpus.effective": "0-1,4\n",
+			},
+			Expected: xunix.CGroupLimits{
+				CGroup:    xunix.CGroupV2,
+				PidsMax:   1024,
+				MemoryMax: -1,
+				CPUSet:    "0-1,4",
+			},
+		},
+		{
+			Name: "CGroupV2_RootFallback",
+			FS: map[string]string{
+				"/proc/self/cgroup":                 "0::/kubepods/pod/container\n",
+				"/sys/fs/cgroup/cgroup.controllers": "cpu io memory pids\n",
+				"/sys/fs/cgroup/memory.max":         "1073741824\n",
+			},
+			Expected: xunix.CGroupLimits{
+				CGroup:    xunix.CGroupV2,
+				PidsMax:   -1,
+				MemoryMax: 1073741824,
+				IOWeight:  true,
+			},
+		},
+		{
+			Name: "CGroupV2_Invalid",
+			FS: map[string]string{
+				"/sys/fs/cgroup/cgroup.controllers": "pids\n",
+				"/sys/fs/cgroup/pids.max":           "invalid\n",
+			},
+			Error: `"invalid" not an int`,
+		},
+	} {
+		tc := tc
+		t.Run(tc.Name, func(t *testing.T) {
+			t.Parallel()
+			tmpfs := &xunixfake.MemFS{MemMapFs: &afero.MemMapFs{}}
+			ctx := xunix.WithFS(context.Background(), tmpfs)
+			for path, content := range tc.FS {
+				require.NoError(t, afero.WriteFile(tmpfs, path, []byte(content), 0o644))
+			}
+			actual, err := xunix.ReadCGroupLimits(ctx)
+			if tc.Error == "" {
+				require.NoError(t, err)
+				require.Equal(t, tc.Expected, actual)
+			} else {
+				require.ErrorContains(t, err, tc.Error)
+			}
+		})
+	}
+}
+
+func TestParseCPUSet(t *testing.T) {
+	t.Parallel()
+
+	cpus, err := xunix.ParseCPUSet("4,0-2,1")
+	require.NoError(t, err)
+	require.Equal(t, []int{0, 1, 2, 4}, cpus)
+
+	cpus, err = xunix.ParseCPUSet("")
+	require.NoError(t, err)
+	require.Empty(t, cpus)
+
+	_, err = xunix.ParseCPUSet("3-1")
+	require.Error(t, err)
+
+	_, err = xunix.ParseCPUSet("a")
+	require.Error(t, err)
+}
+
+func TestReadRLimits(t *testing.T) {
+	t.Parallel()
+
+	const limits = `Limit                     Soft Limit           Hard Limit           Units
+Max cpu time              unlimited            unlimited            seconds
+Max processes             63459                63459                processes
+Max open files            1024                 1048576              files
+Max locked memory         8388608              8388608              bytes
+`
+
+	tmpfs := xunixfake.NewMemFS()
+	ctx := xunix.WithFS(context.Background(), tmpfs)
+	require.NoError(t, afero.WriteFile(tmpfs, "/proc/self/limits", []byte(limits), 0o644))
+
+	actual, err := xunix.ReadRLimits(ctx)
+	require.NoError(t, err)
+	require.Equal(t, map[string]xunix.RLimit{
+		"cpu":     {Soft: -1, Hard: -1},
+		"nproc":   {Soft: 63459, Hard: 63459},
+		"nofile":  {Soft: 1024, Hard: 1048576},
+		"memlock": {Soft: 8388608, Hard: 8388608},
+	}, actual)
+}
+
+func TestReadMemoryLimit(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		Name     string
+		FS       map[string]string
+		Expected xunix.MemoryLimit
+		Error    string
+	}{
+		{
+			Name: "CGroupV1",
+			FS: map[string]string{
+				memoryLimitPathCGroupV1: "4294967296\n",
+			},
+			Expected: xunix.MemoryLimit{Limit: 4294967296, CGroup: xunix.CGroupV1},
+		},
+		{
+			Name: "CGroupV1_Unlimited",
+			FS: map[string]string{
+				memoryLimitPathCGroupV1: "9223372036854771712\n",
+			},
+			Expected: xunix.MemoryLimit{Limit: -1, CGroup: xunix.CGroupV1},
+		},
+		{
+			Name: "CGroupV2",
+			FS: map[string]string{
+				"/proc/self/cgroup": "0::/kubepods/pod/container\n",
+				"/sys/fs/cgroup/kubepods/pod/container/memory.max":  "4294967296\n",
+				"/sys/fs/cgroup/kubepods/pod/container/memory.high": "max\n",
+			},
+			Expected: xunix.MemoryLimit{Limit: 4294967296, CGroup: xunix.CGroupV2},
+		},
+		{
+			Name: "CGroupV2_High",
+			FS: map[string]string{
+				"/proc/self/cgroup":          "0::/kubepods/pod/container\n",
+				"/sys/fs/cgroup/memory.max":  "max\n",
+				"/sys/fs/cgroup/memory.high": "2147483648\n",
+			},
+			Expected: xunix.MemoryLimit{Limit: 2147483648, CGroup: xunix.CGroupV2},
+		},
+		{
+			Name: "CGroupV2_Unlimited",
+			FS: map[string]string{
+				"/sys/fs/cgroup/cgroup.controllers": "cpu memory pids\n",
+				"/sys/fs/cgroup/memory.max":         "max\n",
+			},
+			Expected: xunix.MemoryLimit{Limit: -1, CGroup: xunix.CGroupV2},
+		},
+		{
+			Name:  "Empty",
+			FS:    map[string]string{},
+			Error: "file does not exist",
+		},
+	} {
+		tc := tc
+		t.Run(tc.Name, func(t *testing.T) {
+			t.Parallel()
+			log := slogtest.Make(t, &slogtest.Options{IgnoreErrors: true})
+			tmpfs := xunixfake.NewMemFS()
+			ctx := xunix.WithFS(context.Background(), tmpfs)
+			for path, content := range tc.FS {
+				require.NoError(t, afero.WriteFile(tmpfs, path, []byte(content), 0o644))
+			}
+			actual, err := xunix.ReadMemoryLimit(ctx, log)
+			if tc.Error == "" {
+				require.NoError(t, err)
+				require.Equal(t, tc.Expected, actual)
+			} else {
+				require.ErrorContains(t, err, tc.Error)
+			}
+		})
+	}
+}
@@ -1,6 +1,8 @@
 package xunix
 
 import (
+	"net"
+
 	"github.com/vishvananda/netlink"
 	"golang.org/x/xerrors"
 )
@@ -13,3 +15,28 @@ func NetlinkMTU(name string) (int, error) {
 
 	return defaultLink.Attrs().MTU, nil
 }
+
+// NetlinkIPv4Nets returns the IPv4 networks of the addresses of a link.
+func NetlinkIPv4Nets(name string) ([]*net.IPNet, error) {
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		return nil, xerrors.Errorf("get %s: %w", name, err)
+	}
+
+	addrs, err := netlink.AddrList(link, netlink.FAMILY_V4)
+	if err != nil {
+		return nil, xerrors.Errorf("list addresses of %s: %w", name, err)
+	}
+
+	nets := make([]*net.IPNet, 0, len(addrs))
+	for _, addr := range addrs {
+		if addr.IPNet == nil {
+			continue
+		}
+		nets = append(nets, &net.IPNet{
+			IP:   addr.IP.Mask(addr.Mask),
+			Mask: addr.Mask,
+		})
+	}
+	return nets, nil
+}
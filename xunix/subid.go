@@ -0,0 +1,104 @@
+package xunix
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"golang.org/x/xerrors"
+)
+
+const (
+	SubUIDPath = "/etc/subuid"
+	SubGIDPath = "/etc/subgid"
+)
+
+// SubIDRange is a range of subordinate IDs from /etc/subuid or
+// /etc/subgid.
+type SubIDRange struct {
+	Name  string
+	Start int
+	Count int
+}
+
+// ParseSubIDs parses the ranges of an /etc/subuid or /etc/subgid.
+func ParseSubIDs(r io.Reader) ([]SubIDRange, error) {
+	var (
+		scanner = bufio.NewScanner(r)
+		ranges  []SubIDRange
+	)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Split(line, ":")
+		if len(fields) != 3 {
+			return nil, xerrors.Errorf("malformed subordinate ID range %q", line)
+		}
+		start, err := strconv.Atoi(fields[1])
+		if err != nil || start < 0 {
+			return nil, xerrors.Errorf("invalid start of subordinate ID range %q", line)
+		}
+		count, err := strconv.Atoi(fields[2])
+		if err != nil || count <= 0 {
+			return nil, xerrors.Errorf("invalid count of subordinate ID range %q", line)
+		}
+		ranges = append(ranges, SubIDRange{
+			Name:  fields[0],
+			Start: start,
+			Count: count,
+		})
+	}
+
+	err := scanner.Err()
+	if err != nil {
+		return nil, xerrors.Errorf("scan subordinate IDs: %w", err)
+	}
+	return ranges, nil
+}
+
+// SetSubIDRange returns the contents of an /etc/subuid or /etc/subgid with
+// r as the only range of r.Name. It takes the place of the user's first
+// range, which is the one a user namespace created for the user, e.g. by
+// dockerd's --userns-remap, maps container ID 0 to. Other lines are kept
+// as they are. An error is returned if r overlaps the range of another
+// user.
+func SetSubIDRange(content []byte, r SubIDRange) ([]byte, error) {
+	ranges, err := ParseSubIDs(bytes.NewReader(content))
+	if err != nil {
+		return nil, err
+	}
+	for _, o := range ranges {
+		if o.Name != r.Name && o.Start < r.Start+r.Count && r.Start < o.Start+o.Count {
+			return nil, xerrors.Errorf("IDs %d-%d of user %q overlap IDs %d-%d of user %q", r.Start, r.Start+r.Count-1, r.Name, o.Start, o.Start+o.Count-1, o.Name)
+		}
+	}
+
+	var (
+		entry = fmt.Sprintf("%s:%d:%d", r.Name, r.Start, r.Count)
+		lines []string
+		set   bool
+	)
+	for _, line := range strings.SplitAfter(string(content), "\n") {
+		if line == "" {
+			continue
+		}
+		if !strings.HasPrefix(strings.TrimSpace(line), r.Name+":") {
+			lines = append(lines, strings.TrimSuffix(line, "\n"))
+			continue
+		}
+		if !set {
+			lines = append(lines, entry)
+			set = true
+		}
+	}
+	if !set {
+		lines = append(lines, entry)
+	}
+	return []byte(strings.Join(lines, "\n") + "\n"), nil
+}
@@ -0,0 +1,81 @@
+package xunix_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/coder/envbox/xunix"
+)
+
+func TestParseSubIDs(t *testing.T) {
+	t.Parallel()
+
+	t.Run("OK", func(t *testing.T) {
+		t.Parallel()
+
+		ranges, err := xunix.ParseSubIDs(strings.NewReader("# comment\ncoder:100000:65536\n\nsysbox:300000:131072\n"))
+		require.NoError(t, err)
+		require.Equal(t, []xunix.SubIDRange{
+			{Name: "coder", Start: 100000, Count: 65536},
+			{Name: "sysbox", Start: 300000, Count: 131072},
+		}, ranges)
+	})
+
+	t.Run("Malformed", func(t *testing.T) {
+		t.Parallel()
+
+		for _, line := range []string{"coder:100000", "coder:abc:65536", "coder:100000:0"} {
+			_, err := xunix.ParseSubIDs(strings.NewReader(line))
+			require.Error(t, err, line)
+		}
+	})
+}
+
+func TestSetSubIDRange(t *testing.T) {
+	t.Parallel()
+
+	coder := xunix.SubIDRange{Name: "coder", Start: 200000, Count: 65536}
+	for _, tc := range []struct {
+		name     string
+		content  string
+		expected string
+		error    string
+	}{
+		{
+			name:     "Empty",
+			expected: "coder:200000:65536\n",
+		},
+		{
+			// Every range of the user is replaced by one in place of
+			// the first.
+			name:     "Replaced",
+			content:  "# comment\ncoder:100000:65536\nsysbox:300000:65536\ncoder:500000:1000",
+			expected: "# comment\ncoder:200000:65536\nsysbox:300000:65536\n",
+		},
+		{
+			name:     "Appended",
+			content:  "sysbox:300000:65536\n",
+			expected: "sysbox:300000:65536\ncoder:200000:65536\n",
+		},
+		{
+			name:    "Overlap",
+			content: "sysbox:250000:65536\n",
+			error:   `IDs 200000-265535 of user "coder" overlap IDs 250000-315535 of user "sysbox"`,
+		},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			content, err := xunix.SetSubIDRange([]byte(tc.content), coder)
+			if tc.error != "" {
+				require.ErrorContains(t, err, tc.error)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.expected, string(content))
+		})
+	}
+}
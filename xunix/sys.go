@@ -1,16 +1,14 @@
 package xunix
 
 import (
-	"bytes"
 	"context"
-	"path/filepath"
-	"strconv"
-	"strings"
 
 	"github.com/spf13/afero"
 	"golang.org/x/xerrors"
 
 	"cdr.dev/slog/v3"
+
+	"github.com/coder/envbox/xunix/cgroup"
 )
 
 type CPUQuota struct {
@@ -24,120 +22,53 @@ const (
 	CPUQuotaPathCGroupV1  = "/sys/fs/cgroup/cpu,cpuacct/cpu.cfs_quota_us"
 )
 
-type CGroup int
-
-func (c CGroup) String() string {
-	return [...]string{"cgroupv1", "cgroupv2"}[c]
-}
+// CGroup is the version of a cgroup hierarchy.
+type CGroup = cgroup.Version
 
 const (
-	CGroupV1 CGroup = iota
-	CGroupV2
+	CGroupV1 = cgroup.V1
+	CGroupV2 = cgroup.V2
 )
 
 // ReadCPUQuota attempts to read the CFS CPU quota and period from the current
-// container context. It first attempts to read the paths relevant to cgroupv2
-// and falls back to reading the paths relevant go cgroupv1
+// container context. The hierarchy managing the cpu controller is located
+// using /proc/self/cgroup and /proc/self/mountinfo. If the quota is set on
+// multiple levels of the hierarchy (e.g. on the pod and the container) the
+// most restrictive one is returned.
 //
 // Relevant paths for cgroupv2:
 // - /proc/self/cgroup
 // - /sys/fs/cgroup/<self>/cpu.max
 //
 // Relevant paths for cgroupv1:
-// - /sys/fs/cgroup/cpu,cpuacct/cpu.cfs_quota_us
-// - /sys/fs/cgroup/cpu,cpuacct/cpu.cfs_period_us
+// - /sys/fs/cgroup/cpu,cpuacct/<self>/cpu.cfs_quota_us
+// - /sys/fs/cgroup/cpu,cpuacct/<self>/cpu.cfs_period_us
+//
+// When /sys/fs/cgroup has been remounted to be rooted at the current cgroup
+// (e.g. after `unshare --cgroup` + `mount -t cgroup2`) the files are read
+// from the mount root instead.
 func ReadCPUQuota(ctx context.Context, log slog.Logger) (CPUQuota, error) {
-	quota, err := readCPUQuotaCGroupV2(ctx)
-	if err == nil {
-		return quota, nil
-	}
-
-	log.Info(ctx, "Unable to read cgroupv2 quota, falling back to cgroupv1", slog.Error(err))
-	return readCPUQuotaCGroupV1(ctx)
-}
-
-func readCPUQuotaCGroupV2(ctx context.Context) (CPUQuota, error) {
-	fs := GetFS(ctx)
-	self, err := ReadCGroupSelf(ctx)
-	if err != nil {
-		return CPUQuota{}, xerrors.Errorf("determine own cgroup: %w", err)
-	}
-
-	// Try the standard path (self-relative) first.
-	selfPath := filepath.Join("/sys/fs/cgroup/", self, "cpu.max")
-	maxStr, err := afero.ReadFile(fs, selfPath)
-	if err != nil {
-		// Fallback: read cpu.max at the mount root. This handles the case where
-		// `/sys/fs/cgroup/` has been remounted to be rooted at the current
-		// cgroup (e.g. after `unshare --cgroup` + `mount -t cgroup2`), so the
-		// self-relative path no longer exists — but the mount root IS the
-		// current cgroup and its cpu.max reflects the same limits.
-		const rootPath = "/sys/fs/cgroup/cpu.max"
-		rootMaxStr, rootErr := afero.ReadFile(fs, rootPath)
-		if rootErr != nil {
-			return CPUQuota{}, xerrors.Errorf("read cpu.max outside container (tried %s: %v; fallback %s: %w)", selfPath, err, rootPath, rootErr)
-		}
-		maxStr = rootMaxStr
-	}
-
-	list := strings.Split(string(bytes.TrimSpace(maxStr)), " ")
-	if len(list) != 2 {
-		return CPUQuota{}, xerrors.Errorf("expected cpu.max to have exactly two entries, got: %s", string(maxStr))
-	}
-
-	var quota int
-	var period int
-
-	if list[0] == "max" {
-		quota = -1
-	} else {
-		quota, err = strconv.Atoi(list[0])
-		if err != nil {
-			return CPUQuota{}, xerrors.Errorf("quota %s not an int: %w", list[0], err)
-		}
-	}
-
-	period, err = strconv.Atoi(list[1])
-	if err != nil {
-		return CPUQuota{}, xerrors.Errorf("period %s not an int: %w", list[1], err)
-	}
-
-	return CPUQuota{Quota: quota, Period: period, CGroup: CGroupV2}, nil
-}
-
-func readCPUQuotaCGroupV1(ctx context.Context) (CPUQuota, error) {
-	fs := GetFS(ctx)
-	periodRaw, err := afero.ReadFile(fs, CPUPeriodPathCGroupV1)
+	cg, err := cgroup.Load(GetFS(ctx))
 	if err != nil {
-		return CPUQuota{}, xerrors.Errorf("read cpu.cfs_period_us outside container: %w", err)
+		return CPUQuota{}, xerrors.Errorf("load cgroups: %w", err)
 	}
+	log.Debug(ctx, "reading cpu quota", slog.F("cgroup_mode", cg.Mode.String()))
 
-	quotaRaw, err := afero.ReadFile(fs, CPUQuotaPathCGroupV1)
+	quota, v, err := cg.CPUQuota()
 	if err != nil {
-		return CPUQuota{}, xerrors.Errorf("read cpu.cfs_quota_us outside container: %w", err)
-	}
-
-	periodStr := string(bytes.TrimSpace(periodRaw))
-	period, err := strconv.Atoi(periodStr)
-	if err != nil {
-		return CPUQuota{}, xerrors.Errorf("period %s not an int: %w", periodStr, err)
-	}
-
-	quotaStr := string(bytes.TrimSpace(quotaRaw))
-	quota, err := strconv.Atoi(quotaStr)
-	if err != nil {
-		return CPUQuota{}, xerrors.Errorf("quota %s not an int: %w", quotaStr, err)
+		return CPUQuota{}, err
 	}
 
 	return CPUQuota{
-		Quota:  quota,
-		Period: period,
+		Quota:  int(quota.Quota),
+		Period: int(quota.Period),
+		CGroup: v,
 	}, nil
 }
 
-// readCGroup attempts to determine the cgroup for the container by
-// reading the fields of /proc/self/cgroup (third field)
-// We currently only check the first line of /proc/self/cgroup.
+// ReadCGroupSelf returns the cgroup of the current process as listed in
+// /proc/self/cgroup. The cgroupv2 entry is preferred, otherwise the first
+// entry is returned.
 func ReadCGroupSelf(ctx context.Context) (string, error) {
 	fs := GetFS(ctx)
 	raw, err := afero.ReadFile(fs, "/proc/self/cgroup")
@@ -145,17 +76,18 @@ func ReadCGroupSelf(ctx context.Context) (string, error) {
 		return "", xerrors.Errorf("read /proc/self/cgroup: %w", err)
 	}
 
-	lines := bytes.Split(raw, []byte("\n"))
-	if len(lines) == 0 {
+	hierarchies, err := cgroup.ParseProcCGroup(raw)
+	if err != nil {
+		return "", xerrors.Errorf("parse /proc/self/cgroup: %w", err)
+	}
+	if len(hierarchies) == 0 {
 		return "", xerrors.Errorf("unexpected content of /proc/self/cgroup: %s", string(raw))
 	}
 
-	// Just pick the first line.
-	line := lines[0]
-	fields := bytes.Split(line, []byte(":"))
-	if len(fields) != 3 {
-		return "", xerrors.Errorf("expected 3 fields in last line of /proc/self/cgroup: %s", string(raw))
+	for _, h := range hierarchies {
+		if h.Version() == cgroup.V2 {
+			return h.Path, nil
+		}
 	}
-
-	return string(fields[2]), nil
+	return hierarchies[0].Path, nil
 }
@@ -25,7 +25,13 @@ func ParsePasswd(r io.Reader) ([]*User, error) {
 	)
 
 	for scanner.Scan() {
-		usr, err := parsePasswdEntry(scanner.Text())
+		line := strings.TrimSpace(scanner.Text())
+		// A full /etc/passwd may contain blank lines or comments.
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		usr, err := parsePasswdEntry(line)
 		if err != nil {
 			return nil, xerrors.Errorf("failed to parse user entry: %w", err)
 		}
@@ -58,3 +64,61 @@ func parsePasswdEntry(entry string) (*User, error) {
 		Shell: fields[6],
 	}, nil
 }
+
+// Group is a linux group from /etc/group.
+type Group struct {
+	user.Group
+	// Members are the usernames of the group's supplementary members.
+	Members []string
+}
+
+// ParseGroup parses group entries from an /etc/group.
+func ParseGroup(r io.Reader) ([]*Group, error) {
+	var (
+		scanner = bufio.NewScanner(r)
+		groups  = make([]*Group, 0)
+	)
+
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		grp, err := parseGroupEntry(line)
+		if err != nil {
+			return nil, xerrors.Errorf("failed to parse group entry: %w", err)
+		}
+
+		groups = append(groups, grp)
+	}
+
+	err := scanner.Err()
+	if err != nil {
+		return nil, xerrors.Errorf("failed to parse group: %w", err)
+	}
+
+	return groups, nil
+}
+
+func parseGroupEntry(entry string) (*Group, error) {
+	fields := strings.Split(entry, ":")
+	if len(fields) < 4 {
+		return nil, xerrors.Errorf("group info (%s) contained an unexpected number of fields", fields)
+	}
+
+	var members []string
+	for _, m := range strings.Split(fields[3], ",") {
+		if m = strings.TrimSpace(m); m != "" {
+			members = append(members, m)
+		}
+	}
+
+	return &Group{
+		Group: user.Group{
+			Gid:  fields[2],
+			Name: fields[0],
+		},
+		Members: members,
+	}, nil
+}
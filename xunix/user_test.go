@@ -0,0 +1,39 @@
+package xunix_test
+
+import (
+	"os/user"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/coder/envbox/xunix"
+)
+
+func TestParseGroup(t *testing.T) {
+	t.Parallel()
+
+	t.Run("OK", func(t *testing.T) {
+		t.Parallel()
+
+		groups, err := xunix.ParseGroup(strings.NewReader(`root:x:0:
+# A comment.
+
+sudo:x:27:coder
+docker:x:998:coder, admin
+`))
+		require.NoError(t, err)
+		require.Equal(t, []*xunix.Group{
+			{Group: user.Group{Gid: "0", Name: "root"}},
+			{Group: user.Group{Gid: "27", Name: "sudo"}, Members: []string{"coder"}},
+			{Group: user.Group{Gid: "998", Name: "docker"}, Members: []string{"coder", "admin"}},
+		}, groups)
+	})
+
+	t.Run("Malformed", func(t *testing.T) {
+		t.Parallel()
+
+		_, err := xunix.ParseGroup(strings.NewReader("root:x:0\n"))
+		require.ErrorContains(t, err, "unexpected number of fields")
+	})
+}
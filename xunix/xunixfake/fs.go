@@ -4,6 +4,7 @@ import (
 	"io/fs"
 	"os"
 	"strconv"
+	"syscall"
 
 	"github.com/spf13/afero"
 	"golang.org/x/xerrors"
@@ -18,12 +19,14 @@ func NewMemFS() *MemFS {
 	return &MemFS{
 		MemMapFs: &afero.MemMapFs{},
 		Owner:    map[string]FileOwner{},
+		Xattrs:   map[string]map[string][]byte{},
 	}
 }
 
 type MemFS struct {
 	*afero.MemMapFs
-	Owner map[string]FileOwner
+	Owner  map[string]FileOwner
+	Xattrs map[string]map[string][]byte
 }
 
 func (m *MemFS) Mknod(path string, mode uint32, dev int) error {
@@ -43,14 +46,61 @@ func (m *MemFS) Chown(path string, uid int, gid int) error {
 	return nil
 }
 
+// Lchown is the same as Chown since this is a in-mem fake.
+func (m *MemFS) Lchown(path string, uid int, gid int) error {
+	return m.Chown(path, uid, gid)
+}
+
+func (m *MemFS) Lgetxattr(path, attr string) ([]byte, error) {
+	_, err := m.MemMapFs.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	data, ok := m.Xattrs[path][attr]
+	if !ok {
+		return nil, &os.PathError{Op: "lgetxattr", Path: path, Err: syscall.ENODATA}
+	}
+	return data, nil
+}
+
+func (m *MemFS) Lsetxattr(path, attr string, data []byte) error {
+	_, err := m.MemMapFs.Stat(path)
+	if err != nil {
+		return err
+	}
+	if m.Xattrs[path] == nil {
+		m.Xattrs[path] = map[string][]byte{}
+	}
+	m.Xattrs[path][attr] = data
+	return nil
+}
+
 func (m *MemFS) GetFileOwner(path string) (FileOwner, bool) {
 	owner, ok := m.Owner[path]
 	return owner, ok
 }
 
-// LStat doesn't follow symbolic links since this is a in-mem fake.
+// LStat doesn't follow symbolic links since this is a in-mem fake. The
+// returned info carries the owner recorded by Chown.
 func (m *MemFS) LStat(path string) (fs.FileInfo, error) {
-	return m.MemMapFs.Stat(path)
+	fi, err := m.MemMapFs.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	owner := m.Owner[path]
+	return &fileInfo{
+		FileInfo: fi,
+		stat:     &syscall.Stat_t{Uid: uint32(owner.UID), Gid: uint32(owner.GID)},
+	}, nil
+}
+
+type fileInfo struct {
+	fs.FileInfo
+	stat *syscall.Stat_t
+}
+
+func (fi *fileInfo) Sys() any {
+	return fi.stat
 }
 
 // Readlink doesn't actually read symbolic links since this is a in-mem